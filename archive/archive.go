@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// An archive starts with Magic and the format version, then holds a genesis record, the block records in height
+// order and an end record. A record is its kind, the length of its payload, the payload and a CRC-32C of the three,
+// so a reader detects corruption at the record it hits and truncation by the missing end record.
+const Magic = "BFTARCHV"
+const Version = 1
+const MaxRecordSize = 64 << 20 // bytes
+
+type recordKind byte
+
+const (
+	genesisRecord recordKind = iota + 1
+	blockRecord
+	endRecord
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorrupted is returned for an archive which fails its checksums or does not follow the format
+var ErrCorrupted = errors.New("corrupted archive")
+
+// Writer streams a chain into an archive, Close writes the end record
+type Writer struct {
+	w *bufio.Writer
+	blocks uint64
+	lastHeight uint64
+}
+
+// NewWriter writes the header and the genesis record
+func NewWriter(w io.Writer, genesis *types.Genesis) (*Writer, error) {
+	aw := &Writer{w: bufio.NewWriter(w)}
+	header := make([]byte, len(Magic) + 2)
+	copy(header, Magic)
+	binary.BigEndian.PutUint16(header[len(Magic):], Version)
+	if _, err := aw.w.Write(header); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(genesis)
+	if err != nil {
+		return nil, err
+	}
+	if err := aw.writeRecord(genesisRecord, payload); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// WriteBlock appends a block, the blocks must be written in height order without gaps
+func (aw *Writer) WriteBlock(block *types.Block) error {
+	if aw.blocks > 0 && block.Height() != aw.lastHeight + 1 {
+		return fmt.Errorf("block %d does not follow block %d", block.Height(), aw.lastHeight)
+	}
+	payload, err := encoding.MarshalBinary(*block)
+	if err != nil {
+		return err
+	}
+	if err := aw.writeRecord(blockRecord, payload); err != nil {
+		return err
+	}
+	aw.blocks++
+	aw.lastHeight = block.Height()
+	return nil
+}
+
+// Close writes the end record with the number of blocks and flushes, it does not close the underlying writer
+func (aw *Writer) Close() error {
+	payload := make([]byte, 16)
+	binary.BigEndian.PutUint64(payload, aw.blocks)
+	binary.BigEndian.PutUint64(payload[8:], aw.lastHeight)
+	if err := aw.writeRecord(endRecord, payload); err != nil {
+		return err
+	}
+	return aw.w.Flush()
+}
+
+func (aw *Writer) writeRecord(kind recordKind, payload []byte) error {
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("record of %d bytes is larger than %d bytes", len(payload), MaxRecordSize)
+	}
+	header := make([]byte, 5)
+	header[0] = byte(kind)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	checksum := crc32.Update(crc32.Checksum(header, crcTable), crcTable, payload)
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, checksum)
+	for _, b := range [][]byte{header, payload, trailer} {
+		if _, err := aw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads an archive block by block
+type Reader struct {
+	r *bufio.Reader
+	Genesis *types.Genesis
+	blocks uint64
+	lastHeight uint64
+	done bool
+}
+
+// NewReader checks the header and reads the genesis record
+func NewReader(r io.Reader) (*Reader, error) {
+	ar := &Reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(Magic) + 2)
+	if _, err := io.ReadFull(ar.r, header); err != nil {
+		return nil, fmt.Errorf("%w: can not read header: %v", ErrCorrupted, err)
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, fmt.Errorf("%w: not an archive", ErrCorrupted)
+	}
+	if version := binary.BigEndian.Uint16(header[len(Magic):]); version != Version {
+		return nil, fmt.Errorf("unsupported archive version %d", version)
+	}
+	kind, payload, err := ar.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	if kind != genesisRecord {
+		return nil, fmt.Errorf("%w: archive does not start with the genesis", ErrCorrupted)
+	}
+	genesis := &types.Genesis{}
+	if err := json.Unmarshal(payload, genesis); err != nil {
+		return nil, fmt.Errorf("%w: genesis: %v", ErrCorrupted, err)
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, err
+	}
+	ar.Genesis = genesis
+	return ar, nil
+}
+
+// NextBlock returns the next block, or io.EOF after the end record has been checked
+func (ar *Reader) NextBlock() (*types.Block, error) {
+	if ar.done {
+		return nil, io.EOF
+	}
+	kind, payload, err := ar.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case blockRecord:
+		block := types.Block{}
+		if err := encoding.UnmarshalBinary(payload, &block); err != nil {
+			return nil, fmt.Errorf("%w: block after height %d: %v", ErrCorrupted, ar.lastHeight, err)
+		}
+		if ar.blocks > 0 && block.Height() != ar.lastHeight + 1 {
+			return nil, fmt.Errorf("%w: block %d does not follow block %d", ErrCorrupted, block.Height(), ar.lastHeight)
+		}
+		ar.blocks++
+		ar.lastHeight = block.Height()
+		return &block, nil
+	case endRecord:
+		if len(payload) != 16 || binary.BigEndian.Uint64(payload) != ar.blocks || binary.BigEndian.Uint64(payload[8:]) != ar.lastHeight {
+			return nil, fmt.Errorf("%w: end record does not match the %d blocks read", ErrCorrupted, ar.blocks)
+		}
+		ar.done = true
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("%w: unexpected record kind %d", ErrCorrupted, kind)
+	}
+}
+
+func (ar *Reader) readRecord() (recordKind, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(ar.r, header); err != nil {
+		if err == io.EOF {
+			return 0, nil, fmt.Errorf("%w: archive is truncated after height %d", ErrCorrupted, ar.lastHeight)
+		}
+		return 0, nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MaxRecordSize {
+		return 0, nil, fmt.Errorf("%w: record of %d bytes is too large", ErrCorrupted, length)
+	}
+	payload := make([]byte, length + 4)
+	if _, err := io.ReadFull(ar.r, payload); err != nil {
+		return 0, nil, fmt.Errorf("%w: archive is truncated after height %d", ErrCorrupted, ar.lastHeight)
+	}
+	checksum := binary.BigEndian.Uint32(payload[length:])
+	payload = payload[:length]
+	if crc32.Update(crc32.Checksum(header, crcTable), crcTable, payload) != checksum {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch after height %d", ErrCorrupted, ar.lastHeight)
+	}
+	return recordKind(header[0]), payload, nil
+}
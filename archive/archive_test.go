@@ -0,0 +1,156 @@
+package archive
+
+import (
+	"bft/crypto"
+	"bft/database"
+	"bft/testutil"
+	"bft/types"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// testChain is a chain of committed blocks of a single validator
+type testChain struct {
+	key *crypto.PrivateKey
+	validator types.Validator
+	genesis *types.Genesis
+	blockStore *database.BlockStore
+}
+
+func newTestChain(t *testing.T, height uint64) *testChain {
+	c := &testChain{}
+	c.key, c.validator = testutil.NewValidator(t)
+	c.genesis = types.NewGenesis("bft-test", types.Validators{c.validator})
+	c.blockStore = c.newBlockStore(t)
+	for h := uint64(2); h <= height; h++ {
+		head, err := c.blockStore.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.blockStore.AddBlock(testutil.NewCommittedBlock(t, head, c.key, c.validator)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// newBlockStore is an empty store of the chain
+func (c *testChain) newBlockStore(t *testing.T) *database.BlockStore {
+	blockStore, err := database.NewBlockStore(database.NewMemoryStore(), c.genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blockStore
+}
+
+func (c *testChain) export(t *testing.T, start, end uint64) []byte {
+	buf := bytes.Buffer{}
+	if _, err := Export(c.blockStore, &buf, start, end); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func importArchive(blockStore *database.BlockStore, data []byte) (database.HeightRange, error) {
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return database.HeightRange{}, err
+	}
+	return Import(blockStore, reader)
+}
+
+func TestExportImport(t *testing.T) {
+	chain := newTestChain(t, 10)
+	blockStore := chain.newBlockStore(t)
+	if imported, err := importArchive(blockStore, chain.export(t, 0, 6)); err != nil || imported.String() != "2-6" {
+		t.Fatalf("unexpected import %s %v", imported, err)
+	}
+	// an archive which overlaps the stored chain adds the missing blocks
+	if imported, err := importArchive(blockStore, chain.export(t, 4, 0)); err != nil || imported.String() != "7-10" {
+		t.Fatalf("unexpected import %s %v", imported, err)
+	}
+	for height := uint64(1); height <= 10; height++ {
+		expected, _ := chain.blockStore.GetBlockHeader(height)
+		header, err := blockStore.GetBlockHeader(height)
+		if err != nil || !header.HeightId.Equals(expected.HeightId) || len(header.Commits) != len(expected.Commits) {
+			t.Fatalf("block %d is not imported: %v", height, err)
+		}
+	}
+	// an archive has to link to the stored chain
+	if _, err := importArchive(chain.newBlockStore(t), chain.export(t, 5, 0)); err == nil {
+		t.Fatal("an archive with a gap should be rejected")
+	}
+	other := newTestChain(t, 3)
+	if _, err := importArchive(blockStore, other.export(t, 0, 0)); err == nil {
+		t.Fatal("an archive of another chain should be rejected")
+	}
+}
+
+func TestImportVerifies(t *testing.T) {
+	chain := newTestChain(t, 5)
+	blockStore := chain.newBlockStore(t)
+	buf := bytes.Buffer{}
+	aw, err := NewWriter(&buf, chain.genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := uint64(2); height <= 5; height++ {
+		block, _ := chain.blockStore.GetBlockFromHeight(height)
+		if height == 4 {
+			block.Header().Commits = nil
+		}
+		if err := aw.WriteBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := importArchive(blockStore, buf.Bytes())
+	if err == nil || imported.String() != "2-3" {
+		t.Fatalf("a block without commits should stop the import after block 3, got %s %v", imported, err)
+	}
+	if lastHeight, _ := blockStore.LastHeight(); lastHeight != 3 {
+		t.Fatalf("unverified blocks should not be written, last height %d", lastHeight)
+	}
+}
+
+func TestCorruptedArchive(t *testing.T) {
+	chain := newTestChain(t, 5)
+	data := chain.export(t, 0, 0)
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped) / 2] ^= 0xff
+	tests := map[string][]byte{
+		"flipped byte": flipped,
+		"truncated": data[:len(data) - 30],
+		"missing end record": data[:len(data) - 25],
+	}
+	for name, archive := range tests {
+		reader, err := NewReader(bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for err == nil {
+			_, err = reader.NextBlock()
+		}
+		if !errors.Is(err, ErrCorrupted) {
+			t.Fatalf("%s: expected ErrCorrupted, got %v", name, err)
+		}
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("BFTARCH"))); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for ; err == nil; count++ {
+		_, err = reader.NextBlock()
+	}
+	if err != io.EOF || count != 6 {
+		t.Fatalf("expected 5 blocks and io.EOF, got %d %v", count - 1, err)
+	}
+}
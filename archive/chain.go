@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"bft/database"
+	"bft/encoding"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Export writes the genesis and the blocks in [start, end] of blockStore to w, an end of 0 is the last height.
+// Pruned blocks can not be exported. The blocks are read from a snapshot, a node can keep adding blocks meanwhile.
+func Export(blockStore *database.BlockStore, w io.Writer, start, end uint64) (database.HeightRange, error) {
+	snapshot, err := blockStore.Snapshot()
+	if err != nil {
+		return database.HeightRange{}, err
+	}
+	defer snapshot.Close()
+	lastHeight, err := snapshot.LastHeight()
+	if err != nil {
+		return database.HeightRange{}, err
+	}
+	if start == 0 {
+		start = 1
+	}
+	if end == 0 || end > lastHeight {
+		end = lastHeight
+	}
+	if start > end {
+		return database.HeightRange{}, fmt.Errorf("no block in heights %d to %d", start, end)
+	}
+	aw, err := NewWriter(w, snapshot.Genesis())
+	if err != nil {
+		return database.HeightRange{}, err
+	}
+	for height := start; height <= end; height++ {
+		block, err := snapshot.GetBlockFromHeight(height)
+		if errors.Is(err, database.ErrNotFound) {
+			return database.HeightRange{}, fmt.Errorf("block %d is pruned: %w", height, err)
+		}
+		if err != nil {
+			return database.HeightRange{}, err
+		}
+		if err := aw.WriteBlock(block); err != nil {
+			return database.HeightRange{}, err
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return database.HeightRange{}, err
+	}
+	return database.HeightRange{From: start, To: end}, nil
+}
+
+// Import adds the blocks of the archive to blockStore. Each block is verified against the stored chain before it
+// is written, blocks the store already has must match it. It returns the heights which have been added.
+func Import(blockStore *database.BlockStore, ar *Reader) (database.HeightRange, error) {
+	if !ar.Genesis.Hash(encoding.MarshalBinary).Equals(blockStore.GenesisHash()) {
+		return database.HeightRange{}, fmt.Errorf("archive of chain %s does not match the genesis of chain %s", ar.Genesis.ChainId, blockStore.ChainId())
+	}
+	imported := database.HeightRange{}
+	for {
+		block, err := ar.NextBlock()
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, err
+		}
+		lastHeight, err := blockStore.LastHeight()
+		if err != nil {
+			return imported, err
+		}
+		if block.Height() <= lastHeight {
+			header, err := blockStore.GetBlockHeader(block.Height())
+			if err != nil && !errors.Is(err, database.ErrNotFound) {
+				return imported, err
+			}
+			if err == nil && !header.Id().Equals(block.Id()) {
+				return imported, fmt.Errorf("block %s of the archive conflicts with the stored block %s", block.Header().HeightId.String(), header.HeightId.String())
+			}
+			continue
+		}
+		if err := blockStore.VerifyNext(block); err != nil {
+			return imported, err
+		}
+		if err := blockStore.AddBlock(block); err != nil {
+			return imported, err
+		}
+		if imported.Empty() {
+			imported.From = block.Height()
+		}
+		imported.To = block.Height()
+	}
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"bft/database"
+	"bft/types"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const FileName = "config.json"
+const DefaultHomeDir = ".bft"
+
+// Duration is written as a string like "10s" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	s := ""
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+// Config holds the settings of a node. Relative paths are resolved against the home directory.
+// Consensus timeouts are not local settings, they are the consensus params of the genesis.
+type Config struct {
+	Home string `json:"-"`
+	ListenAddress string `json:"listen_address"`
+	ListenPort int `json:"listen_port"`
+	Peers []string `json:"peers"` // multiaddrs with peer id, like /ip4/127.0.0.1/tcp/2000/ipfs/<peer id>
+	RPCAddress string `json:"rpc_address"`
+	DBBackend string `json:"db_backend"` // rocksdb, goleveldb or memory, rocksdb needs the rocksdb build tag
+	DBPath string `json:"db_path"`
+	DBSync bool `json:"db_sync"` // fsync every write, a crash of the machine does not lose committed blocks
+	RetainBlocks uint64 `json:"retain_blocks"` // keep the bodies of the last blocks, 0 keeps them all unless retain_time is set
+	RetainTime Duration `json:"retain_time"` // keep the bodies of the blocks younger than this, 0 keeps them all unless retain_blocks is set
+	RetainHeaders uint64 `json:"retain_headers"` // keep the headers and commits of the last blocks, 0 keeps them all
+	KeyFile string `json:"key_file"` // validator private key in WIF
+	IdentityFile string `json:"identity_file"` // libp2p private key
+	GenesisFile string `json:"genesis_file"`
+	LogLevel string `json:"log_level"` // for example "info,consensus=debug"
+	HandshakePastSkew Duration `json:"handshake_past_skew"`
+	HandshakeFutureSkew Duration `json:"handshake_future_skew"`
+}
+
+func DefaultConfig(home string) *Config {
+	return &Config{
+		Home: home,
+		ListenAddress: "127.0.0.1",
+		ListenPort: 2000,
+		Peers: []string{},
+		RPCAddress: types.RPCAddress,
+		DBBackend: database.DefaultBackend(),
+		DBPath: "data",
+		DBSync: true,
+		KeyFile: "validator.key",
+		IdentityFile: types.HostIdentity,
+		GenesisFile: "genesis.json",
+		LogLevel: "info",
+		HandshakePastSkew: Duration{types.HandshakePastSkew * time.Second},
+		HandshakeFutureSkew: Duration{types.HandshakeFutureSkew * time.Second},
+	}
+}
+
+// DefaultHome is ~/.bft, or .bft in the working directory if there is no home directory
+func DefaultHome() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return DefaultHomeDir
+	}
+	return filepath.Join(home, DefaultHomeDir)
+}
+
+// Load reads the config file of home, settings missing from the file keep their defaults
+func Load(home string) (*Config, error) {
+	config := DefaultConfig(home)
+	b, err := ioutil.ReadFile(filepath.Join(home, FileName))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("can not parse %s: %v", filepath.Join(home, FileName), err)
+	}
+	config.Home = home
+	return config, config.Validate()
+}
+
+func (c *Config) Save() error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Home, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.File(), append(b, '\n'), 0644)
+}
+
+func (c *Config) Validate() error {
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", c.ListenPort)
+	}
+	if !database.HasBackend(c.DBBackend) {
+		return fmt.Errorf("database backend %s is unknown or not built in", c.DBBackend)
+	}
+	if c.RetainTime.Duration < 0 {
+		return fmt.Errorf("retain time can not be negative")
+	}
+	if c.RetainHeaders != 0 {
+		if c.RetainBlocks == 0 && c.RetainTime.Duration == 0 {
+			return fmt.Errorf("retain headers needs retain blocks or retain time, bodies can not outlive their headers")
+		}
+		if c.RetainHeaders < c.RetainBlocks {
+			return fmt.Errorf("retain headers %d is less than retain blocks %d", c.RetainHeaders, c.RetainBlocks)
+		}
+	}
+	if c.HandshakePastSkew.Duration < 0 || c.HandshakeFutureSkew.Duration < 0 {
+		return fmt.Errorf("handshake skew can not be negative")
+	}
+	return nil
+}
+
+func (c *Config) File() string {
+	return filepath.Join(c.Home, FileName)
+}
+
+func (c *Config) DBDir() string {
+	return c.resolve(c.DBPath)
+}
+
+func (c *Config) KeyPath() string {
+	return c.resolve(c.KeyFile)
+}
+
+func (c *Config) IdentityPath() string {
+	return c.resolve(c.IdentityFile)
+}
+
+func (c *Config) GenesisPath() string {
+	return c.resolve(c.GenesisFile)
+}
+
+func (c *Config) RetentionPolicy() database.RetentionPolicy {
+	return database.RetentionPolicy{
+		KeepBlocks: c.RetainBlocks,
+		KeepTime: c.RetainTime.Duration,
+		KeepHeaders: c.RetainHeaders,
+	}
+}
+
+func (c *Config) SkewWindow() types.SkewWindow {
+	return types.SkewWindow{
+		Past: c.HandshakePastSkew.Duration,
+		Future: c.HandshakeFutureSkew.Duration,
+	}
+}
+
+func (c *Config) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.Home, path)
+}
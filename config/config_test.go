@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bft/database"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tempHome(t *testing.T) string {
+	home, err := ioutil.TempDir("", "bft-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return home
+}
+
+func TestSaveLoad(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+	config := DefaultConfig(home)
+	config.Peers = []string{"/ip4/127.0.0.1/tcp/2001/ipfs/QmVJih4nhy6TGVrJKBmtinPFimDD83N3FrmMyQPZmNF7hE"}
+	config.HandshakePastSkew = Duration{3 * time.Second}
+	if err := config.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, loaded) {
+		t.Fatalf("expected %+v, got %+v", config, loaded)
+	}
+}
+
+func TestLoadKeepsDefaults(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+	content := `{"listen_port": 2005, "handshake_future_skew": "1500ms"}`
+	if err := ioutil.WriteFile(filepath.Join(home, FileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := Load(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenPort != 2005 || config.HandshakeFutureSkew.Duration != 1500 * time.Millisecond {
+		t.Fatalf("settings of the file are not loaded: %+v", config)
+	}
+	defaults := DefaultConfig(home)
+	if config.ListenAddress != defaults.ListenAddress || config.DBPath != defaults.DBPath {
+		t.Fatalf("missing settings should keep their defaults: %+v", config)
+	}
+	if config.DBDir() != filepath.Join(home, defaults.DBPath) {
+		t.Fatalf("db path should be relative to home, got %s", config.DBDir())
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+	if _, err := Load(home); err == nil {
+		t.Fatal("loading a missing config should fail")
+	}
+	for _, content := range []string{`{"listen_port": `, `{"handshake_past_skew": "soon"}`, `{"listen_port": 70000}`, `{"db_backend": "leveldb"}`, `{"retain_blocks": 10, "retain_headers": 5}`, `{"retain_headers": 5}`} {
+		if err := ioutil.WriteFile(filepath.Join(home, FileName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(home); err == nil {
+			t.Fatalf("config %s should be rejected", content)
+		}
+	}
+}
+
+func TestFlagsOverride(t *testing.T) {
+	config := DefaultConfig("home")
+	config.LogLevel = "debug"
+	flagSet := flag.NewFlagSet("start", flag.ContinueOnError)
+	flags := RegisterFlags(flagSet)
+	args := []string{"--listen-port", "2003", "--peers", "/ip4/127.0.0.1/tcp/2000/ipfs/a, /ip4/127.0.0.1/tcp/2001/ipfs/b", "--handshake-past-skew", "2s", "--db-sync=false", "--retain-blocks", "100", "--retain-time", "24h"}
+	if err := flagSet.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := flags.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenPort != 2003 || config.HandshakePastSkew.Duration != 2 * time.Second || config.DBSync || config.RetentionPolicy() != (database.RetentionPolicy{KeepBlocks: 100, KeepTime: 24 * time.Hour}) {
+		t.Fatalf("flags are not applied: %+v", config)
+	}
+	expectedPeers := []string{"/ip4/127.0.0.1/tcp/2000/ipfs/a", "/ip4/127.0.0.1/tcp/2001/ipfs/b"}
+	if !reflect.DeepEqual(config.Peers, expectedPeers) {
+		t.Fatalf("expected peers %v, got %v", expectedPeers, config.Peers)
+	}
+	// flags which are not set keep the config
+	if config.LogLevel != "debug" || config.ListenAddress != "127.0.0.1" {
+		t.Fatalf("unset flags should not override the config: %+v", config)
+	}
+}
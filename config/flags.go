@@ -0,0 +1,87 @@
+package config
+
+import (
+	"flag"
+	"strings"
+)
+
+// Flags are settings given on the command line, only the flags which have been set override the config file
+type Flags struct {
+	flagSet *flag.FlagSet
+	values Config
+	peers string
+}
+
+// RegisterFlags adds the config flags to flagSet, the --home flag is registered separately by the caller
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	f := &Flags{flagSet: flagSet}
+	flagSet.StringVar(&f.values.ListenAddress, "listen-address", "", "ip address to listen on for peers")
+	flagSet.IntVar(&f.values.ListenPort, "listen-port", 0, "tcp port to listen on for peers")
+	flagSet.StringVar(&f.peers, "peers", "", "comma separated multiaddrs of peers")
+	flagSet.StringVar(&f.values.RPCAddress, "rpc-address", "", "listen address of the rpc server")
+	flagSet.StringVar(&f.values.DBBackend, "db-backend", "", "database backend: rocksdb, goleveldb or memory")
+	flagSet.StringVar(&f.values.DBPath, "db-path", "", "database directory")
+	flagSet.BoolVar(&f.values.DBSync, "db-sync", true, "fsync every database write")
+	flagSet.Uint64Var(&f.values.RetainBlocks, "retain-blocks", 0, "keep the bodies of the last blocks, 0 keeps them all")
+	flagSet.DurationVar(&f.values.RetainTime.Duration, "retain-time", 0, "keep the bodies of the blocks younger than this, 0 keeps them all")
+	flagSet.Uint64Var(&f.values.RetainHeaders, "retain-headers", 0, "keep the headers and commits of the last blocks, 0 keeps them all")
+	flagSet.StringVar(&f.values.KeyFile, "key-file", "", "validator key file")
+	flagSet.StringVar(&f.values.IdentityFile, "identity-file", "", "libp2p identity file")
+	flagSet.StringVar(&f.values.GenesisFile, "genesis-file", "", "genesis file shared by the network")
+	flagSet.StringVar(&f.values.LogLevel, "log-level", "", "log levels, for example info,consensus=debug")
+	flagSet.DurationVar(&f.values.HandshakePastSkew.Duration, "handshake-past-skew", 0, "how old a handshake may be")
+	flagSet.DurationVar(&f.values.HandshakeFutureSkew.Duration, "handshake-future-skew", 0, "how far ahead of the local clock a handshake may be")
+	return f
+}
+
+// Apply overrides config with the flags which have been set
+func (f *Flags) Apply(config *Config) error {
+	f.flagSet.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "listen-address":
+			config.ListenAddress = f.values.ListenAddress
+		case "listen-port":
+			config.ListenPort = f.values.ListenPort
+		case "peers":
+			config.Peers = splitList(f.peers)
+		case "rpc-address":
+			config.RPCAddress = f.values.RPCAddress
+		case "db-backend":
+			config.DBBackend = f.values.DBBackend
+		case "db-path":
+			config.DBPath = f.values.DBPath
+		case "db-sync":
+			config.DBSync = f.values.DBSync
+		case "retain-blocks":
+			config.RetainBlocks = f.values.RetainBlocks
+		case "retain-time":
+			config.RetainTime = Duration{f.values.RetainTime.Duration}
+		case "retain-headers":
+			config.RetainHeaders = f.values.RetainHeaders
+		case "key-file":
+			config.KeyFile = f.values.KeyFile
+		case "identity-file":
+			config.IdentityFile = f.values.IdentityFile
+		case "genesis-file":
+			config.GenesisFile = f.values.GenesisFile
+		case "log-level":
+			config.LogLevel = f.values.LogLevel
+		case "handshake-past-skew":
+			config.HandshakePastSkew = Duration{f.values.HandshakePastSkew.Duration}
+		case "handshake-future-skew":
+			config.HandshakeFutureSkew = Duration{f.values.HandshakeFutureSkew.Duration}
+		}
+	})
+	return config.Validate()
+}
+
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,24 @@
+package consensus
+
+import "time"
+
+// Timer is stopped when the step it guards is left
+type Timer interface {
+	Stop() bool
+}
+
+// Clock schedules the step timeouts, tests replace it to control time
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -3,35 +3,120 @@ package consensus
 import (
 	"bft/types"
 	"sync"
-	"log"
-	"crypto/sha256"
+	"bft/logging"
 	"bft/crypto"
 	"math"
 	"time"
 	"bft/database"
 	"bft/encoding"
+	"bft/events"
 	"fmt"
+	"encoding/binary"
 )
 
 type BroadcastFunc func(message types.Message)
 
 type ConsensusManager struct {
-	mutex sync.Mutex
+	mutex sync.Mutex // guards currentState, which the RPC reads through the accessors while consensus replaces it
 	currentState *ConsensusState
-	validatorSet *types.ValidatorSet
+	validatorSet *types.ValidatorSet // validators of the current height
 	blockStore *database.BlockStore
 	signer crypto.SignFunc
 	broadcaster BroadcastFunc
-	roundChangeTimer *time.Timer
-	f int // maximum number of faults
+	roundChangeTimer Timer
+	clock Clock
+	mempool *Mempool
+	eventBus *events.EventBus
+	lastCommitTime time.Time
+	params types.ConsensusParams
+	logger logging.Logger
 }
 
-func NewConsensusManager(validators types.Validators, address string) *ConsensusManager {
+// NewConsensusManager takes the validators and the consensus params from blockStore, which derives them from
+// the genesis
+func NewConsensusManager(blockStore *database.BlockStore, address string) (*ConsensusManager, error) {
+	if blockStore == nil {
+		return nil, fmt.Errorf("block store is not initialized")
+	}
 	cm := &ConsensusManager{}
-	cm.validatorSet = types.NewValidatorSet(validators, address)
-	cm.blockStore = database.GetBlockStore()
-	cm.f = int(math.Floor(float64(cm.validatorSet.Size())/3))
-	return cm
+	cm.blockStore = blockStore
+	cm.mempool = NewMempool(types.MempoolSize, types.MempoolTTL * time.Second)
+	cm.clock = systemClock{}
+	cm.logger = logging.Default().With(logging.Module("consensus"))
+	head, err := cm.head()
+	if err != nil {
+		return nil, err
+	}
+	cm.validatorSet, err = cm.blockStore.GetValidatorSet(head.Height() + 1, address)
+	if err != nil {
+		return nil, err
+	}
+	if !cm.validatorSet.IsValidator() {
+		cm.logger.Info("local node is not a validator", logging.F("address", address))
+	}
+	cm.params, err = cm.blockStore.GetConsensusParams(head.Height() + 1)
+	if err != nil {
+		return nil, err
+	}
+	heightGauge.Set(float64(head.Height()))
+	return cm, nil
+}
+
+// updateValidatorSet switches to the validators which sign the block at the given height. The set of the next
+// height continues the proposer rotation of the current one, a set further away is restored from the block store.
+func (cm *ConsensusManager) updateValidatorSet(height uint64) {
+	vs := cm.validatorSet
+	if vs.Height() == height {
+		return
+	}
+	if vs.Height() + 1 == height {
+		validators, err := cm.blockStore.GetValidators(height)
+		if err != nil {
+			cm.logger.Error("can not load validators", logging.Height(height), logging.Err(err))
+			return
+		}
+		cm.setValidatorSet(vs.NextHeight(validators))
+		return
+	}
+	vs, err := cm.blockStore.GetValidatorSet(height, cm.address())
+	if err != nil {
+		cm.logger.Error("can not load validators", logging.Height(height), logging.Err(err))
+		return
+	}
+	cm.setValidatorSet(vs)
+}
+
+func (cm *ConsensusManager) setValidatorSet(vs *types.ValidatorSet) {
+	if vs.IsValidator() != cm.validatorSet.IsValidator() {
+		cm.logger.Info("validator set changed", logging.Height(vs.Height()), logging.F("address", cm.address()), logging.F("validator", vs.IsValidator()))
+	}
+	cm.validatorSet = vs
+}
+
+// updateParams switches to the consensus params which apply to the given height
+func (cm *ConsensusManager) updateParams(height uint64) {
+	params, err := cm.blockStore.GetConsensusParams(height)
+	if err != nil {
+		cm.logger.Error("can not load consensus params", logging.Height(height), logging.Err(err))
+		return
+	}
+	if params != cm.params {
+		cm.logger.Info("consensus params changed", logging.Height(height), logging.F("params", params))
+	}
+	cm.params = params
+}
+
+func (cm *ConsensusManager) SetLogger(logger logging.Logger) {
+	cm.logger = logger
+	if cm.currentState != nil {
+		cm.currentState.logger = logger
+	}
+}
+
+// SetClock replaces the system clock which schedules the step timeouts
+func (cm *ConsensusManager) SetClock(clock Clock) {
+	cm.clock = clock
+	cm.mempool.SetClock(clock)
 }
 
 func (cm *ConsensusManager) SetSigner(signer crypto.SignFunc) {
@@ -42,7 +127,78 @@ func (cm *ConsensusManager) SetBroadcaster(broadcaster BroadcastFunc) {
 	cm.broadcaster = broadcaster
 }
 
-func (cm *ConsensusManager) head() *types.Block {
+// SetEventBus publishes committed blocks, state transitions and new rounds to the bus
+func (cm *ConsensusManager) SetEventBus(eventBus *events.EventBus) {
+	cm.eventBus = eventBus
+	if cm.currentState != nil {
+		cm.currentState.eventBus = eventBus
+	}
+}
+
+// Start enters the first round on top of the stored head
+func (cm *ConsensusManager) Start() {
+	cm.startNewRound(0)
+}
+
+// View returns the height and round which the validator is working on
+func (cm *ConsensusManager) View() types.View {
+	cs := cm.state()
+	if cs == nil {
+		return types.View{}
+	}
+	cs.rwMutex.RLock()
+	defer cs.rwMutex.RUnlock()
+	return cs.view
+}
+
+func (cm *ConsensusManager) StateType() ConsensusStateType {
+	cs := cm.state()
+	if cs == nil {
+		return NewRound
+	}
+	cs.rwMutex.RLock()
+	defer cs.rwMutex.RUnlock()
+	return cs.stateType
+}
+
+func (cm *ConsensusManager) IsStarted() bool {
+	return cm.state() != nil
+}
+
+// state returns the state of the current height, the fields of the state are guarded by its own lock
+func (cm *ConsensusManager) state() *ConsensusState {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	return cm.currentState
+}
+
+func (cm *ConsensusManager) setState(cs *ConsensusState) {
+	cm.mutex.Lock()
+	cm.currentState = cs
+	cm.mutex.Unlock()
+}
+
+func (cm *ConsensusManager) Mempool() *Mempool {
+	return cm.mempool
+}
+
+// BroadcastTransaction adds a transaction to the mempool and gossips it to peers
+func (cm *ConsensusManager) BroadcastTransaction(tx types.Transaction) (types.Hash, error) {
+	hash, err := cm.mempool.Add(tx)
+	if err != nil {
+		return hash, err
+	}
+	payload, err := encoding.MarshalBinary(tx)
+	if err != nil {
+		return hash, err
+	}
+	if cm.broadcaster != nil {
+		cm.broadcaster(types.NewMessage(types.TransactionMessage, payload))
+	}
+	return hash, nil
+}
+
+func (cm *ConsensusManager) head() (*types.Block, error) {
 	return cm.blockStore.Head()
 }
 
@@ -52,25 +208,36 @@ func (cm *ConsensusManager) Receive(message types.Message) {
 	case types.VoteMessage:
 		vote, err := message.ToVote(encoding.UnmarshalBinary)
 		if err != nil {
-			log.Println(err)
+			cm.logger.Warn("unable to parse vote", logging.Err(err))
 			return
 		}
 		cm.onVote(vote)
 	case types.ProposalMessage:
 		proposal, err := message.ToProposal(encoding.UnmarshalBinary)
 		if err != nil {
-			log.Println(err)
+			cm.logger.Warn("unable to parse proposal", logging.Err(err))
 			return
 		}
 		cm.onProposal(proposal)
+	case types.TransactionMessage:
+		tx, err := message.ToTransaction(encoding.UnmarshalBinary)
+		if err != nil {
+			cm.logger.Warn("unable to parse transaction", logging.Err(err))
+			return
+		}
+		// relay transactions which are new to us only
+		if _, err := cm.BroadcastTransaction(tx); err != nil {
+			cm.logger.Debug("transaction is not relayed", logging.Err(err))
+		}
 	}
 }
 
 func (cm *ConsensusManager) onVote(vote *types.Vote) {
 	if vote == nil {
-		log.Println("unable to parse vote")
+		cm.logger.Warn("unable to parse vote")
 		return
 	}
+	votesReceived.Inc(vote.Type.String())
 	switch vote.Type {
 	case types.Prepare:
 		cm.onPrepare(*vote)
@@ -83,7 +250,7 @@ func (cm *ConsensusManager) onVote(vote *types.Vote) {
 
 func (cm *ConsensusManager) onProposal(proposal *types.Proposal) {
 	if proposal == nil {
-		log.Println("unable to parse proposal")
+		cm.logger.Warn("unable to parse proposal")
 		return
 	}
 	// check proposal's round and height
@@ -96,13 +263,13 @@ func (cm *ConsensusManager) onProposal(proposal *types.Proposal) {
 	}
 	sender := proposal.Sender
 	// Is proposal from valid proposer
-	if !cm.validatorSet.IsProposer(sender) {
-		log.Println("Don't accept a proposal from unknown proposer")
+	if !cm.validatorSet.IsProposer(sender, cm.currentState.view) {
+		cm.logger.Warn("don't accept a proposal from unknown proposer", logging.Height(proposal.View.Height), logging.Round(proposal.View.Round), logging.F("sender", sender.Address))
 		return
 	}
 	// check proposal
 	if err := cm.verifyProposal(proposal); err != nil {
-		log.Println(err)
+		cm.logger.Warn("invalid proposal", logging.Height(proposal.View.Height), logging.Round(proposal.View.Round), logging.Err(err))
 		//TODO: handle the future block
 		cm.sendRoundChange(cm.currentState.round() + 1)
 		return
@@ -116,6 +283,7 @@ func (cm *ConsensusManager) enterPrePrepared(proposal *types.Proposal) {
 		if cs.isLocked() {
 			if cs.proposal.BlockHeightId().Equals(cs.lockedHeightId) {
 				cs.setSate(Prepared)
+				cm.newRoundChangeTimer()
 				cm.sendVote(types.Commit)
 			} else {
 				// should go to next round
@@ -124,6 +292,7 @@ func (cm *ConsensusManager) enterPrePrepared(proposal *types.Proposal) {
 		} else {
 			cs.setProposal(proposal)
 			cs.setSate(PrePrepared)
+			cm.newRoundChangeTimer()
 			cm.sendVote(types.Prepare)
 		}
 	}
@@ -148,6 +317,7 @@ func (cm *ConsensusManager) enterPrepared() {
 	// lock proposal block
 	cs.lock()
 	cs.setSate(Prepared)
+	cm.newRoundChangeTimer()
 	cm.sendVote(types.Commit)
 }
 
@@ -155,10 +325,10 @@ func (cm *ConsensusManager) enterPrepared() {
 func (cm *ConsensusManager) canEnterPrepared() bool {
 	cs := cm.currentState
 	if cs.stateType >= Prepared {
-		log.Printf("current state %s is greater than prepared", cs.stateType.String())
+		cm.logger.Debug("state is already prepared", logging.F("state", cs.stateType.String()))
 		return false
 	}
-	if cs.prepares().Size() < 2*cm.f + 1 {
+	if !cm.validatorSet.HasTwoThirdsMajority(cs.prepares().VotingPower()) {
 		return false
 	}
 	return true
@@ -179,10 +349,10 @@ func (cm *ConsensusManager) onCommit(vote types.Vote) {
 func (cm *ConsensusManager) canEnterCommitted() bool {
 	cs := cm.currentState
 	if cs.stateType >= Committed {
-		log.Printf("current state %s is greater than prepared", cs.stateType.String())
+		cm.logger.Debug("state is already committed", logging.F("state", cs.stateType.String()))
 		return false
 	}
-	if cs.commits().Size() < 2*cm.f + 1 {
+	if !cm.validatorSet.HasTwoThirdsMajority(cs.commits().VotingPower()) {
 		return false
 	}
 	return true
@@ -201,10 +371,20 @@ func (cm *ConsensusManager) enterCommitted() {
 			commits = append(commits, vote)
 		}
 		if err := cm.commitBlock(&proposal.Block, commits); err != nil {
+			cm.logger.Error("can not commit block", logging.Height(proposal.Block.Height()), logging.Err(err))
 			cs.unLock()
 			cm.sendRoundChange(cs.round() + 1)
 			return
 		}
+		cm.mempool.Remove(proposal.Block.Transactions)
+		cm.eventBus.Publish(events.NewBlock, events.BlockEvent{Header: *proposal.Block.Header()})
+		heightGauge.Set(float64(proposal.Block.Height()))
+		// the first commit after the start has no previous height to measure from
+		now := cm.clock.Now()
+		if !cm.lastCommitTime.IsZero() {
+			heightDuration.Observe(now.Sub(cm.lastCommitTime).Seconds())
+		}
+		cm.lastCommitTime = now
 		cm.startNewRound(0)
 	}
 }
@@ -214,7 +394,7 @@ func (cm *ConsensusManager) commitBlock(block *types.Block, commits []types.Vote
 		return fmt.Errorf("block is invalid")
 	}
 	header := block.Header()
-	if len(commits) < 2*cm.f + 1 {
+	if !cm.validatorSet.HasTwoThirdsMajority(cm.validatorSet.VotingPowerOf(commits)) {
 		return fmt.Errorf("there are not enough commit votes")
 	}
 	header.Commits = commits
@@ -235,10 +415,11 @@ func (cm *ConsensusManager) onRoundChange(vote types.Vote) {
 	}
 }
 
+// check whether the validator received +1/3 round change for a higher round
 func (cm *ConsensusManager) shouldChangeRound(round uint64) bool {
 	cs := cm.currentState
-	voteCount := cs.roundChanges[round].Size()
-	if cs.stateType == RoundChange && voteCount == cm.f + 1 {
+	power := cs.roundChanges[round].VotingPower()
+	if cs.stateType == RoundChange && cm.validatorSet.HasOneThird(power) {
 		if cs.round() < round {
 			return true
 		}
@@ -246,12 +427,13 @@ func (cm *ConsensusManager) shouldChangeRound(round uint64) bool {
 	return false
 }
 
+// check whether the validator received +2/3 round change
 func (cm *ConsensusManager) shouldStartNewRound(round uint64) bool {
 	cs := cm.currentState
 	stateType := cs.stateType
 	currentRound := cs.round()
-	voteCount := cs.roundChanges[round].Size()
-	if voteCount == 2*cm.f + 1 && (stateType == RoundChange || currentRound < round) {
+	power := cs.roundChanges[round].VotingPower()
+	if cm.validatorSet.HasTwoThirdsMajority(power) && (stateType == RoundChange || currentRound < round) {
 		return true
 	}
 	return false
@@ -260,67 +442,163 @@ func (cm *ConsensusManager) shouldStartNewRound(round uint64) bool {
 func (cm *ConsensusManager) isProposer() bool {
 	vs := cm.validatorSet
 	if vs == nil || vs.Size() == 0 {
-		log.Println("validator set should not be nil or empty")
+		cm.logger.Error("validator set should not be nil or empty")
+		return false
+	}
+	if !vs.IsValidator() {
 		return false
 	}
 	self := vs.Self()
-	return vs.IsProposer(self)
+	return vs.IsProposer(self, cm.currentState.view)
 }
 
 func (cm *ConsensusManager) startNewRound(round uint64) {
 	cs := cm.currentState
-	vs := cm.validatorSet
-	head := cm.head()
-	if head == nil {
-		log.Fatal("blockchain must have a head")
+	head, err := cm.head()
+	if err != nil {
+		cm.logger.Error("can not load head", logging.Err(err))
+		return
 	}
 	newView := types.View{
-		0,
-		head.Height() + 1,
+		Round: 0,
+		Height: head.Height() + 1,
 	}
 	if cs == nil {
-		log.Println("initial round")
+		cm.logger.Info("initial round", logging.Height(newView.Height))
+		cm.updateValidatorSet(newView.Height)
+		cm.updateParams(newView.Height)
 		cs = NewConsensusState(newView, cm.validatorSet)
+		cs.eventBus = cm.eventBus
+		cs.logger = cm.logger
+		cm.setState(cs)
 	} else if head.Height() >= cs.height() {
-		log.Println("catch up latest proposal")
+		cm.logger.Info("catch up latest proposal", logging.Height(newView.Height))
+		cm.updateValidatorSet(newView.Height)
+		cm.updateParams(newView.Height)
 		cs = NewConsensusState(newView, cm.validatorSet)
+		cs.eventBus = cm.eventBus
+		cs.logger = cm.logger
+		cm.setState(cs)
 	} else if head.Height() == cs.height() - 1 {
 		if round == 0 {
 			return
 		}
 		if round < cs.round() {
-			log.Println("new round should be greater than current round")
+			cm.logger.Debug("new round should be greater than current round", logging.Round(round))
 			return
 		}
 		newView.Round = round
 	} else {
-		log.Println("new height should be greater than current height")
+		cm.logger.Warn("new height should be greater than current height", logging.Height(newView.Height))
 	}
 	// delete all old votes
 	for k, _ := range cs.roundChanges {
 		delete(cs.roundChanges, k)
 	}
 	cs.updateView(newView)
-	vs.CalculateProposer(round)
+	cm.eventBus.Publish(events.RoundChange, events.RoundEvent{View: newView})
+	roundGauge.Set(float64(newView.Round))
 	cs.setSate(NewRound)
-	if newView.Round != 0 && cm.isProposer() {
-		if cs.isLocked() {
-			if cs.proposal != nil {
-				cm.sendProposal(*cs.proposal)
-			}
-		} else {
-			//if cs.pendingProposal != nil {
-			//	cm.sendProposal(*cs.pendingProposal)
-			//}
-		}
+	if cm.isProposer() {
+		cm.schedulePropose(newView)
 	}
 	cm.newRoundChangeTimer()
 }
 
+// schedulePropose proposes the block of the view through the clock, so a validator which decides alone does not
+// recurse from height to height. Round 0 waits the block interval after the previous block, a later round proposes
+// right away. Nothing is sent if the view has moved on meanwhile.
+func (cm *ConsensusManager) schedulePropose(view types.View) {
+	delay := time.Duration(0)
+	if view.Round == 0 {
+		delay = types.BlockInterval * time.Millisecond
+	}
+	cm.clock.AfterFunc(delay, func() {
+		if cm.View() != view || cm.StateType() != NewRound {
+			return
+		}
+		cm.propose()
+	})
+}
+
+// propose sends the locked proposal again, or a new block with the pending transactions of the mempool
+func (cm *ConsensusManager) propose() {
+	cs := cm.currentState
+	if cs.isLocked() {
+		if cs.proposal != nil {
+			cm.sendProposal(*cs.proposal)
+		}
+		return
+	}
+	block, err := cm.buildBlock()
+	if err != nil {
+		cm.logger.Error("can not build block", logging.Height(cs.height()), logging.Err(err))
+		return
+	}
+	cm.sendProposal(types.Proposal{Block: *block})
+}
+
+// buildBlock creates the block on top of the head. It takes the oldest pending transactions which fit the limits
+// of the consensus params, they stay in the mempool until the block is committed.
+func (cm *ConsensusManager) buildBlock() (*types.Block, error) {
+	head, err := cm.head()
+	if err != nil {
+		return nil, err
+	}
+	height := head.Height() + 1
+	validatorsHash, err := cm.validatorSet.GetValidators().Hash(encoding.MarshalBinary)
+	if err != nil {
+		return nil, err
+	}
+	nextValidators, err := cm.blockStore.GetValidators(height + 1)
+	if err != nil {
+		return nil, err
+	}
+	nextValidatorsHash, err := nextValidators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return nil, err
+	}
+	header := types.BlockHeader{
+		HeightId: types.BlockHeightId{Height: height},
+		PreviousId: head.Id(),
+		Proposer: cm.validatorSet.Self(),
+		Timestamp: cm.clock.Now().UTC(),
+		ValidatorsHash: validatorsHash,
+		NextValidatorsHash: nextValidatorsHash,
+	}
+	headerData, err := encoding.MarshalBinary(header)
+	if err != nil {
+		return nil, err
+	}
+	// the block adds the signature and the length of the transactions to the header
+	size := uint64(len(headerData) + encoding.SignatureSize + binary.MaxVarintLen64)
+	if size > cm.params.MaxBlockSize {
+		return nil, fmt.Errorf("block header has %d bytes, more than max block size %d", size, cm.params.MaxBlockSize)
+	}
+	block := &types.Block{}
+	block.Transactions = cm.mempool.Reap(cm.params.MaxTransactions, cm.params.MaxBlockSize - size)
+	header.TransactionsHash = block.Transactions.Hash()
+	header.HeightId.Id = header.CalculateId(encoding.MarshalBinary)
+	block.SignedHeader.Header = header
+	blockId := header.Id()
+	block.SignedHeader.Signature, err = cm.signer(blockId[:])
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// changeView moves to the round which the validator asks for, after a timeout or the round-change votes of others
 func (cm *ConsensusManager) changeView(v types.View) {
 	cs := cm.currentState
+	changed := cs.view.Compare(v) != 0
 	cs.setSate(RoundChange)
 	cs.updateView(v)
+	if changed {
+		cm.eventBus.Publish(events.RoundChange, events.RoundEvent{View: v})
+	}
+	roundChanges.Inc()
+	roundGauge.Set(float64(v.Round))
 	cm.newRoundChangeTimer()
 }
 
@@ -330,24 +608,42 @@ func (cm *ConsensusManager) stopRoundChangeTimer() {
 	}
 }
 
+// newRoundChangeTimer restarts the timeout of the current step, a validator asks for a round change when it expires
 func (cm *ConsensusManager) newRoundChangeTimer() {
 	cm.stopRoundChangeTimer()
-	timeout := types.RequestTimeout * time.Millisecond
-	cm.roundChangeTimer = time.AfterFunc(timeout, cm.handleTimeout)
+	cs := cm.currentState
+	step := timeoutStep(cs.stateType)
+	timeout := cm.params.Timeout(step, cs.round())
+	cm.logger.Debug("schedule timeout", logging.Height(cs.height()), logging.Round(cs.round()), logging.F("step", step), logging.F("timeout", timeout))
+	cm.roundChangeTimer = cm.clock.AfterFunc(timeout, cm.handleTimeout)
+}
+
+// timeoutStep is the step which a state waits for. A round change waits for the proposal of the new round.
+func timeoutStep(state ConsensusStateType) types.TimeoutStep {
+	switch state {
+	case PrePrepared:
+		return types.PrepareStep
+	case Prepared:
+		return types.CommitStep
+	default:
+		return types.ProposeStep
+	}
 }
 
 func (cm *ConsensusManager) handleTimeout() {
 	cs := cm.currentState
 	if cs.stateType != RoundChange {
-		threshold := cm.f + 1
-		maxRound := cs.getMaxRound(threshold)
+		maxRound := cs.getMaxRound(cm.validatorSet.HasOneThird)
 		if maxRound != math.MaxUint64 && maxRound > cs.round() {
 			cm.sendRoundChange(maxRound)
 			return
 		}
 	}
-	head := cm.head()
-	if head != nil && head.Height() >= cs.height() {
+	head, err := cm.head()
+	if err != nil {
+		cm.logger.Error("can not load head", logging.Err(err))
+	}
+	if err == nil && head.Height() >= cs.height() {
 		cm.startNewRound(0)
 	} else {
 		cm.sendRoundChange(cs.round() + 1)
@@ -357,6 +653,9 @@ func (cm *ConsensusManager) handleTimeout() {
 func (cm *ConsensusManager) sendVote(voteType types.VoteType) {
 	cs := cm.currentState
 	vs := cm.validatorSet
+	if !vs.IsValidator() {
+		return
+	}
 	voter := vs.Self()
 	view := cs.view
 	blockId := types.Hash{}
@@ -364,23 +663,41 @@ func (cm *ConsensusManager) sendVote(voteType types.VoteType) {
 		blockId = cs.proposal.BlockId()
 	}
 	vote := types.Vote {
-		types.Hash{},
-		voter.Address,
-		voteType,
-		view,
-		blockId,
-		crypto.Signature{},
-	}
-	b, err := encoding.MarshalBinary(vote)
+		Hash: types.Hash{},
+		Address: voter.Address,
+		Type: voteType,
+		View: view,
+		BlockId: blockId,
+		Signature: crypto.Signature{},
+	}
+	hash, err := vote.CalculateHash(encoding.MarshalBinary)
 	if err != nil {
-		log.Println(err)
+		cm.logger.Error("can not hash vote", logging.VoteType(voteType), logging.Err(err))
 		return
 	}
-	hash := sha256.Sum256(b)
 	vote.Hash = hash
+	if voteType != types.RoundChange {
+		state, err := cm.blockStore.SignState()
+		if err != nil {
+			cm.logger.Error("can not load sign state", logging.Err(err))
+			return
+		}
+		if !state.Allows(voter.Address, view) {
+			cm.logger.Warn("vote is below the signed commit", logging.Height(view.Height), logging.Round(view.Round), logging.VoteType(voteType), logging.F("signed_height", state.Height))
+			return
+		}
+	}
+	if voteType == types.Commit {
+		// a rollback must not remove a height whose commit may have been sent
+		state := database.SignState{Address: voter.Address, Height: view.Height, Round: view.Round}
+		if err := cm.blockStore.SaveSignState(state); err != nil {
+			cm.logger.Error("can not save sign state", logging.Height(view.Height), logging.Round(view.Round), logging.Err(err))
+			return
+		}
+	}
 	sig, err := cm.signer(hash[:])
 	if err != nil {
-		log.Println(err)
+		cm.logger.Error("can not sign vote", logging.VoteType(voteType), logging.Err(err))
 		return
 	}
 	vote.Signature = sig
@@ -389,7 +706,7 @@ func (cm *ConsensusManager) sendVote(voteType types.VoteType) {
 	// send to others
 	payload, err := encoding.MarshalBinary(vote)
 	if err != nil {
-		log.Println(err)
+		cm.logger.Error("can not encode vote", logging.VoteType(voteType), logging.Err(err))
 		return
 	}
 	message := types.NewMessage(types.VoteMessage, payload)
@@ -406,7 +723,7 @@ func (cm *ConsensusManager) sendProposal(proposal types.Proposal) {
 	// send to others
 	payload, err := encoding.MarshalBinary(proposal)
 	if err != nil {
-		log.Println(err)
+		cm.logger.Error("can not encode proposal", logging.Err(err))
 		return
 	}
 	message := types.NewMessage(types.ProposalMessage, payload)
@@ -415,8 +732,8 @@ func (cm *ConsensusManager) sendProposal(proposal types.Proposal) {
 
 func (cm *ConsensusManager) sendRoundChange(round uint64) {
 	newView := types.View{
-		round,
-		cm.currentState.height(),
+		Round: round,
+		Height: cm.currentState.height(),
 	}
 	cm.changeView(newView)
 	cm.sendVote(types.RoundChange)
@@ -8,54 +8,98 @@ import (
 	"bft/encoding"
 	"fmt"
 	"log"
-	"os"
 	"bft/database"
+	"bft/events"
+	"math"
 )
 
+func testGenesis() *types.Genesis {
+	publicKey, err := crypto.NewPublicKey("4zWHNAewJRxdzwgfpYzwhJvFzDooxBLHs28JT3AEXEbDMs9ha4")
+	if err != nil {
+		log.Fatal(err)
+	}
+	validator := types.Validator{
+		Address: publicKey.Address(),
+		PublicKey: *publicKey,
+		VotingPower: 1,
+	}
+	genesis := types.NewGenesis("bft-test", types.Validators{validator})
+	genesis.Time = time.Date(2017, 10, 2, 0, 0, 0, 0, time.UTC)
+	return genesis
+}
+
+// newTestBlockStore keeps the chain in memory, every tester starts from the genesis block
+func newTestBlockStore() *database.BlockStore {
+	blockStore, err := database.NewBlockStore(database.NewMemoryStore(), testGenesis())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return blockStore
+}
+
 type tester struct {
 	managers []*ConsensusManager
+	blockStore *database.BlockStore
 }
 
 func newTester() *tester {
-	t := &tester{}
-	managers := consensusManagers()
-	t.managers = managers
+	return newWeightedTester([]uint64{1, 1, 1, 1})
+}
+
+// newWeightedTester creates one manager per voting power
+func newWeightedTester(powers []uint64) *tester {
+	t := &tester{blockStore: newTestBlockStore()}
+	t.managers = consensusManagers(t.blockStore, powers)
 	return t
 }
 
-func newValidator(privateKey *crypto.PrivateKey) types.Validator {
+func newValidator(privateKey *crypto.PrivateKey, power uint64) types.Validator {
 	return types.Validator{
 		PublicKey: *privateKey.PublicKey(),
 		Address: privateKey.PublicKey().Address(),
+		VotingPower: power,
 	}
 }
 
-func consensusManagers() []*ConsensusManager {
+func consensusManagers(blockStore *database.BlockStore, powers []uint64) []*ConsensusManager {
 	validators := make([]types.Validator, 0)
 	privateKeys := make([]*crypto.PrivateKey, 0)
 	cms := make([]*ConsensusManager, 0)
-	for i := 0; i < 4; i++ {
+	for i := 0; i < len(powers); i++ {
 		privateKey, _ := crypto.NewRandomPrivateKey()
 		privateKeys = append(privateKeys, privateKey)
-		validator := newValidator(privateKey)
+		validator := newValidator(privateKey, powers[i])
 		validators = append(validators, validator)
 	}
-	for i := 0; i < 4; i++ {
-		cm := NewConsensusManager(validators, privateKeys[i].PublicKey().Address())
+	// the managers of a tester share the block store
+	blockStore.ResetValidators(validators)
+	for i := 0; i < len(powers); i++ {
+		cm, err := NewConsensusManager(blockStore, privateKeys[i].PublicKey().Address())
+		if err != nil {
+			log.Fatal(err)
+		}
 		cm.SetSigner(privateKeys[i].Sign)
 		view := types.View{
-			1,
-			2,
+			Round: 1,
+			Height: 2,
 		}
 		cm.currentState = NewConsensusState(view, cm.validatorSet)
 		cm.currentState.setSate(NewRound)
-		cm.validatorSet.CalculateProposer(view.Round)
-		log.Println(cm.validatorSet.Proposer().Address)
+		log.Println(cm.validatorSet.GetProposer(view).Address)
 		cms = append(cms, cm)
 	}
 	return cms
 }
 
+// head is the head of the block store shared by the managers
+func (t *tester) head() *types.Block {
+	head, err := t.blockStore.Head()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return head
+}
+
 // return manager of the proposer and it's index
 func (t *tester) managerOfProposer() (*ConsensusManager, int) {
 	managers := t.managers
@@ -76,19 +120,45 @@ func (t *tester) getProposer() (types.Validator, error) {
 }
 
 func (t *tester) newProposal(round, height uint64) (*types.Proposal, error) {
+	return t.newProposalWithUpdates(round, height, nil)
+}
+
+func (t *tester) newProposalWithUpdates(round, height uint64, updates types.Validators) (*types.Proposal, error) {
+	return t.newProposalWithHeader(round, height, func(header *types.BlockHeader) {
+		header.ValidatorUpdates = updates
+	})
+}
+
+// newProposalWithHeader lets modify change the block header before it is signed
+func (t *tester) newProposalWithHeader(round, height uint64, modify func(header *types.BlockHeader)) (*types.Proposal, error) {
 	manager, _ := t.managerOfProposer()
-	head := manager.head()
+	head := t.head()
 	blockHeightId := types.BlockHeightId{ Height: head.Height() + 1 }
 	proposer, err := t.getProposer()
 	if err != nil {
 		return nil, err
 	}
+	validatorsHash, err := manager.validatorSet.GetValidators().Hash(encoding.MarshalBinary)
+	if err != nil {
+		return nil, err
+	}
+	nextValidators, err := manager.blockStore.GetValidators(blockHeightId.Height + 1)
+	if err != nil {
+		return nil, err
+	}
+	nextValidatorsHash, err := nextValidators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return nil, err
+	}
 	blockHeader := types.BlockHeader{
 		HeightId: blockHeightId,
 		PreviousId: head.Id(),
 		Proposer: proposer,
 		Timestamp: time.Now().UTC(),
+		ValidatorsHash: validatorsHash,
+		NextValidatorsHash: nextValidatorsHash,
 	}
+	modify(&blockHeader)
 	blockHeader.HeightId.Id = blockHeader.CalculateId(encoding.MarshalBinary)
 	signedBlockHeader := types.SignedBlockHeader{Header: blockHeader}
 	blockId := blockHeader.Id()
@@ -99,8 +169,8 @@ func (t *tester) newProposal(round, height uint64) (*types.Proposal, error) {
 	signedBlock := types.Block{ SignedHeader: signedBlockHeader }
 	proposal := &types.Proposal{
 		View: types.View{
-			round,
-			height,
+			Round: round,
+			Height: height,
 		},
 		Block: signedBlock,
 	}
@@ -125,7 +195,7 @@ func TestParseAndVerifyProposal(t *testing.T) {
 	proposer := proposal.Proposer()
 	managers := tester.managers
 	for _, cm := range managers {
-		if !cm.validatorSet.IsProposer(proposer) {
+		if !cm.validatorSet.IsProposer(proposer, proposal.View) {
 			t.Fatal("Don't accept a proposal from unknown proposer")
 		}
 		if err := cm.verifyProposal(proposal); err != nil {
@@ -158,6 +228,34 @@ func TestEnterPrePrepared(t *testing.T) {
 	}
 }
 
+// after a forced rollback the validator does not vote at the removed heights
+func TestSignStateRefusesVotes(t *testing.T) {
+	tester := newTester()
+	proposal, err := tester.newProposal(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := tester.managers[0]
+	if err := tester.blockStore.SaveSignState(database.SignState{Address: cm.address(), Height: 2, Round: math.MaxUint64}); err != nil {
+		t.Fatal(err)
+	}
+	var sent []types.Message
+	cm.SetBroadcaster(func(message types.Message) {
+		sent = append(sent, message)
+	})
+	cm.enterPrePrepared(proposal)
+	if len(sent) != 0 {
+		t.Fatalf("the prepare vote at a held height should be refused, sent %d messages", len(sent))
+	}
+	if err := tester.blockStore.SaveSignState(database.SignState{Address: cm.address(), Height: 1, Round: 1}); err != nil {
+		t.Fatal(err)
+	}
+	cm.sendVote(types.Prepare)
+	if len(sent) != 1 {
+		t.Fatalf("the prepare vote above the sign state should be sent, sent %d messages", len(sent))
+	}
+}
+
 func TestEnterPrepared(t *testing.T) {
 	tester := newTester()
 	err := tester.enterPrePrepared()
@@ -210,14 +308,271 @@ func TestCommitBlock(t *testing.T) {
 	}
 	managers := tester.managers
 	tester.setBroadcaster(tester.broadcast)
+	bus := events.NewEventBus()
+	subscription := bus.Subscribe(events.Filter{Types: []events.EventType{events.NewBlock, events.StateChange}}, 100)
+	for _, cm := range managers {
+		cm.SetEventBus(bus)
+	}
 	for _, cm := range managers {
 		cm.enterPrePrepared(proposal)
 	}
-	lastHeight := database.GetBlockStore().LastHeight()
+	lastHeight, err := tester.blockStore.LastHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
 	if lastHeight != 2 {
 		t.Fatal("it fails to commit block")
 	}
-	os.RemoveAll(database.DBPath)
+	// the block is published once, by the manager which stored it
+	states := make(map[string]bool, 0)
+	blocks := 0
+	for len(subscription.Events()) > 0 {
+		event := <-subscription.Events()
+		switch data := event.Data.(type) {
+		case events.StateEvent:
+			states[data.State] = true
+		case events.BlockEvent:
+			if data.Header.Height() != 2 || len(data.Header.Commits) < 3 {
+				t.Fatalf("unexpected block %s", data.Header.HeightId.String())
+			}
+			blocks++
+		}
+	}
+	if blocks != 1 || !states[PrePrepared.String()] || !states[Prepared.String()] || !states[Committed.String()] {
+		t.Fatalf("unexpected events: %d blocks, states %v", blocks, states)
+	}
+	// the managers share the store, the last one which signed a commit is recorded
+	state, err := tester.blockStore.SignState()
+	if err != nil || state == nil || state.Height != 2 || state.Round != 1 {
+		t.Fatalf("the commit should be recorded before it is sent, got %v %v", state, err)
+	}
+	// the commit certificate is verifiable from the header and the validators in its hash
+	block, err := tester.blockStore.GetBlockFromHeight(lastHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators, err := tester.blockStore.GetValidators(lastHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := block.Header().VerifyCommits(validators, encoding.MarshalBinary); err != nil {
+		t.Fatal(err)
+	}
+	block.Header().Commits = block.Header().Commits[:2]
+	if err := block.Header().VerifyCommits(validators, encoding.MarshalBinary); err == nil {
+		t.Fatal("2 of 4 commits should not be enough")
+	}
+}
+
+func TestValidatorUpdatesTakeEffectLater(t *testing.T) {
+	tester := newTester()
+	blockStore := tester.blockStore
+	removed := tester.managers[0].validatorSet.Self()
+	removed.VotingPower = 0
+	head := tester.head()
+	proposal, err := tester.newProposalWithUpdates(0, head.Height() + 1, types.Validators{removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range tester.managers {
+		if err := cm.verifyProposal(proposal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := blockStore.AddBlock(&proposal.Block); err != nil {
+		t.Fatal(err)
+	}
+	height := proposal.Block.Height()
+	for h := height; h < height + types.ValidatorUpdateDelay; h++ {
+		validators, err := blockStore.GetValidators(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(validators) != 4 {
+			t.Fatalf("expected 4 validators at height %d, got %d", h, len(validators))
+		}
+	}
+	validators, err := blockStore.GetValidators(height + types.ValidatorUpdateDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 3 {
+		t.Fatalf("expected 3 validators, got %d", len(validators))
+	}
+	cm := tester.managers[0]
+	cm.updateValidatorSet(height + types.ValidatorUpdateDelay)
+	if cm.validatorSet.IsValidator() {
+		t.Fatal("removed validator should not be in the validator set")
+	}
+	if cm.validatorSet.TotalVotingPower() != 3 {
+		t.Fatalf("expected total voting power 3, got %d", cm.validatorSet.TotalVotingPower())
+	}
+}
+
+func TestConsensusParamsUpdateTakesEffectLater(t *testing.T) {
+	tester := newTester()
+	blockStore := tester.blockStore
+	head := tester.head()
+	height := head.Height() + 1
+	oldParams, err := blockStore.GetConsensusParams(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newParams := oldParams
+	newParams.MaxTransactions = oldParams.MaxTransactions + 1
+	newParams.MaxEvidenceAge = oldParams.MaxEvidenceAge + 1
+	updateAt := func(effectiveHeight uint64) func(header *types.BlockHeader) {
+		return func(header *types.BlockHeader) {
+			header.ParamsUpdates = []types.ConsensusParamsUpdate{{Height: effectiveHeight, Params: newParams}}
+		}
+	}
+	early, err := tester.newProposalWithHeader(0, height, updateAt(height + types.ParamsUpdateDelay - 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tester.managers[0].verifyProposal(early); err == nil {
+		t.Fatal("consensus params update before the update delay should be rejected")
+	}
+	if err := blockStore.AddBlock(&early.Block); err == nil {
+		t.Fatal("block store should reject an early consensus params update")
+	}
+	proposal, err := tester.newProposalWithHeader(0, height, updateAt(height + types.ParamsUpdateDelay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cm := range tester.managers {
+		if err := cm.verifyProposal(proposal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := blockStore.AddBlock(&proposal.Block); err != nil {
+		t.Fatal(err)
+	}
+	for h := height; h < height + types.ParamsUpdateDelay; h++ {
+		params, err := blockStore.GetConsensusParams(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params != oldParams {
+			t.Fatalf("params of height %d should not change yet, got %+v", h, params)
+		}
+	}
+	params, err := blockStore.GetConsensusParams(height + types.ParamsUpdateDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != newParams {
+		t.Fatalf("expected params %+v, got %+v", newParams, params)
+	}
+	cm := tester.managers[0]
+	cm.updateParams(height + types.ParamsUpdateDelay)
+	if cm.params != newParams {
+		t.Fatalf("consensus manager should switch to %+v, got %+v", newParams, cm.params)
+	}
+}
+
+func TestRejectOversizedBlock(t *testing.T) {
+	tester := newTester()
+	cm := tester.managers[0]
+	proposal, err := tester.newProposal(0, tester.head().Height() + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.verifyProposal(proposal); err != nil {
+		t.Fatal(err)
+	}
+	cm.params.MaxBlockSize = 10
+	if err := cm.verifyProposal(proposal); err == nil {
+		t.Fatal("block larger than the max block size should be rejected")
+	}
+}
+
+func TestWeightedPrepareQuorum(t *testing.T) {
+	tester := newWeightedTester([]uint64{7, 2, 2, 2})
+	proposal, err := tester.newProposal(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester.setBroadcaster(broadcastNothing)
+	for _, cm := range tester.managers {
+		cm.enterPrePrepared(proposal)
+	}
+	heavy, lights := tester.splitByPower(7)
+	// neither the heavy validator (7 of 13) nor the observer can prepare alone, together they hold 9 of 13
+	observer := lights[0]
+	heavy.SetBroadcaster(deliverTo(observer))
+	heavy.sendVote(types.Prepare)
+	if state := observer.currentState.stateType; state != Prepared {
+		t.Fatalf("expected prepared, got %s", state.String())
+	}
+}
+
+func TestWeightedPrepareWithoutQuorum(t *testing.T) {
+	tester := newWeightedTester([]uint64{7, 2, 2, 2})
+	proposal, err := tester.newProposal(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tester.setBroadcaster(broadcastNothing)
+	for _, cm := range tester.managers {
+		cm.enterPrePrepared(proposal)
+	}
+	_, lights := tester.splitByPower(7)
+	// three of four validators hold only 6 of 13
+	observer := lights[0]
+	for _, cm := range lights[1:] {
+		cm.SetBroadcaster(deliverTo(observer))
+		cm.sendVote(types.Prepare)
+	}
+	if power := observer.currentState.prepares().VotingPower(); power != 6 {
+		t.Fatalf("expected voting power 6, got %d", power)
+	}
+	if state := observer.currentState.stateType; state != PrePrepared {
+		t.Fatalf("expected pre-prepared, got %s", state.String())
+	}
+}
+
+func TestWeightedRoundChange(t *testing.T) {
+	tester := newWeightedTester([]uint64{5, 2, 2, 2})
+	tester.setBroadcaster(broadcastNothing)
+	heavy, lights := tester.splitByPower(5)
+	observer := lights[0]
+	observer.sendRoundChange(2)
+	// a single light validator holds 2 of 11, which is not enough to follow
+	lights[1].SetBroadcaster(deliverTo(observer))
+	lights[1].sendRoundChange(3)
+	if round := observer.currentState.round(); round != 2 {
+		t.Fatalf("expected round 2, got %d", round)
+	}
+	// the heavy validator holds 5 of 11, more than 1/3 but not enough to start the round with the observer
+	heavy.SetBroadcaster(deliverTo(observer))
+	heavy.sendRoundChange(4)
+	if round := observer.currentState.round(); round != 4 {
+		t.Fatalf("expected round 4, got %d", round)
+	}
+	if state := observer.currentState.stateType; state != RoundChange {
+		t.Fatalf("expected round change, got %s", state.String())
+	}
+}
+
+// splitByPower returns the manager with the given voting power and the others
+func (t *tester) splitByPower(power uint64) (*ConsensusManager, []*ConsensusManager) {
+	var found *ConsensusManager
+	others := make([]*ConsensusManager, 0)
+	for _, cm := range t.managers {
+		if found == nil && cm.validatorSet.Self().VotingPower == power {
+			found = cm
+			continue
+		}
+		others = append(others, cm)
+	}
+	return found, others
+}
+
+func deliverTo(target *ConsensusManager) BroadcastFunc {
+	return func(message types.Message) {
+		target.Receive(message)
+	}
 }
 
 func (t *tester) enterPrePrepared() error {
@@ -297,4 +652,61 @@ func (t *tester) broadcast(message types.Message) {
 	for _, manager := range t.managers {
 		manager.Receive(message)
 	}
-}
\ No newline at end of file
+}
+func TestHeightDurationSkipsFirstCommit(t *testing.T) {
+	tester := newWeightedTester([]uint64{1})
+	cm := tester.managers[0]
+	clock := newFakeClock()
+	cm.SetClock(clock)
+	cm.SetBroadcaster(broadcastNothing)
+	observed := heightDuration.Count()
+	// a single validator commits its own proposals
+	cm.propose()
+	if tester.head().Height() != 2 {
+		t.Fatal("block 2 should be committed")
+	}
+	if heightDuration.Count() != observed {
+		t.Fatal("the first commit should not be observed")
+	}
+	clock.Advance(types.BlockInterval * time.Millisecond)
+	if tester.head().Height() != 3 {
+		t.Fatal("block 3 should be committed")
+	}
+	if heightDuration.Count() != observed + 1 {
+		t.Fatal("the second commit should be observed")
+	}
+}
+
+func TestStatusDuringCommits(t *testing.T) {
+	tester := newWeightedTester([]uint64{1})
+	cm := tester.managers[0]
+	clock := newFakeClock()
+	cm.SetClock(clock)
+	cm.SetBroadcaster(broadcastNothing)
+	// the RPC reads the status while consensus moves from height to height
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if cm.IsStarted() {
+					cm.View()
+					cm.StateType()
+				}
+			}
+		}
+	}()
+	cm.propose()
+	for i := 0; i < 3; i++ {
+		clock.Advance(types.BlockInterval * time.Millisecond)
+	}
+	close(done)
+	<-finished
+	if height := cm.View().Height; height != tester.head().Height() + 1 {
+		t.Fatalf("expected view height %d, got %d", tester.head().Height() + 1, height)
+	}
+}
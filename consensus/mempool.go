@@ -0,0 +1,155 @@
+package consensus
+
+import (
+	"bft/types"
+	"fmt"
+	"sync"
+	"time"
+	"encoding/binary"
+)
+
+// txSizeOverhead is the length prefix of a transaction in an encoded block
+const txSizeOverhead = binary.MaxVarintLen64
+
+// Mempool keeps submitted transactions which are not committed yet, in arrival order. A transaction which has not
+// been committed within the ttl is dropped.
+type Mempool struct {
+	mutex sync.Mutex
+	txs map[types.Hash]pendingTransaction
+	order []types.Hash
+	maxSize int
+	ttl time.Duration
+	clock Clock
+}
+
+type pendingTransaction struct {
+	tx types.Transaction
+	added time.Time
+}
+
+func NewMempool(maxSize int, ttl time.Duration) *Mempool {
+	return &Mempool{
+		txs: make(map[types.Hash]pendingTransaction, 0),
+		order: make([]types.Hash, 0),
+		maxSize: maxSize,
+		ttl: ttl,
+		clock: systemClock{},
+	}
+}
+
+// SetClock replaces the system clock which ages the transactions
+func (mp *Mempool) SetClock(clock Clock) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.clock = clock
+}
+
+func (mp *Mempool) Add(tx types.Transaction) (types.Hash, error) {
+	hash := tx.Hash()
+	if len(tx) == 0 {
+		return hash, fmt.Errorf("transaction is empty")
+	}
+	if len(tx) > types.MaxTransactionSize {
+		return hash, fmt.Errorf("transaction has %d bytes, the limit is %d", len(tx), types.MaxTransactionSize)
+	}
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.evictExpired()
+	if _, ok := mp.txs[hash]; ok {
+		return hash, fmt.Errorf("transaction %s is existing", hash.String())
+	}
+	if len(mp.order) >= mp.maxSize {
+		return hash, fmt.Errorf("mempool is full")
+	}
+	mp.txs[hash] = pendingTransaction{tx, mp.clock.Now()}
+	mp.order = append(mp.order, hash)
+	return hash, nil
+}
+
+// evictExpired drops the transactions older than the ttl, they are at the front of the arrival order
+func (mp *Mempool) evictExpired() {
+	if mp.ttl <= 0 {
+		return
+	}
+	now := mp.clock.Now()
+	expired := 0
+	for _, hash := range mp.order {
+		if now.Sub(mp.txs[hash].added) < mp.ttl {
+			break
+		}
+		delete(mp.txs, hash)
+		expired++
+	}
+	mp.order = mp.order[expired:]
+}
+
+// Remove drops the committed transactions, unknown ones are ignored
+func (mp *Mempool) Remove(txs types.Transactions) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	removed := 0
+	for _, tx := range txs {
+		hash := tx.Hash()
+		if _, ok := mp.txs[hash]; ok {
+			delete(mp.txs, hash)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return
+	}
+	order := make([]types.Hash, 0, len(mp.txs))
+	for _, hash := range mp.order {
+		if _, ok := mp.txs[hash]; ok {
+			order = append(order, hash)
+		}
+	}
+	mp.order = order
+	mp.evictExpired()
+}
+
+// Reap returns the oldest pending transactions, at most maxCount of them which encode to at most maxBytes.
+// The transactions stay in the pool until a block commits them.
+func (mp *Mempool) Reap(maxCount uint64, maxBytes uint64) types.Transactions {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.evictExpired()
+	txs := make(types.Transactions, 0)
+	size := uint64(0)
+	for _, hash := range mp.order {
+		tx := mp.txs[hash].tx
+		txSize := uint64(len(tx) + txSizeOverhead)
+		if uint64(len(txs)) >= maxCount || size + txSize > maxBytes {
+			break
+		}
+		txs = append(txs, tx)
+		size += txSize
+	}
+	return txs
+}
+
+func (mp *Mempool) Has(hash types.Hash) bool {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	_, ok := mp.txs[hash]
+	return ok
+}
+
+func (mp *Mempool) Size() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.evictExpired()
+	return len(mp.order)
+}
+
+// Transactions returns the pending transactions in arrival order
+func (mp *Mempool) Transactions() []types.Transaction {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.evictExpired()
+	txs := make([]types.Transaction, 0)
+	for _, hash := range mp.order {
+		txs = append(txs, mp.txs[hash].tx)
+	}
+	return txs
+}
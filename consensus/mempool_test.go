@@ -0,0 +1,126 @@
+package consensus
+
+import (
+	"bft/types"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestTransactions(n int) types.Transactions {
+	txs := make(types.Transactions, 0)
+	for i := 0; i < n; i++ {
+		txs = append(txs, types.Transaction(fmt.Sprintf("tx-%d", i)))
+	}
+	return txs
+}
+
+// commitTransactions lets the proposer of the tester propose a block with the pending transactions, every manager
+// shares the mempool
+func (t *tester) commitTransactions(mempool *Mempool) (*types.Block, error) {
+	clock := newFakeClock()
+	for _, cm := range t.managers {
+		cm.mempool = mempool
+		cm.SetClock(clock)
+	}
+	t.setBroadcaster(t.broadcast)
+	proposer, _ := t.managerOfProposer()
+	block, err := proposer.buildBlock()
+	if err != nil {
+		return nil, err
+	}
+	proposer.sendProposal(types.Proposal{Block: *block})
+	head := t.head()
+	if head.Height() != block.Height() {
+		return nil, fmt.Errorf("block %d is not committed", block.Height())
+	}
+	return head, nil
+}
+
+func TestMempoolRemovesCommittedTransactions(t *testing.T) {
+	tester := newTester()
+	mempool := NewMempool(4, time.Minute)
+	txs := newTestTransactions(5)
+	for _, tx := range txs[:4] {
+		if _, err := mempool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mempool.Add(txs[4]); err == nil {
+		t.Fatal("a full mempool should reject transactions")
+	}
+	block, err := tester.commitTransactions(mempool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 4 || !block.Header().TransactionsHash.Equals(txs[:4].Hash()) {
+		t.Fatalf("the block should commit the pending transactions, got %d", len(block.Transactions))
+	}
+	if mempool.Size() != 0 {
+		t.Fatalf("committed transactions should leave the mempool, %d are pending", mempool.Size())
+	}
+	if _, err := mempool.Add(txs[4]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProposalRespectsMaxTransactions(t *testing.T) {
+	tester := newTester()
+	mempool := NewMempool(10, time.Minute)
+	for _, tx := range newTestTransactions(5) {
+		mempool.Add(tx)
+	}
+	for _, cm := range tester.managers {
+		cm.params.MaxTransactions = 2
+	}
+	block, err := tester.commitTransactions(mempool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || mempool.Size() != 3 {
+		t.Fatalf("expected 2 committed and 3 pending transactions, got %d and %d", len(block.Transactions), mempool.Size())
+	}
+	// a proposer with a higher limit is rejected by the others
+	for _, cm := range tester.managers {
+		cm.params.MaxTransactions = 2
+	}
+	proposer, _ := tester.managerOfProposer()
+	proposer.params.MaxTransactions = 3
+	block, err = proposer.buildBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 3 {
+		t.Fatalf("expected 3 transactions, got %d", len(block.Transactions))
+	}
+	for _, cm := range tester.managers {
+		if cm == proposer {
+			continue
+		}
+		if err := cm.verifyProposal(&types.Proposal{Block: *block}); err == nil {
+			t.Fatal("a block with more than max transactions should be rejected")
+		}
+	}
+}
+
+func TestMempoolEvictsExpiredTransactions(t *testing.T) {
+	clock := newFakeClock()
+	mempool := NewMempool(10, time.Minute)
+	mempool.SetClock(clock)
+	txs := newTestTransactions(3)
+	mempool.Add(txs[0])
+	clock.Advance(30 * time.Second)
+	mempool.Add(txs[1])
+	mempool.Add(txs[2])
+	clock.Advance(30 * time.Second)
+	if mempool.Size() != 2 || mempool.Has(txs[0].Hash()) {
+		t.Fatalf("the oldest transaction should expire, %d are pending", mempool.Size())
+	}
+	if reaped := mempool.Reap(10, uint64(len(txs[1]) + txSizeOverhead)); len(reaped) != 1 {
+		t.Fatalf("reap should stop at the size limit, got %d transactions", len(reaped))
+	}
+	clock.Advance(30 * time.Second)
+	if mempool.Size() != 0 {
+		t.Fatalf("every transaction should expire, %d are pending", mempool.Size())
+	}
+}
@@ -0,0 +1,12 @@
+package consensus
+
+import "bft/metrics"
+
+var (
+	heightGauge = metrics.NewGauge("bft_consensus_height", "Height of the last committed block.")
+	roundGauge = metrics.NewGauge("bft_consensus_round", "Round of the current view.")
+	heightDuration = metrics.NewHistogram("bft_consensus_height_duration_seconds", "Time between two committed heights.", []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 300})
+	roundChanges = metrics.NewCounter("bft_consensus_round_changes_total", "Round changes sent by this validator.")
+	stateDuration = metrics.NewCounter("bft_consensus_state_seconds_total", "Time spent in each consensus state.", "state")
+	votesReceived = metrics.NewCounter("bft_consensus_votes_received_total", "Votes received, including our own.", "type")
+)
@@ -3,8 +3,10 @@ package consensus
 import (
 	"sync"
 	"bft/types"
-	"log"
+	"bft/events"
+	"bft/logging"
 	"math"
+	"time"
 )
 
 type ConsensusStateType uint8
@@ -46,6 +48,9 @@ type ConsensusState struct {
 	pendingProposal *types.Proposal
 	prepareCommits map[types.VoteType]*types.VoteSet // include prepare, commit
 	roundChanges map[uint64]*types.VoteSet
+	eventBus *events.EventBus
+	stateSince time.Time // when the current state was entered
+	logger logging.Logger
 }
 
 func NewConsensusState(view types.View, validatorSet *types.ValidatorSet) *ConsensusState {
@@ -57,6 +62,7 @@ func NewConsensusState(view types.View, validatorSet *types.ValidatorSet) *Conse
 		cs.prepareCommits[voteType] = types.NewVoteSet(view, voteType, validatorSet)
 	}
 	cs.roundChanges = make(map[uint64]*types.VoteSet, 0)
+	cs.logger = logging.Default().With(logging.Module("consensus"))
 	return cs
 }
 
@@ -77,15 +83,26 @@ func (cs *ConsensusState) setProposal(proposal *types.Proposal) {
 }
 
 func (cs *ConsensusState) setSate(state ConsensusStateType) {
-	if cs.stateType != state {
-		cs.stateType = state
+	cs.rwMutex.Lock()
+	if cs.stateType == state {
+		cs.rwMutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if !cs.stateSince.IsZero() {
+		stateDuration.Add(now.Sub(cs.stateSince).Seconds(), cs.stateType.String())
 	}
+	cs.stateSince = now
+	cs.stateType = state
+	view := cs.view
+	cs.rwMutex.Unlock()
+	cs.eventBus.Publish(events.StateChange, events.StateEvent{View: view, State: state.String()})
 	//TODO: process pending requests or backlogs
 }
 
 func (cs *ConsensusState) applyVote(vote types.Vote) {
 	if err := cs.prepareCommits[vote.Type].AddVote(vote, true); err != nil {
-		log.Println(err)
+		cs.logger.Debug("vote is not added", logging.Height(vote.View.Height), logging.Round(vote.View.Round), logging.VoteType(vote.Type), logging.F("voter", vote.Address), logging.Err(err))
 		return
 	}
 	if vote.Type == types.Commit {
@@ -101,7 +118,7 @@ func (cs *ConsensusState) applyRoundChange(vote types.Vote, validatorSet *types.
 	}
 	err := cs.roundChanges[round].AddVote(vote, true)
 	if err != nil {
-		log.Println(err)
+		cs.logger.Debug("vote is not added", logging.Height(view.Height), logging.Round(round), logging.VoteType(vote.Type), logging.F("voter", vote.Address), logging.Err(err))
 	}
 }
 
@@ -129,7 +146,9 @@ func (cs *ConsensusState) isLocked() bool {
 
 func (cs *ConsensusState) updateView(v types.View) {
 	if cs.view.Compare(v) != 0 {
+		cs.rwMutex.Lock()
 		cs.view = v
+		cs.rwMutex.Unlock()
 		for _, votSet := range cs.roundChanges {
 			votSet.ChangeView(v)
 		}
@@ -150,11 +169,15 @@ func (cs *ConsensusState) clearSmallerRound() {
 	}
 }
 
-func (cs *ConsensusState) getMaxRound(threshold int) (maxRound uint64) {
+// getMaxRound returns the highest round whose round-change votes reach the threshold,
+// or math.MaxUint64 if there is none
+func (cs *ConsensusState) getMaxRound(reachThreshold func(power uint64) bool) (maxRound uint64) {
 	maxRound = uint64(math.MaxUint64)
 	for round, voteSet := range cs.roundChanges {
-		voteNum := voteSet.Size()
-		if voteNum >= threshold && maxRound < uint64(voteNum) {
+		if !reachThreshold(voteSet.VotingPower()) {
+			continue
+		}
+		if maxRound == math.MaxUint64 || round > maxRound {
 			maxRound = round
 		}
 	}
@@ -0,0 +1,140 @@
+package consensus
+
+import (
+	"bft/types"
+	"bft/events"
+	"testing"
+	"time"
+)
+
+type fakeTimer struct {
+	deadline time.Time
+	f func()
+	stopped bool
+	fired bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
+// fakeClock only moves when it is advanced, timers fire synchronously in Advance
+type fakeClock struct {
+	now time.Time
+	timers []*fakeTimer
+	scheduled []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	timer := &fakeTimer{deadline: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	c.scheduled = append(c.scheduled, d)
+	return timer
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	timers := c.timers
+	for _, timer := range timers {
+		if !timer.stopped && !timer.fired && !timer.deadline.After(c.now) {
+			timer.fired = true
+			timer.f()
+		}
+	}
+}
+
+func (c *fakeClock) lastScheduled() time.Duration {
+	return c.scheduled[len(c.scheduled) - 1]
+}
+
+func (c *fakeClock) activeTimers() int {
+	active := 0
+	for _, timer := range c.timers {
+		if !timer.stopped && !timer.fired {
+			active++
+		}
+	}
+	return active
+}
+
+func TestStepTimeouts(t *testing.T) {
+	tester := newTester()
+	tester.setBroadcaster(broadcastNothing)
+	cm := tester.managers[0]
+	clock := newFakeClock()
+	cm.SetClock(clock)
+	bus := events.NewEventBus()
+	subscription := bus.Subscribe(events.Filter{Types: []events.EventType{events.RoundChange}}, 100)
+	cm.SetEventBus(bus)
+	params := cm.params
+	view := types.View{
+		Round: 1,
+		Height: tester.head().Height() + 1,
+	}
+	for _, manager := range tester.managers {
+		manager.currentState = NewConsensusState(view, manager.validatorSet)
+		manager.currentState.setSate(NewRound)
+	}
+	cm.newRoundChangeTimer()
+	if timeout := clock.lastScheduled(); timeout != params.Timeout(types.ProposeStep, 1) {
+		t.Fatalf("expected propose timeout, got %v", timeout)
+	}
+	proposal, err := tester.newProposal(1, view.Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.enterPrePrepared(proposal)
+	if timeout := clock.lastScheduled(); timeout != params.Timeout(types.PrepareStep, 1) {
+		t.Fatalf("expected prepare timeout, got %v", timeout)
+	}
+	cm.enterPrepared()
+	commitTimeout := params.Timeout(types.CommitStep, 1)
+	if timeout := clock.lastScheduled(); timeout != commitTimeout {
+		t.Fatalf("expected commit timeout, got %v", timeout)
+	}
+	if active := clock.activeTimers(); active != 1 {
+		t.Fatalf("timers of left steps should be stopped, %d are active", active)
+	}
+	clock.Advance(commitTimeout - time.Millisecond)
+	if round := cm.currentState.round(); round != 1 {
+		t.Fatalf("round should not change before the timeout, got round %d", round)
+	}
+	clock.Advance(time.Millisecond)
+	if round, state := cm.currentState.round(), cm.currentState.stateType; round != 2 || state != RoundChange {
+		t.Fatalf("expected a round change to round 2, got round %d in %s", round, state.String())
+	}
+	// every further timeout moves to the next round and waits longer
+	previous := clock.lastScheduled()
+	for round := uint64(3); round < 6; round++ {
+		clock.Advance(previous)
+		if cm.currentState.round() != round {
+			t.Fatalf("expected round %d, got %d", round, cm.currentState.round())
+		}
+		timeout := clock.lastScheduled()
+		if timeout != params.Timeout(types.ProposeStep, round) || timeout <= previous {
+			t.Fatalf("timeout of round %d should grow, got %v after %v", round, timeout, previous)
+		}
+		previous = timeout
+	}
+	cm.stopRoundChangeTimer()
+	// subscribers see every round which a timeout moved to
+	for round := uint64(2); round < 6; round++ {
+		if len(subscription.Events()) == 0 {
+			t.Fatalf("round change to round %d is not published", round)
+		}
+		event := <-subscription.Events()
+		if got := event.Data.(events.RoundEvent).View; got.Round != round || got.Height != view.Height {
+			t.Fatalf("expected round %d, got %v", round, got)
+		}
+	}
+}
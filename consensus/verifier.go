@@ -3,6 +3,7 @@ package consensus
 import (
 	"bft/types"
 	"fmt"
+	"bft/encoding"
 )
 
 func (cm *ConsensusManager) verifyProposal(proposal *types.Proposal) error {
@@ -10,9 +11,9 @@ func (cm *ConsensusManager) verifyProposal(proposal *types.Proposal) error {
 		return fmt.Errorf("proposal should be not nil")
 	}
 	// Does blockchain have a head
-	head := cm.head()
-	if head == nil {
-		return fmt.Errorf("blockchain hasn't a head")
+	head, err := cm.head()
+	if err != nil {
+		return fmt.Errorf("can not load head: %v", err)
 	}
 	blockHeader := proposal.Block.Header()
 	// Are block's height and hash valid
@@ -23,12 +24,77 @@ func (cm *ConsensusManager) verifyProposal(proposal *types.Proposal) error {
 	if !blockHeader.PreviousId.Equals(head.Id()) || blockHeader.Height() != head.Height() + 1 {
 		return fmt.Errorf("unlinkable block")
 	}
+	// Is block's id the hash of its header
+	if !blockHeader.VerifyId(encoding.MarshalBinary) {
+		return fmt.Errorf("block's id does not match its header")
+	}
+	// Are the transactions the ones of the header
+	if err := proposal.Block.VerifyTransactions(); err != nil {
+		return err
+	}
+	// Does block fit the max transactions and the max block size
+	if uint64(len(proposal.Block.Transactions)) > cm.params.MaxTransactions {
+		return fmt.Errorf("block has %d transactions, more than max transactions %d", len(proposal.Block.Transactions), cm.params.MaxTransactions)
+	}
+	blockData, err := encoding.MarshalBinary(proposal.Block)
+	if err != nil {
+		return err
+	}
+	if uint64(len(blockData)) > cm.params.MaxBlockSize {
+		return fmt.Errorf("block has %d bytes, more than max block size %d", len(blockData), cm.params.MaxBlockSize)
+	}
+	// Do validator hashes match the validators of this height and the next one
+	if err := cm.verifyValidatorsHashes(blockHeader); err != nil {
+		return err
+	}
+	// validator updates must apply to the validators of the height before they take effect
+	if len(blockHeader.ValidatorUpdates) > 0 {
+		validators, err := cm.blockStore.GetValidators(blockHeader.Height() + types.ValidatorUpdateDelay - 1)
+		if err != nil {
+			return err
+		}
+		if _, err := validators.ApplyUpdates(blockHeader.ValidatorUpdates); err != nil {
+			return err
+		}
+	}
+	// consensus params updates must take effect in the future
+	for _, update := range blockHeader.ParamsUpdates {
+		if err := update.Validate(blockHeader.Height()); err != nil {
+			return err
+		}
+	}
 	publicKey := proposal.Proposer().PublicKey
 	// Is block signed by proposer
 	blockId := proposal.BlockId()
 	signature := proposal.Block.Signature()
 	if !signature.Verify(publicKey.Address(), blockId[:]) {
-		fmt.Errorf("block's signature is wrong")
+		return fmt.Errorf("block's signature is wrong")
+	}
+	return nil
+}
+
+func (cm *ConsensusManager) verifyValidatorsHashes(header *types.BlockHeader) error {
+	validators, err := cm.blockStore.GetValidators(header.Height())
+	if err != nil {
+		return err
+	}
+	validatorsHash, err := validators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return err
+	}
+	if !header.ValidatorsHash.Equals(validatorsHash) {
+		return fmt.Errorf("validators hash %s does not match local validators %s", header.ValidatorsHash.String(), validatorsHash.String())
+	}
+	nextValidators, err := cm.blockStore.GetValidators(header.Height() + 1)
+	if err != nil {
+		return err
+	}
+	nextValidatorsHash, err := nextValidators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return err
+	}
+	if !header.NextValidatorsHash.Equals(nextValidatorsHash) {
+		return fmt.Errorf("next validators hash %s does not match local validators %s", header.NextValidatorsHash.String(), nextValidatorsHash.String())
 	}
 	return nil
 }
@@ -40,6 +106,10 @@ func (cm *ConsensusManager) verifyVote(vote types.Vote) error {
 	if vote.View.Compare(currentState.view) != 0 {
 		return fmt.Errorf("prepare's round and height are invalid")
 	}
+	// commits end up in the block, so the signed hash must cover the vote
+	if !verifyVoteHash(vote) {
+		return fmt.Errorf("vote's hash does not match its content")
+	}
 	// check current state
 	if currentState.stateType == NewRound {
 		return fmt.Errorf("state should not be newround when receiving a prepare message")
@@ -57,7 +127,18 @@ func (cm *ConsensusManager) verifyVote(vote types.Vote) error {
 	return nil
 }
 
+func verifyVoteHash(vote types.Vote) bool {
+	hash, err := vote.CalculateHash(encoding.MarshalBinary)
+	if err != nil {
+		return false
+	}
+	return hash.Equals(vote.Hash)
+}
+
 func (cm *ConsensusManager) verifyRoundChange(vote types.Vote) bool {
+	if !verifyVoteHash(vote) {
+		return false
+	}
 	if vote.View.Height > cm.currentState.height() {
 		return false
 	} else if vote.View.Compare(cm.currentState.view) < 0 {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"bytes"
 	"golang.org/x/crypto/ripemd160"
+	"encoding/json"
 )
 
 type PublicKey struct {
@@ -41,3 +42,23 @@ func (pk *PublicKey) Address() string {
 func (pk PublicKey) Equals(target PublicKey) bool {
 	return bytes.Equal(pk.Data, target.Data)
 }
+
+func (pk PublicKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pk.String())
+}
+
+func (pk *PublicKey) UnmarshalJSON(b []byte) error {
+	pubString := ""
+	if err := json.Unmarshal(b, &pubString); err != nil {
+		return err
+	}
+	if len(base58.Decode(pubString)) <= 4 {
+		return fmt.Errorf("public key is too short")
+	}
+	publicKey, err := NewPublicKey(pubString)
+	if err != nil {
+		return err
+	}
+	*pk = *publicKey
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/btcsuite/btcd/btcec"
 	"bytes"
 	"fmt"
+	"encoding/json"
 )
 
 type SignFunc func (digest []byte) (Signature, error)
@@ -52,4 +53,31 @@ func (s *Signature) Verify(address string, hash []byte) bool {
 func (s Signature) IsValid() bool {
 	emptySig := make([]byte, 65, 65)
 	return !bytes.Equal(s.Data, emptySig)
+}
+
+func (s Signature) MarshalJSON() ([]byte, error) {
+	if len(s.Data) == 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(s.String())
+}
+
+func (s *Signature) UnmarshalJSON(b []byte) error {
+	sigString := ""
+	if err := json.Unmarshal(b, &sigString); err != nil {
+		return err
+	}
+	if sigString == "" {
+		s.Data = nil
+		return nil
+	}
+	if len(base58.Decode(sigString)) <= 4 {
+		return fmt.Errorf("signature is too short")
+	}
+	signature, err := NewSignature(sigString)
+	if err != nil {
+		return err
+	}
+	*s = *signature
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,318 @@
+package database
+
+import (
+	"bft/types"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// prefixes of the secondary indexes, the keys end with the big endian height so they sort by height
+const ProposerIndexPrefix = "P"
+const TimeIndexPrefix = "T"
+const TransactionIndexPrefix = "X"
+
+// BlockQuery selects blocks. Heights are in [Start, End], an End of 0 is the last height. A non zero From or To
+// selects the timestamps in [From, To), a Proposer selects the blocks proposed by an address. Limit is the most
+// blocks of a page, 0 is no limit, and Cursor continues after the page which returned it.
+type BlockQuery struct {
+	Start uint64
+	End uint64
+	Proposer string
+	From time.Time
+	To time.Time
+	Descending bool
+	Limit int
+	Cursor string
+}
+
+// BlockPage is a page of blocks, Next is the cursor of the following page and empty on the last page
+type BlockPage struct {
+	Blocks []*types.Block
+	Next string
+}
+
+// CommittedTransaction is a transaction with the block which committed it
+type CommittedTransaction struct {
+	Tx types.Transaction
+	Height uint64
+	Index int // position in the transactions of the block
+}
+
+// GetTransaction looks up a committed transaction in the transaction index. A transaction committed at several
+// heights is found at the lowest one whose body is stored, the index keys of a body which is gone are skipped.
+func (bs *BlockStore) GetTransaction(hash types.Hash) (*CommittedTransaction, error) {
+	prefix := transactionIndexPrefix(hash)
+	it, err := bs.db.Iterator(prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != len(prefix) + 8 {
+			return nil, corrupted("transaction index", fmt.Errorf("key %x has a wrong length", key))
+		}
+		height := binary.BigEndian.Uint64(key[len(prefix):])
+		block, err := bs.GetBlockFromHeight(height)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, tx := range block.Transactions {
+			if tx.Hash().Equals(hash) {
+				return &CommittedTransaction{Tx: tx, Height: height, Index: i}, nil
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("transaction %s: %w", hash.String(), ErrNotFound)
+}
+
+// QueryBlocks returns a page of the blocks selected by q. A proposer or a time range is looked up in its index,
+// other queries walk the heights.
+func (bs *BlockStore) QueryBlocks(q BlockQuery) (*BlockPage, error) {
+	page := &BlockPage{
+		Blocks: make([]*types.Block, 0),
+	}
+	err := bs.scan(q, func(height uint64, cursor string) (bool, error) {
+		if q.Limit > 0 && len(page.Blocks) == q.Limit {
+			page.Next = cursor
+			return false, nil
+		}
+		block, err := bs.GetBlockFromHeight(height)
+		if errors.Is(err, ErrNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if q.matches(block) {
+			page.Blocks = append(page.Blocks, block)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// IterateBlocks calls fn for every block selected by q until fn returns false, the limit of q is ignored
+func (bs *BlockStore) IterateBlocks(q BlockQuery, fn func(block *types.Block) bool) error {
+	return bs.scan(q, func(height uint64, cursor string) (bool, error) {
+		block, err := bs.GetBlockFromHeight(height)
+		if errors.Is(err, ErrNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !q.matches(block) {
+			return true, nil
+		}
+		return fn(block), nil
+	})
+}
+
+func (q BlockQuery) matches(block *types.Block) bool {
+	header := block.Header()
+	if header.Height() < q.Start || (q.End != 0 && header.Height() > q.End) {
+		return false
+	}
+	if q.Proposer != "" && header.Proposer.Address != q.Proposer {
+		return false
+	}
+	if !q.From.IsZero() && header.Timestamp.Before(q.From) {
+		return false
+	}
+	return q.To.IsZero() || header.Timestamp.Before(q.To)
+}
+
+// scan calls fn with the heights which may match q in order, and the cursor which resumes the scan at each height
+func (bs *BlockStore) scan(q BlockQuery, fn func(height uint64, cursor string) (bool, error)) error {
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return err
+	}
+	start, end := q.Start, q.End
+	if start == 0 {
+		start = 1
+	}
+	if end == 0 || end > lastHeight {
+		end = lastHeight
+	}
+	if start > end {
+		return nil
+	}
+	if q.Proposer != "" {
+		prefix := proposerIndexPrefix(q.Proposer)
+		return bs.scanIndex(q, appendHeight(prefix, start), appendHeight(prefix, end + 1), start, end, fn)
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		from, to := []byte(TimeIndexPrefix), prefixEnd([]byte(TimeIndexPrefix))
+		if !q.From.IsZero() {
+			from = appendTime([]byte(TimeIndexPrefix), q.From)
+		}
+		if !q.To.IsZero() {
+			to = appendTime([]byte(TimeIndexPrefix), q.To)
+		}
+		return bs.scanIndex(q, from, to, start, end, fn)
+	}
+	if q.Cursor != "" {
+		height, err := strconv.ParseUint(q.Cursor, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid cursor %s", q.Cursor)
+		}
+		if q.Descending && height < end {
+			end = height
+		} else if !q.Descending && height > start {
+			start = height
+		}
+		if start > end {
+			return nil
+		}
+	}
+	for i := uint64(0); i <= end - start; i++ {
+		height := start + i
+		if q.Descending {
+			height = end - i
+		}
+		next, err := fn(height, strconv.FormatUint(height, 10))
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanIndex walks the index keys in [start, end) and skips the heights out of [minHeight, maxHeight] before their
+// blocks are read, the cursor is the hex encoded key
+func (bs *BlockStore) scanIndex(q BlockQuery, start, end []byte, minHeight, maxHeight uint64, fn func(height uint64, cursor string) (bool, error)) error {
+	if q.Cursor != "" {
+		key, err := hex.DecodeString(q.Cursor)
+		if err != nil || !inRange(key, start, end) {
+			return fmt.Errorf("invalid cursor %s", q.Cursor)
+		}
+		if q.Descending {
+			end = append(key, 0)
+		} else {
+			start = key
+		}
+	}
+	iterator := bs.db.Iterator
+	if q.Descending {
+		iterator = bs.db.ReverseIterator
+	}
+	it, err := iterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < 8 {
+			return corrupted("block index", fmt.Errorf("key %x is too short", key))
+		}
+		height := binary.BigEndian.Uint64(key[len(key) - 8:])
+		if height < minHeight || height > maxHeight {
+			continue
+		}
+		next, err := fn(height, hex.EncodeToString(key))
+		if err != nil || !next {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// putIndexes adds the index keys of header to batch
+func putIndexes(batch Batch, header *types.BlockHeader) {
+	batch.Put(keyFromProposer(header.Proposer.Address, header.Height()), []byte{})
+	batch.Put(keyFromTime(header.Timestamp, header.Height()), []byte{})
+}
+
+func deleteIndexes(batch Batch, header *types.BlockHeader) {
+	batch.Delete(keyFromProposer(header.Proposer.Address, header.Height()))
+	batch.Delete(keyFromTime(header.Timestamp, header.Height()))
+}
+
+// putTransactionIndexes adds the transaction index keys of block to batch
+func putTransactionIndexes(batch Batch, block *types.Block) {
+	for _, tx := range block.Transactions {
+		batch.Put(keyFromTransaction(tx.Hash(), block.Height()), []byte{})
+	}
+}
+
+// deleteTransactionIndexes deletes the transaction index keys of the stored body of header, a body which is gone
+// took its keys along
+func (bs *BlockStore) deleteTransactionIndexes(batch Batch, header *types.BlockHeader, legacyHeight uint64) error {
+	value, err := bs.get(keyFromId(header.Id()))
+	if err != nil || value == nil {
+		return err
+	}
+	block, err := decodeBlock(value, legacyHeight)
+	if err != nil {
+		return corrupted(fmt.Sprintf("block %s", header.HeightId.String()), err)
+	}
+	for _, tx := range block.Transactions {
+		batch.Delete(keyFromTransaction(tx.Hash(), header.Height()))
+	}
+	return nil
+}
+
+func proposerIndexPrefix(address string) []byte {
+	return []byte(ProposerIndexPrefix + address + "/")
+}
+
+func keyFromProposer(address string, height uint64) []byte {
+	return appendHeight(proposerIndexPrefix(address), height)
+}
+
+func transactionIndexPrefix(hash types.Hash) []byte {
+	return append([]byte(TransactionIndexPrefix), hash[:]...)
+}
+
+func keyFromTransaction(hash types.Hash, height uint64) []byte {
+	return appendHeight(transactionIndexPrefix(hash), height)
+}
+
+func keyFromTime(timestamp time.Time, height uint64) []byte {
+	return appendHeight(appendTime([]byte(TimeIndexPrefix), timestamp), height)
+}
+
+// appendHeight returns a new key, the prefix can be shared
+func appendHeight(prefix []byte, height uint64) []byte {
+	key := make([]byte, len(prefix) + 8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], height)
+	return key
+}
+
+// appendTime keeps the order of the timestamps after 1970
+func appendTime(prefix []byte, timestamp time.Time) []byte {
+	nanos := timestamp.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+	return appendHeight(prefix, uint64(nanos))
+}
+
+// prefixEnd is the first key after all the keys starting with prefix
+func prefixEnd(prefix []byte) []byte {
+	end := copyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i + 1]
+		}
+	}
+	return nil
+}
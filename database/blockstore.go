@@ -1,102 +1,284 @@
 package database
 
 import (
-	"github.com/tecbot/gorocksdb"
 	"bft/types"
+	"errors"
 	"fmt"
 	"bft/encoding"
-	"log"
+	"bft/logging"
+	"sort"
+	"strconv"
+	"sync"
+	"encoding/binary"
 )
 
 const BlockStoreCF = "blockstore"
 const LastHeightKey = "lastheight"
+const ConsensusParamsKey = "consensusparams"
+const HeightKeyPrefix = "H"
+const BlockKeyPrefix = "B"
+const ValidatorsKeyPrefix = "V"
+
+// validatorsRecord is stored at the heights where the validator set changes, the heights up to the next record use
+// its validators. The keys end with the big endian height, so the record of a height is the nearest one at or below.
+// An unchanged set is stored again every types.ValidatorSetCheckpoint heights to bound the turns which restore the
+// proposer priorities.
+type validatorsRecord struct {
+	Validators types.Validators
+	Priorities []int64 // proposer priorities at the height of the record
+}
+
+// paramsChange is a consensus params update of the block at SourceHeight, it applies from Height on
+type paramsChange struct {
+	Height uint64
+	SourceHeight uint64
+	Params types.ConsensusParams
+}
 
 type BlockStore struct {
-	db *RocksDB
+	db KVStore
+	headMutex sync.RWMutex // guards head, which consensus, sync, the RPC and the pruner read and replace
 	head *types.Block
-	chainId types.Hash
+	genesis *types.Genesis
+	genesisHash types.Hash
+	logger logging.Logger
+	pruneMutex sync.Mutex
 }
 
-var blockStore = NewBlockStore()
+// NewBlockStore opens the chain of the network described by genesis in db. The genesis block is added to an empty
+// store, a store which holds the chain of another genesis is rejected.
+func NewBlockStore(db KVStore, genesis *types.Genesis) (*BlockStore, error) {
+	bs, genesisBlock, err := newBlockStore(db, genesis)
+	if err != nil {
+		return nil, err
+	}
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return nil, err
+	}
+	// a store of another chain is rejected before a migration writes to it
+	if lastHeight != 0 {
+		if err := bs.checkGenesis(genesisBlock); err != nil {
+			return nil, err
+		}
+	}
+	if err := bs.migrate(); err != nil {
+		return nil, err
+	}
+	if lastHeight != 0 {
+		// the validators are missing if the node stopped right after adding the genesis block
+		if err := bs.InitValidators(genesis.Validators); err != nil {
+			return nil, err
+		}
+		return bs, nil
+	}
+	bs.logger.Info("add genesis", logging.F("chain_id", genesis.ChainId), logging.F("genesis_hash", bs.genesisHash.String()))
+	if err := bs.AddBlock(genesisBlock); err != nil {
+		return nil, err
+	}
+	if err := bs.InitValidators(genesis.Validators); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
 
-func NewBlockStore() *BlockStore {
-	db := GetDB()
-	db.AddCF(BlockStoreCF)
+func newBlockStore(db KVStore, genesis *types.Genesis) (*BlockStore, *types.Block, error) {
+	if err := genesis.Validate(); err != nil {
+		return nil, nil, err
+	}
 	bs := &BlockStore{
-		db: GetDB(),
+		db: db,
+		genesis: genesis,
+		genesisHash: genesis.Hash(encoding.MarshalBinary),
+		logger: logging.Default().With(logging.Module("database")),
+	}
+	genesisBlock, err := types.NewGenesisBlock(genesis, encoding.MarshalBinary)
+	if err != nil {
+		return nil, nil, err
 	}
-	genesis := types.NewGenesis()
-	bs.chainId = genesis.ChainId(encoding.MarshalBinary)
-	if bs.LastHeight() == 0 {
-		//Add genesis block
-		log.Println("add genesis")
-		log.Println(bs.chainId)
-		genesisBlock := types.NewGenesisBlock(genesis, encoding.MarshalBinary)
-		bs.AddBlock(genesisBlock)
+	return bs, genesisBlock, nil
+}
+
+// checkGenesis compares the stored genesis block with the one of genesis. The genesis block of version 1 hashes to the
+// version 1 id of the genesis block. The one of the first layout was not derived from a genesis file, it has to carry
+// the genesis time and one of the genesis validators as proposer.
+func (bs *BlockStore) checkGenesis(genesisBlock *types.Block) error {
+	legacy, err := bs.isLegacy()
+	if err != nil {
+		return err
+	}
+	if !legacy {
+		header, err := bs.GetBlockHeader(1)
+		if err != nil {
+			return err
+		}
+		if !header.Id().Equals(genesisBlock.Id()) {
+			return fmt.Errorf("stored chain does not belong to genesis %s", bs.genesis.ChainId)
+		}
+		return nil
+	}
+	header, err := bs.legacyHeader(1)
+	if err != nil {
+		return err
+	}
+	if header.Id().Equals(version1Id(genesisBlock.Header())) {
+		return nil
+	}
+	if header.Timestamp.Equal(bs.genesis.Time) {
+		for _, v := range bs.genesis.Validators {
+			if v.Equals(header.Proposer) {
+				return nil
+			}
+		}
 	}
-	return bs
+	return fmt.Errorf("stored chain does not belong to genesis %s", bs.genesis.ChainId)
 }
 
-func GetBlockStore() *BlockStore {
-	return blockStore
+// Close closes the underlying store, or releases the snapshot of a store returned by Snapshot
+func (bs *BlockStore) Close() error {
+	return bs.db.Close()
 }
 
-func (bs *BlockStore) ChainId() types.Hash {
-	return bs.chainId
+// Snapshot returns a read only view of the chain as it is now, blocks added later are not visible to it. Reads which
+// have to agree with each other, like the pages of a query or an export, use a snapshot while consensus writes.
+func (bs *BlockStore) Snapshot() (*BlockStore, error) {
+	snapshot, err := bs.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &BlockStore{
+		db: &snapshotStore{snapshot, snapshot},
+		genesis: bs.genesis,
+		genesisHash: bs.genesisHash,
+		logger: bs.logger,
+	}, nil
 }
 
-func (bs *BlockStore) Head() *types.Block {
+func (bs *BlockStore) SetLogger(logger logging.Logger) {
+	bs.logger = logger
+}
+
+func (bs *BlockStore) Genesis() *types.Genesis {
+	return bs.genesis
+}
+
+func (bs *BlockStore) ChainId() string {
+	return bs.genesis.ChainId
+}
+
+// GenesisHash identifies the network in handshakes
+func (bs *BlockStore) GenesisHash() types.Hash {
+	return bs.genesisHash
+}
+
+// Head returns the block at the last height
+func (bs *BlockStore) Head() (*types.Block, error) {
+	if head := bs.cachedHead(); head != nil {
+		return head, nil
+	}
+	// a writer which replaces the head waits until the loaded one is cached, so it does not outlive the change
+	bs.headMutex.Lock()
+	defer bs.headMutex.Unlock()
 	if bs.head != nil {
-		return bs.head
+		return bs.head, nil
 	}
 	// try to load from database
-	lastHeight := bs.LastHeight()
-	if lastHeight != 0 {
-		head, err := bs.GetBlockFromHeight(lastHeight)
-		if err != nil {
-			log.Println(err)
-			return nil
-		}
-		bs.head = head
-		return bs.head
+	lastHeight, err := bs.storedLastHeight()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if lastHeight == 0 {
+		return nil, fmt.Errorf("head: %w", ErrNotFound)
+	}
+	head, err := bs.GetBlockFromHeight(lastHeight)
+	if err != nil {
+		return nil, err
+	}
+	bs.head = head
+	return bs.head, nil
 }
 
-func (bs *BlockStore) LastHeight() uint64 {
-	if bs.head != nil {
-		return bs.head.Height()
+// LastHeight is 0 if the store has no block
+func (bs *BlockStore) LastHeight() (uint64, error) {
+	if head := bs.cachedHead(); head != nil {
+		return head.Height(), nil
+	}
+	return bs.storedLastHeight()
+}
+
+func (bs *BlockStore) cachedHead() *types.Block {
+	bs.headMutex.RLock()
+	defer bs.headMutex.RUnlock()
+	return bs.head
+}
+
+// setHead replaces the cached head once the last height is written, nil loads it again on the next read
+func (bs *BlockStore) setHead(head *types.Block) {
+	bs.headMutex.Lock()
+	bs.head = head
+	bs.headMutex.Unlock()
+}
+
+func (bs *BlockStore) storedLastHeight() (uint64, error) {
+	value, err := bs.get([]byte(LastHeightKey))
+	if err != nil {
+		return 0, err
 	}
-	// try to load from database
-	value := bs.get([]byte(LastHeightKey))
 	if value == nil {
-		return 0
+		return 0, nil
 	}
 	lastHeight := uint64(0)
-	encoding.UnmarshalBinary(value, &lastHeight)
-	return lastHeight
+	if err := encoding.UnmarshalBinary(value, &lastHeight); err != nil {
+		return 0, corrupted("last height", err)
+	}
+	return lastHeight, nil
 }
 
+// AddBlock stores the block, the last height, the validators and the consensus params updates of the block in one
+// batch, a crash leaves either all of them or none
 func (bs *BlockStore) AddBlock(block *types.Block) error {
 	height := block.Header().Height()
 	if _, err := bs.GetBlockHeader(height); err == nil {
 		return fmt.Errorf("block height %v is existing", height)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	for _, update := range block.Header().ParamsUpdates {
+		if err := update.Validate(height); err != nil {
+			return err
+		}
 	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
 	//save block header
 	headerData, err := encoding.MarshalBinary(block.Header())
 	if err != nil {
 		return err
 	}
-	bs.put(keyFromHeight(height), headerData)
+	batch.Put(keyFromHeight(height), headerData)
 	//save block
 	blockData, err := encoding.MarshalBinary(*block)
 	if err != nil {
 		return err
 	}
-	bs.put(keyFromId(block.Header().Id()), blockData)
-	bs.head = block
+	batch.Put(keyFromId(block.Header().Id()), blockData)
+	putIndexes(batch, block.Header())
+	putTransactionIndexes(batch, block)
 	//save last height
-	bs.saveLastHeight(height)
+	if err := bs.saveLastHeight(batch, height); err != nil {
+		return err
+	}
+	//save validators which apply from height + ValidatorUpdateDelay
+	if err := bs.saveNextValidators(batch, block.Header()); err != nil {
+		return err
+	}
+	if err := bs.saveParamsUpdates(batch, block.Header()); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	bs.setHead(block)
 	return nil
 }
 
@@ -110,74 +292,307 @@ func (bs *BlockStore) GetBlockFromHeight(height uint64) (*types.Block, error) {
 
 func (bs *BlockStore) GetBlockFromId(id types.Hash) (*types.Block, error) {
 	key := keyFromId(id)
-	value := bs.get(key)
+	value, err := bs.get(key)
+	if err != nil {
+		return nil, err
+	}
 	if value == nil {
-		return nil, fmt.Errorf("block id %v does not exist", id.String())
+		return nil, fmt.Errorf("block id %v: %w", id.String(), ErrNotFound)
 	}
 	block := types.Block{}
-	encoding.UnmarshalBinary(value, &block)
+	if err := encoding.UnmarshalBinary(value, &block); err != nil {
+		return nil, corrupted(fmt.Sprintf("block id %v", id.String()), err)
+	}
 	return &block, nil
 }
 
 func (bs *BlockStore) GetBlockHeader(height uint64) (*types.BlockHeader, error) {
 	key := keyFromHeight(height)
-	value := bs.get(key)
+	value, err := bs.get(key)
+	if err != nil {
+		return nil, err
+	}
 	if value == nil {
-		return nil, fmt.Errorf("block height %v does not exist", height)
+		return nil, fmt.Errorf("block height %v: %w", height, ErrNotFound)
 	}
 	blockHeader := types.BlockHeader{}
-	encoding.UnmarshalBinary(value, &blockHeader)
+	if err := encoding.UnmarshalBinary(value, &blockHeader); err != nil {
+		return nil, corrupted(fmt.Sprintf("block height %v", height), err)
+	}
 	return &blockHeader, nil
 }
 
+// RemoveBlock deletes the block at height, removing the last height makes the previous block the head
 func (bs *BlockStore) RemoveBlock(height uint64) error {
 	header, err := bs.GetBlockHeader(height)
 	if err != nil {
 		return err
 	}
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return err
+	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	// the transaction keys of a body which does not decode are left, lookups skip them
+	if err := bs.deleteTransactionIndexes(batch, header, 0); err != nil && !errors.Is(err, ErrCorrupted) {
+		return err
+	}
 	//remove block header
-	bs.delete(keyFromHeight(height))
+	batch.Delete(keyFromHeight(height))
 	//remove block
-	bs.delete(keyFromId(header.Id()))
+	batch.Delete(keyFromId(header.Id()))
+	deleteIndexes(batch, header)
+	if height == lastHeight {
+		if err := bs.saveLastHeight(batch, height - 1); err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if height == lastHeight {
+		bs.setHead(nil)
+	}
 	return nil
 }
 
-func (bs *BlockStore) saveLastHeight(height uint64) {
-	value, _ := encoding.MarshalBinary(height)
-	bs.put([]byte(LastHeightKey), value)
+// InitValidators stores the initial validator set unless the store already has one
+func (bs *BlockStore) InitValidators(validators types.Validators) error {
+	has, err := bs.has(keyFromValidatorsHeight(1))
+	if err != nil || has {
+		return err
+	}
+	return bs.ResetValidators(validators)
 }
 
-func keyFromHeight(height uint64) []byte {
-	return []byte(fmt.Sprintf("H%v", height))
+// ResetValidators makes one validator set apply to every height, discarding updates recorded so far
+func (bs *BlockStore) ResetValidators(validators types.Validators) error {
+	sorted, err := types.Validators{}.ApplyUpdates(validators)
+	if err != nil {
+		return err
+	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	if err := bs.deleteValidatorsFrom(batch, 2); err != nil {
+		return err
+	}
+	if err := bs.saveValidatorsRecord(batch, 1, validatorsRecord{sorted, make([]int64, len(sorted))}); err != nil {
+		return err
+	}
+	return batch.Write()
 }
 
-func keyFromId(id types.Hash) []byte {
-	key := []byte("B")
-	key = append(key, id[:]...)
-	return key
+// GetValidators returns the validator set which signs the block at the given height. The validators are known up
+// to the last height + ValidatorUpdateDelay.
+func (bs *BlockStore) GetValidators(height uint64) (types.Validators, error) {
+	if err := bs.checkValidatorsHeight(height); err != nil {
+		return nil, err
+	}
+	record, _, err := bs.getValidatorsRecord(height)
+	if err != nil {
+		return nil, err
+	}
+	return record.Validators, nil
 }
 
+// GetValidatorSet returns the validators of height with their proposer priorities, address is the local node
+func (bs *BlockStore) GetValidatorSet(height uint64, address string) (*types.ValidatorSet, error) {
+	if err := bs.checkValidatorsHeight(height); err != nil {
+		return nil, err
+	}
+	return bs.validatorSet(height, address)
+}
 
-func (bs *BlockStore) put(key, value []byte) {
-	bs.db.Put(BlockStoreCF, key, value)
+func (bs *BlockStore) checkValidatorsHeight(height uint64) error {
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return err
+	}
+	if height == 0 || height > lastHeight + types.ValidatorUpdateDelay {
+		return fmt.Errorf("validators of height %v: %w", height, ErrNotFound)
+	}
+	return nil
 }
 
-func (bs *BlockStore) get(key []byte) []byte {
-	return bs.db.Get(BlockStoreCF, key)
+// validatorSet restores the set of the nearest record and takes the turns of the heights since
+func (bs *BlockStore) validatorSet(height uint64, address string) (*types.ValidatorSet, error) {
+	record, recordHeight, err := bs.getValidatorsRecord(height)
+	if err != nil {
+		return nil, err
+	}
+	vs, err := types.RestoreValidatorSet(recordHeight, record.Validators, record.Priorities, address)
+	if err != nil {
+		return nil, corrupted(fmt.Sprintf("validators of height %v", recordHeight), err)
+	}
+	for vs.Height() < height {
+		vs = vs.NextHeight(record.Validators)
+	}
+	return vs, nil
 }
 
-func (bs *BlockStore) delete(key []byte) {
-	bs.db.Delete(BlockStoreCF, key)
+// saveNextValidators records the validators of height + ValidatorUpdateDelay if the block updates them or if the
+// previous record is a checkpoint interval away
+func (bs *BlockStore) saveNextValidators(batch Batch, header *types.BlockHeader) error {
+	height := header.Height() + types.ValidatorUpdateDelay
+	previous, previousHeight, err := bs.getValidatorsRecord(height - 1)
+	if errors.Is(err, ErrNotFound) {
+		// validators have not been initialized yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(header.ValidatorUpdates) == 0 && height - previousHeight < types.ValidatorSetCheckpoint {
+		return nil
+	}
+	validators, err := previous.Validators.ApplyUpdates(header.ValidatorUpdates)
+	if err != nil {
+		return err
+	}
+	vs, err := bs.validatorSet(height - 1, "")
+	if err != nil {
+		return err
+	}
+	next := vs.NextHeight(validators)
+	return bs.saveValidatorsRecord(batch, height, validatorsRecord{validators, next.Priorities()})
 }
 
-func (bs *BlockStore) has(key []byte) bool {
-	return bs.db.Has(BlockStoreCF, key)
+// GetConsensusParams returns the consensus params which apply to the block at the given height
+func (bs *BlockStore) GetConsensusParams(height uint64) (types.ConsensusParams, error) {
+	changes, err := bs.getParamsChanges()
+	if err != nil {
+		return types.ConsensusParams{}, err
+	}
+	params := bs.genesis.ConsensusParams
+	for _, change := range changes {
+		if change.Height > height {
+			break
+		}
+		params = change.Params
+	}
+	return params, nil
 }
 
-func (bs *BlockStore) iterator() *gorocksdb.Iterator {
-	return bs.db.GetIterator(BlockStoreCF)
+// saveParamsUpdates records the consensus params updates of header. Changes are kept sorted by the height they
+// take effect, a later update of the same height replaces an earlier one.
+func (bs *BlockStore) saveParamsUpdates(batch Batch, header *types.BlockHeader) error {
+	if len(header.ParamsUpdates) == 0 {
+		return nil
+	}
+	changes, err := bs.getParamsChanges()
+	if err != nil {
+		return err
+	}
+	for _, update := range header.ParamsUpdates {
+		index := sort.Search(len(changes), func(i int) bool {
+			return changes[i].Height > update.Height
+		})
+		change := paramsChange{update.Height, header.Height(), update.Params}
+		changes = append(changes, paramsChange{})
+		copy(changes[index+1:], changes[index:])
+		changes[index] = change
+	}
+	value, err := encoding.MarshalBinary(changes)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(ConsensusParamsKey), value)
+	return nil
+}
+
+func (bs *BlockStore) getParamsChanges() ([]paramsChange, error) {
+	value, err := bs.get([]byte(ConsensusParamsKey))
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]paramsChange, 0)
+	if value == nil {
+		return changes, nil
+	}
+	if err := encoding.UnmarshalBinary(value, &changes); err != nil {
+		return nil, corrupted("consensus params", err)
+	}
+	return changes, nil
+}
+
+// getValidatorsRecord returns the nearest record at or below height and the height it is stored at
+func (bs *BlockStore) getValidatorsRecord(height uint64) (*validatorsRecord, uint64, error) {
+	it, err := bs.db.ReverseIterator(keyFromValidatorsHeight(0), keyFromValidatorsHeight(height + 1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.Close()
+	if !it.Valid() {
+		if err := it.Error(); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("validators of height %v: %w", height, ErrNotFound)
+	}
+	recordHeight := binary.BigEndian.Uint64(it.Key()[len(ValidatorsKeyPrefix):])
+	record := validatorsRecord{}
+	if err := encoding.UnmarshalBinary(it.Value(), &record); err != nil {
+		return nil, 0, corrupted(fmt.Sprintf("validators of height %v", recordHeight), err)
+	}
+	return &record, recordHeight, nil
 }
 
-func (bs *BlockStore) getFromSnapshot(snapshot *gorocksdb.Snapshot, key []byte) []byte {
-	return bs.db.GetFromSnapshot(BlockStoreCF, snapshot, key)
-}
\ No newline at end of file
+func (bs *BlockStore) saveValidatorsRecord(batch Batch, height uint64, record validatorsRecord) error {
+	value, err := encoding.MarshalBinary(record)
+	if err != nil {
+		return err
+	}
+	batch.Put(keyFromValidatorsHeight(height), value)
+	return nil
+}
+
+// deleteValidatorsFrom deletes the validator records of height and above
+func (bs *BlockStore) deleteValidatorsFrom(batch Batch, height uint64) error {
+	prefix := []byte(ValidatorsKeyPrefix)
+	it, err := bs.db.Iterator(keyFromValidatorsHeight(height), prefixEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		batch.Delete(copyBytes(it.Key()))
+	}
+	return it.Error()
+}
+
+func (bs *BlockStore) saveLastHeight(batch Batch, height uint64) error {
+	value, err := encoding.MarshalBinary(height)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(LastHeightKey), value)
+	return nil
+}
+
+func keyFromHeight(height uint64) []byte {
+	return []byte(HeightKeyPrefix + strconv.FormatUint(height, 10))
+}
+
+func keyFromValidatorsHeight(height uint64) []byte {
+	return appendHeight([]byte(ValidatorsKeyPrefix), height)
+}
+
+func keyFromId(id types.Hash) []byte {
+	key := []byte(BlockKeyPrefix)
+	key = append(key, id[:]...)
+	return key
+}
+
+
+// corrupted wraps the decoding error of a stored value
+func corrupted(what string, err error) error {
+	return fmt.Errorf("%s: %w: %v", what, ErrCorrupted, err)
+}
+
+func (bs *BlockStore) get(key []byte) ([]byte, error) {
+	return bs.db.Get(key)
+}
+
+func (bs *BlockStore) has(key []byte) (bool, error) {
+	return bs.db.Has(key)
+}
@@ -0,0 +1,804 @@
+package database
+
+import (
+	"bft/crypto"
+	"bft/encoding"
+	"bft/testutil"
+	"bft/types"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const crashExitCode = 3
+
+func testGenesis() *types.Genesis {
+	publicKey, err := crypto.NewPublicKey("4zWHNAewJRxdzwgfpYzwhJvFzDooxBLHs28JT3AEXEbDMs9ha4")
+	if err != nil {
+		log.Fatal(err)
+	}
+	validator := types.Validator{
+		Address: publicKey.Address(),
+		PublicKey: *publicKey,
+		VotingPower: 1,
+	}
+	genesis := types.NewGenesis("bft-test", types.Validators{validator})
+	genesis.Time = time.Date(2017, 10, 2, 0, 0, 0, 0, time.UTC)
+	return genesis
+}
+
+// newTestBlock is the unsigned block on top of head
+func newTestBlock(head *types.Block) *types.Block {
+	header := *head.Header()
+	header.HeightId = types.BlockHeightId{Height: head.Height() + 1}
+	header.PreviousId = head.Id()
+	header.Timestamp = head.Header().Timestamp.Add(time.Second)
+	header.ValidatorUpdates = nil
+	header.ParamsUpdates = nil
+	header.Commits = nil
+	header.HeightId.Id = header.CalculateId(encoding.MarshalBinary)
+	return &types.Block{SignedHeader: types.SignedBlockHeader{Header: header}}
+}
+
+// crashingStore kills the process instead of running its crashAfter-th write. Writes of a batch count one by one,
+// so the process can die between the writes of a block.
+type crashingStore struct {
+	KVStore
+	writes int
+	crashAfter int
+}
+
+func (s *crashingStore) write() {
+	s.writes++
+	if s.writes == s.crashAfter {
+		os.Exit(crashExitCode)
+	}
+}
+
+func (s *crashingStore) Put(key, value []byte) error {
+	s.write()
+	return s.KVStore.Put(key, value)
+}
+
+func (s *crashingStore) Delete(key []byte) error {
+	s.write()
+	return s.KVStore.Delete(key)
+}
+
+func (s *crashingStore) NewBatch() Batch {
+	return &crashingBatch{Batch: s.KVStore.NewBatch(), store: s}
+}
+
+type crashingBatch struct {
+	Batch
+	store *crashingStore
+}
+
+func (b *crashingBatch) Put(key, value []byte) {
+	b.store.write()
+	b.Batch.Put(key, value)
+}
+
+func (b *crashingBatch) Delete(key []byte) {
+	b.store.write()
+	b.Batch.Delete(key)
+}
+
+func (b *crashingBatch) Write() error {
+	b.store.write()
+	return b.Batch.Write()
+}
+
+// addBlocksUntilCrash runs in a child process, it adds blocks to the store in dir until crashingStore kills it
+func addBlocksUntilCrash(dir string, crashAfter int) {
+	store, err := NewGoLevelDBStore(dir, Options{Sync: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	bs, err := NewBlockStore(&crashingStore{KVStore: store, crashAfter: crashAfter}, testGenesis())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		head, err := bs.Head()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := bs.AddBlock(newTestBlock(head)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	store.Close()
+}
+
+func TestAddBlockCrash(t *testing.T) {
+	if dir := os.Getenv("BFT_CRASH_DIR"); dir != "" {
+		crashAfter, _ := strconv.Atoi(os.Getenv("BFT_CRASH_AFTER"))
+		addBlocksUntilCrash(dir, crashAfter)
+		return
+	}
+	crashed := true
+	for crashAfter := 1; crashed; crashAfter++ {
+		dir, err := ioutil.TempDir("", "blockstore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAddBlockCrash$")
+		cmd.Env = append(os.Environ(), "BFT_CRASH_DIR=" + dir, fmt.Sprintf("BFT_CRASH_AFTER=%d", crashAfter))
+		err = cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if code := exitErr.ExitCode(); code != crashExitCode {
+				t.Fatalf("child process failed with exit code %d", code)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			// every write has been done
+			crashed = false
+		}
+		store, err := NewGoLevelDBStore(dir, Options{Sync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkConsistent(t, store, crashAfter)
+		store.Close()
+	}
+}
+
+// checkConsistent reopens the chain and checks that every stored height has its block and the next validators,
+// then adds one more block
+func checkConsistent(t *testing.T, store KVStore, crashAfter int) {
+	bs, err := NewBlockStore(store, testGenesis())
+	if err != nil {
+		t.Fatalf("crash after %d writes: %v", crashAfter, err)
+	}
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		t.Fatalf("crash after %d writes: %v", crashAfter, err)
+	}
+	for height := uint64(1); height <= lastHeight; height++ {
+		if _, err := bs.GetBlockFromHeight(height); err != nil {
+			t.Fatalf("crash after %d writes: %v", crashAfter, err)
+		}
+	}
+	if _, err := bs.GetBlockHeader(lastHeight + 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("crash after %d writes: block %d is stored above the last height %d", crashAfter, lastHeight + 1, lastHeight)
+	}
+	if _, err := bs.GetValidators(lastHeight + 1); err != nil {
+		t.Fatalf("crash after %d writes: %v", crashAfter, err)
+	}
+	head, err := bs.Head()
+	if err != nil {
+		t.Fatalf("crash after %d writes: %v", crashAfter, err)
+	}
+	if err := bs.AddBlock(newTestBlock(head)); err != nil {
+		t.Fatalf("crash after %d writes: %v", crashAfter, err)
+	}
+}
+
+func TestBlockStoreErrors(t *testing.T) {
+	store := NewMemoryStore()
+	bs, err := NewBlockStore(store, testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlockFromHeight(2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := bs.GetValidators(100); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	store.Put(keyFromHeight(2), []byte{1})
+	if _, err := bs.GetBlockHeader(2); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	head, err := bs.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.AddBlock(newTestBlock(head)); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("a corrupted header should fail AddBlock, got %v", err)
+	}
+	bs.Close()
+	if _, err := bs.GetBlockHeader(1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+// validators are only stored at the heights where they change
+func TestValidatorRecords(t *testing.T) {
+	store := NewMemoryStore()
+	bs, err := NewBlockStore(store, testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := types.Validator{Address: key.PublicKey().Address(), PublicKey: *key.PublicKey(), VotingPower: 2}
+	head, _ := bs.Head()
+	for height := uint64(2); height <= 10; height++ {
+		block := newTestBlock(head)
+		if height == 4 {
+			block.Header().ValidatorUpdates = types.Validators{added}
+		}
+		if err := bs.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		head = block
+	}
+	records := func() int {
+		count := 0
+		it, _ := store.Iterator([]byte(ValidatorsKeyPrefix), prefixEnd([]byte(ValidatorsKeyPrefix)))
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			count++
+		}
+		return count
+	}
+	if count := records(); count != 2 {
+		t.Fatalf("expected the records of heights 1 and %d, got %d records", 4 + types.ValidatorUpdateDelay, count)
+	}
+	for height := uint64(1); height <= 10 + types.ValidatorUpdateDelay; height++ {
+		validators, err := bs.GetValidators(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := 1
+		if height >= 4 + types.ValidatorUpdateDelay {
+			expected = 2
+		}
+		if len(validators) != expected {
+			t.Fatalf("expected %d validators at height %d, got %d", expected, height, len(validators))
+		}
+	}
+	if _, err := bs.GetValidators(11 + types.ValidatorUpdateDelay); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := bs.ResetValidators(testGenesis().Validators); err != nil {
+		t.Fatal(err)
+	}
+	if count := records(); count != 1 {
+		t.Fatalf("a reset should leave one record, got %d", count)
+	}
+	if validators, err := bs.GetValidators(10); err != nil || len(validators) != 1 {
+		t.Fatalf("the reset validators should apply to every height, got %v", err)
+	}
+}
+
+func TestQueryBlocks(t *testing.T) {
+	bs, err := NewBlockStore(NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime := testGenesis().Time
+	head, _ := bs.Head()
+	// blocks 2 to 10, the even ones are proposed by "even"
+	for height := 2; height <= 10; height++ {
+		block := newTestBlock(head)
+		block.Header().Proposer.Address = "odd"
+		if height % 2 == 0 {
+			block.Header().Proposer.Address = "even"
+		}
+		block.Header().HeightId.Id = block.Header().CalculateId(encoding.MarshalBinary)
+		if err := bs.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		head = block
+	}
+	heights := func(blocks []*types.Block) []uint64 {
+		result := make([]uint64, 0)
+		for _, block := range blocks {
+			result = append(result, block.Height())
+		}
+		return result
+	}
+	// pages follows the cursors of q and returns the heights of every page
+	pages := func(q BlockQuery) [][]uint64 {
+		result := make([][]uint64, 0)
+		for {
+			page, err := bs.QueryBlocks(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result = append(result, heights(page.Blocks))
+			if page.Next == "" {
+				return result
+			}
+			q.Cursor = page.Next
+		}
+	}
+	tests := []struct {
+		query BlockQuery
+		expected string
+	}{
+		{BlockQuery{}, "[[1 2 3 4 5 6 7 8 9 10]]"},
+		{BlockQuery{Start: 3, End: 7, Limit: 2}, "[[3 4] [5 6] [7]]"},
+		{BlockQuery{Descending: true, Limit: 4}, "[[10 9 8 7] [6 5 4 3] [2 1]]"},
+		{BlockQuery{Start: 20}, "[[]]"},
+		{BlockQuery{Proposer: "even", Limit: 2}, "[[2 4] [6 8] [10]]"},
+		{BlockQuery{Proposer: "even", Start: 3, End: 8, Descending: true}, "[[8 6 4]]"},
+		{BlockQuery{From: genesisTime.Add(3 * time.Second), To: genesisTime.Add(6 * time.Second), Limit: 2}, "[[4 5] [6]]"},
+		{BlockQuery{From: genesisTime.Add(7 * time.Second), Descending: true, Limit: 2}, "[[10 9] [8]]"},
+		{BlockQuery{Proposer: "even", From: genesisTime.Add(5 * time.Second)}, "[[6 8 10]]"},
+		{BlockQuery{From: genesisTime.Add(2 * time.Second), To: genesisTime.Add(9 * time.Second), Start: 5, End: 7, Limit: 2}, "[[5 6] [7]]"},
+		{BlockQuery{From: genesisTime.Add(2 * time.Second), Start: 8, Descending: true}, "[[10 9 8]]"},
+	}
+	for _, test := range tests {
+		if result := fmt.Sprint(pages(test.query)); result != test.expected {
+			t.Fatalf("query %+v: expected %s, got %s", test.query, test.expected, result)
+		}
+	}
+	// a time range reads the blocks of the height range only
+	header, err := bs.db.Get(keyFromHeight(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.db.Put(keyFromHeight(3), []byte{1})
+	if result := fmt.Sprint(pages(BlockQuery{From: genesisTime, Start: 5, End: 6})); result != "[[5 6]]" {
+		t.Fatalf("expected [[5 6]], got %s", result)
+	}
+	bs.db.Put(keyFromHeight(3), header)
+	count := 0
+	err = bs.IterateBlocks(BlockQuery{Start: 4, Descending: true}, func(block *types.Block) bool {
+		count++
+		return block.Height() > 6
+	})
+	if err != nil || count != 5 {
+		t.Fatalf("iteration should stop at height 6 after 5 blocks, got %d %v", count, err)
+	}
+	if _, err := bs.QueryBlocks(BlockQuery{Cursor: "abc"}); err == nil {
+		t.Fatal("invalid cursor should be rejected")
+	}
+	// removed blocks leave the indexes
+	if err := bs.RemoveBlock(4); err != nil {
+		t.Fatal(err)
+	}
+	if result := fmt.Sprint(pages(BlockQuery{Proposer: "even"})); result != "[[2 6 8 10]]" {
+		t.Fatalf("removed block should not be listed, got %s", result)
+	}
+}
+
+func TestTransactionIndex(t *testing.T) {
+	bs, err := NewBlockStore(NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := bs.Head()
+	// block h carries "tx h", blocks 3 and 5 carry "dup" as well
+	dup := types.Transaction("dup")
+	for height := 2; height <= 10; height++ {
+		block := newTestBlock(head)
+		block.Transactions = types.Transactions{types.Transaction(fmt.Sprintf("tx %d", height))}
+		if height == 3 || height == 5 {
+			block.Transactions = append(block.Transactions, dup)
+		}
+		block.Header().TransactionsHash = block.Transactions.Hash()
+		block.Header().HeightId.Id = block.Header().CalculateId(encoding.MarshalBinary)
+		if err := bs.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		head = block
+	}
+	find := func(tx types.Transaction) (uint64, int) {
+		committed, err := bs.GetTransaction(tx.Hash())
+		if errors.Is(err, ErrNotFound) {
+			return 0, -1
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !committed.Tx.Hash().Equals(tx.Hash()) {
+			t.Fatalf("transaction %s found for %s", committed.Tx, tx)
+		}
+		return committed.Height, committed.Index
+	}
+	// indexed heights lists the heights of the transaction index keys
+	indexedHeights := func() string {
+		heights := make(map[uint64]bool, 0)
+		prefix := []byte(TransactionIndexPrefix)
+		it, _ := bs.db.Iterator(prefix, prefixEnd(prefix))
+		for ; it.Valid(); it.Next() {
+			heights[binary.BigEndian.Uint64(it.Key()[len(it.Key()) - 8:])] = true
+		}
+		it.Close()
+		result := make([]uint64, 0)
+		for height := uint64(1); height <= 10; height++ {
+			if heights[height] {
+				result = append(result, height)
+			}
+		}
+		return fmt.Sprint(result)
+	}
+	if height, index := find(types.Transaction("tx 4")); height != 4 || index != 0 {
+		t.Fatalf("expected tx 4 at height 4 index 0, got %d %d", height, index)
+	}
+	if height, index := find(dup); height != 3 || index != 1 {
+		t.Fatalf("expected dup at height 3 index 1, got %d %d", height, index)
+	}
+	if height, _ := find(types.Transaction("unknown")); height != 0 {
+		t.Fatalf("unknown transaction should not be found at height %d", height)
+	}
+	// truncated, removed and pruned blocks take their keys along
+	if _, err := bs.Rollback(8, "other", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.RemoveBlock(8); err != nil {
+		t.Fatal(err)
+	}
+	pruner := NewPruner(bs, RetentionPolicy{KeepBlocks: 4})
+	if err := pruner.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if heights := indexedHeights(); heights != "[4 5 6 7]" {
+		t.Fatalf("expected transaction keys of heights [4 5 6 7], got %s", heights)
+	}
+	for _, tx := range []string{"tx 3", "tx 8", "tx 9"} {
+		if height, _ := find(types.Transaction(tx)); height != 0 {
+			t.Fatalf("%s should not be found, got height %d", tx, height)
+		}
+	}
+	if height, _ := find(dup); height != 5 {
+		t.Fatalf("dup should be found at height 5 once height 3 is pruned, got %d", height)
+	}
+	// the keys of a block added again are written with it
+	head, _ = bs.Head()
+	block := newTestBlock(head)
+	block.Transactions = types.Transactions{types.Transaction("tx 9")}
+	block.Header().TransactionsHash = block.Transactions.Hash()
+	block.Header().HeightId.Id = block.Header().CalculateId(encoding.MarshalBinary)
+	if err := bs.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := find(types.Transaction("tx 9")); height != 8 {
+		t.Fatalf("tx 9 should be found at height 8, got %d", height)
+	}
+}
+
+func TestPruning(t *testing.T) {
+	bs, err := NewBlockStore(NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime := testGenesis().Time
+	head, _ := bs.Head()
+	// block h is one second per height younger than the genesis
+	for height := 2; height <= 30; height++ {
+		block := newTestBlock(head)
+		if err := bs.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		head = block
+	}
+	prune := func(policy RetentionPolicy) (HeightRange, HeightRange) {
+		pruner := NewPruner(bs, policy)
+		pruner.now = func() time.Time {
+			return genesisTime.Add(30 * time.Second)
+		}
+		if err := pruner.Prune(); err != nil {
+			t.Fatal(err)
+		}
+		blocks, headers, err := bs.Pruned()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blocks, headers
+	}
+	if blocks, headers := prune(RetentionPolicy{KeepTime: 12 * time.Second}); blocks.String() != "2-18" || !headers.Empty() {
+		t.Fatalf("unexpected pruned blocks %s and headers %s", blocks, headers)
+	}
+	if blocks, headers := prune(RetentionPolicy{KeepBlocks: 10, KeepHeaders: 20}); blocks.String() != "2-20" || headers.String() != "2-10" {
+		t.Fatalf("unexpected pruned blocks %s and headers %s", blocks, headers)
+	}
+	for height := uint64(1); height <= 30; height++ {
+		_, headerErr := bs.GetBlockHeader(height)
+		_, blockErr := bs.GetBlockFromHeight(height)
+		prunedHeader := height >= 2 && height <= 10
+		prunedBlock := height >= 2 && height <= 20
+		if errors.Is(headerErr, ErrNotFound) != prunedHeader || errors.Is(blockErr, ErrNotFound) != prunedBlock {
+			t.Fatalf("height %d: unexpected header error %v and block error %v", height, headerErr, blockErr)
+		}
+		if _, err := bs.GetValidators(height); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := bs.QueryBlocks(BlockQuery{From: genesisTime})
+	if err != nil || len(page.Blocks) != 11 {
+		t.Fatalf("only the kept blocks should be listed, got %v", err)
+	}
+	// removing the last height makes the previous block the head
+	if err := bs.RemoveBlock(30); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := bs.Head(); err != nil || head.Height() != 29 {
+		t.Fatalf("head should be at height 29, got %v", err)
+	}
+	// the head is kept whatever the policy
+	if blocks, _ := prune(RetentionPolicy{KeepBlocks: 1, KeepHeaders: 1}); blocks.String() != "2-28" {
+		t.Fatalf("unexpected pruned blocks %s", blocks)
+	}
+	if _, err := bs.GetBlockFromHeight(29); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockStore(bs.db, testGenesis()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the pruner runs in the background while consensus adds blocks and the RPC reads the head
+func TestPruningWhileAdding(t *testing.T) {
+	bs, err := NewBlockStore(NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruner := NewPruner(bs, RetentionPolicy{KeepBlocks: 5, KeepHeaders: 10})
+	done := make(chan struct{})
+	finished := make(chan error, 2)
+	go func() {
+		for {
+			select {
+			case <-done:
+				finished <- nil
+				return
+			default:
+			}
+			if err := pruner.Prune(); err != nil {
+				finished <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				finished <- nil
+				return
+			default:
+			}
+			if _, err := bs.Head(); err != nil {
+				finished <- err
+				return
+			}
+			if _, err := bs.LastHeight(); err != nil {
+				finished <- err
+				return
+			}
+		}
+	}()
+	for height := 2; height <= 50; height++ {
+		head, err := bs.Head()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.AddBlock(newTestBlock(head)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	for i := 0; i < 2; i++ {
+		if err := <-finished; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruner.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if blocks, headers, err := bs.Pruned(); err != nil || blocks.String() != "2-45" || headers.String() != "2-40" {
+		t.Fatalf("unexpected pruned blocks %s and headers %s, %v", blocks, headers, err)
+	}
+}
+
+// newSignedChain is a chain of blocks committed by a single validator with a random key
+func newSignedChain(t *testing.T, height uint64) (*BlockStore, KVStore) {
+	key, validator := testutil.NewValidator(t)
+	store := NewMemoryStore()
+	bs, err := NewBlockStore(store, types.NewGenesis("bft-test", types.Validators{validator}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := bs.Head()
+	for h := uint64(2); h <= height; h++ {
+		block := testutil.NewCommittedBlock(t, head, key, validator)
+		if err := bs.VerifyNext(block); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		head = block
+	}
+	return bs, store
+}
+
+func TestCheckRepair(t *testing.T) {
+	bs, store := newSignedChain(t, 6)
+	check := func() *CheckReport {
+		report, err := bs.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	if report := check(); !report.OK() || report.ConsistentHeight != 6 || report.Headers != 6 || report.Blocks != 6 {
+		t.Fatalf("unexpected report of a healthy store %+v", report)
+	}
+	// a header above the last height, as left by a crash between the writes of a block
+	header, _ := bs.GetBlockHeader(6)
+	header.HeightId.Height = 7
+	value, _ := encoding.MarshalBinary(header)
+	store.Put(keyFromHeight(7), value)
+	// a header which does not decode
+	store.Put(keyFromHeight(4), []byte{1, 2, 3})
+	report := check()
+	if report.OK() || report.ConsistentHeight != 3 || report.LastHeight != 6 {
+		t.Fatalf("unexpected report of a damaged store %+v", report)
+	}
+	if err := bs.Repair(report); err != nil {
+		t.Fatal(err)
+	}
+	if report := check(); !report.OK() || report.ConsistentHeight != 3 || report.Blocks != 3 {
+		t.Fatalf("unexpected report of a repaired store %+v", report)
+	}
+	head, err := bs.Head()
+	if err != nil || head.Height() != 3 {
+		t.Fatalf("head should be at height 3, got %v", err)
+	}
+	if _, err := bs.GetValidators(6); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("validators above the new head should be removed, got %v", err)
+	}
+	for _, prefix := range []string{ProposerIndexPrefix, TimeIndexPrefix} {
+		it, _ := store.Iterator([]byte(prefix), prefixEnd([]byte(prefix)))
+		for ; it.Valid(); it.Next() {
+			if height := binary.BigEndian.Uint64(it.Key()[len(it.Key()) - 8:]); height > 3 {
+				t.Fatalf("index key of height %d should be removed", height)
+			}
+		}
+		it.Close()
+	}
+	if err := bs.AddBlock(newTestBlock(head)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckCorruptedLastHeight(t *testing.T) {
+	bs, store := newSignedChain(t, 5)
+	genesis := bs.Genesis()
+	store.Put([]byte(LastHeightKey), []byte{1})
+	if _, err := NewBlockStore(store, genesis); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	bs, err := OpenForCheck(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := bs.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.ConsistentHeight != 5 || report.Headers != 5 {
+		t.Fatalf("unexpected report of a store with a corrupted last height %+v", report)
+	}
+	if value, _ := store.Get([]byte(LastHeightKey)); len(value) != 1 {
+		t.Fatal("a check should not write to the store")
+	}
+	if err := bs.Repair(report); err != nil {
+		t.Fatal(err)
+	}
+	bs, err = NewBlockStore(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastHeight, err := bs.LastHeight(); err != nil || lastHeight != 5 {
+		t.Fatalf("the repair should keep every block, last height %d %v", lastHeight, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	bs, _ := newSignedChain(t, 6)
+	head, _ := bs.Head()
+	validator := head.Header().Proposer.Address
+	if removed, err := bs.Rollback(4, "other", false); err != nil || removed.String() != "5-6" {
+		t.Fatalf("unexpected rollback %s %v", removed, err)
+	}
+	if head, err := bs.Head(); err != nil || head.Height() != 4 {
+		t.Fatalf("head should be at height 4, got %v", err)
+	}
+	if _, err := bs.Rollback(2, validator, false); !errors.Is(err, ErrSignedCommit) {
+		t.Fatalf("expected ErrSignedCommit, got %v", err)
+	}
+	if lastHeight, _ := bs.LastHeight(); lastHeight != 4 {
+		t.Fatalf("a refused rollback should keep the blocks, last height %d", lastHeight)
+	}
+	if removed, err := bs.Rollback(2, validator, true); err != nil || removed.String() != "3-4" {
+		t.Fatalf("unexpected forced rollback %s %v", removed, err)
+	}
+	state, err := bs.SignState()
+	if err != nil || state == nil || state.Address != validator || state.Height != 4 || state.Round != math.MaxUint64 {
+		t.Fatalf("a forced rollback should hold the removed heights, got %v %v", state, err)
+	}
+	if state.Allows(validator, types.View{Height: 4, Round: 7}) || !state.Allows(validator, types.View{Height: 5, Round: 1}) {
+		t.Fatal("the validator should only vote above the old head")
+	}
+	if !state.Allows("other", types.View{Height: 3, Round: 1}) {
+		t.Fatal("the sign state should not refuse another validator")
+	}
+	if removed, err := bs.Rollback(5, validator, false); err != nil || !removed.Empty() {
+		t.Fatalf("rollback above the head should do nothing, got %s %v", removed, err)
+	}
+	if _, err := bs.Rollback(0, validator, true); err == nil {
+		t.Fatal("the genesis block should not be rolled back")
+	}
+	head, _ = bs.Head()
+	if err := bs.AddBlock(newTestBlock(head)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the commit of the local validator reached the others but not the stored block
+func TestRollbackRefusesSignedState(t *testing.T) {
+	bs, _ := newSignedChain(t, 6)
+	if err := bs.SaveSignState(SignState{Address: "local", Height: 5, Round: 2}); err != nil {
+		t.Fatal(err)
+	}
+	head, _ := bs.Head()
+	for _, vote := range head.Header().Commits {
+		if vote.Address == "local" {
+			t.Fatal("the stored commits should not include the local vote")
+		}
+	}
+	if _, err := bs.Rollback(4, "local", false); !errors.Is(err, ErrSignedCommit) {
+		t.Fatalf("expected ErrSignedCommit, got %v", err)
+	}
+	if removed, err := bs.Rollback(5, "local", false); err != nil || removed.String() != "6-6" {
+		t.Fatalf("heights above the sign state should be removed, got %s %v", removed, err)
+	}
+	if removed, err := bs.Rollback(3, "other", false); err != nil || removed.String() != "4-5" {
+		t.Fatalf("the sign state of another validator should not refuse, got %s %v", removed, err)
+	}
+	if state, err := bs.SignState(); err != nil || state.Height != 5 {
+		t.Fatalf("a rollback should keep the sign state, got %v %v", state, err)
+	}
+}
+
+func TestBlockStoreSnapshot(t *testing.T) {
+	bs, err := NewBlockStore(NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := bs.Head()
+	snapshot, err := bs.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.AddBlock(newTestBlock(head)); err != nil {
+		t.Fatal(err)
+	}
+	if lastHeight, err := snapshot.LastHeight(); err != nil || lastHeight != 1 {
+		t.Fatalf("snapshot should not see block 2, last height %d %v", lastHeight, err)
+	}
+	page, err := snapshot.QueryBlocks(BlockQuery{From: testGenesis().Time})
+	if err != nil || len(page.Blocks) != 1 {
+		t.Fatalf("snapshot should list the genesis block only, got %v", err)
+	}
+	snapshotHead, _ := snapshot.Head()
+	if err := snapshot.AddBlock(newTestBlock(snapshotHead)); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := snapshot.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lastHeight, err := bs.LastHeight(); err != nil || lastHeight != 2 {
+		t.Fatalf("closing the snapshot should keep the store open, last height %d %v", lastHeight, err)
+	}
+}
@@ -0,0 +1,287 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// CheckReport is the result of BlockStore.Check
+type CheckReport struct {
+	LastHeight uint64 // stored last height
+	ConsistentHeight uint64 // every check passed up to this height, 0 if the genesis block fails
+	Headers uint64 // checked headers
+	Blocks uint64 // checked bodies
+	Problems []string
+	orphans [][]byte // block keys which no header points to
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *CheckReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// OpenForCheck opens the chain of genesis in db for Check and Repair. Unlike NewBlockStore it neither reads the last
+// height nor writes, so a damaged store is checked as it is. A store which has not been migrated is refused, its
+// blocks would be checked in the wrong layout.
+func OpenForCheck(db KVStore, genesis *types.Genesis) (*BlockStore, error) {
+	bs, genesisBlock, err := newBlockStore(db, genesis)
+	if err != nil {
+		return nil, err
+	}
+	version, err := bs.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("database schema version %d is newer than version %d of this node", version, SchemaVersion)
+	}
+	if version < SchemaVersion {
+		// the legacy height is raised to the last height before a migration rewrites the first block
+		legacyHeight, err := bs.legacyHeight()
+		if err != nil {
+			return nil, err
+		}
+		lastHeight, err := bs.storedLastHeight()
+		if err != nil {
+			return nil, err
+		}
+		if legacyHeight < lastHeight {
+			return nil, fmt.Errorf("database schema version %d is older than version %d, the node migrates it when it starts", version, SchemaVersion)
+		}
+	}
+	if err := bs.checkGenesis(genesisBlock); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// Check walks every header key and every block key. It checks that each header decodes and hashes to its id, that
+// it links to the previous header and that its commits verify, that each body matches its header and is signed by
+// its proposer, and that the last height is the highest stored height.
+func (bs *BlockStore) Check() (*CheckReport, error) {
+	report := &CheckReport{}
+	lastHeight, err := bs.storedLastHeight()
+	if err != nil && !errors.Is(err, ErrCorrupted) {
+		return nil, err
+	}
+	lastHeightCorrupted := err != nil
+	if lastHeightCorrupted {
+		report.problem("%v", err)
+	}
+	report.LastHeight = lastHeight
+	info, err := bs.getPrunedInfo()
+	if err != nil && !errors.Is(err, ErrCorrupted) {
+		return nil, err
+	}
+	if err != nil {
+		report.problem("%v", err)
+		info = &prunedInfo{}
+	}
+	heights, invalidKeys, err := bs.storedHeights(HeightKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range invalidKeys {
+		report.problem("key %q is not a height key", key)
+	}
+	maxHeight := lastHeight
+	if len(heights) > 0 && heights[len(heights) - 1] > maxHeight {
+		maxHeight = heights[len(heights) - 1]
+	}
+	if maxHeight != lastHeight && !lastHeightCorrupted {
+		report.problem("last height is %d but headers are stored up to height %d", lastHeight, maxHeight)
+	}
+	consistent := true
+	report.ConsistentHeight = maxHeight
+	// a corrupted last height is rewritten by the repair, the headers decide up to which height the chain is kept
+	if lastHeight < maxHeight && !lastHeightCorrupted {
+		report.ConsistentHeight = lastHeight
+	}
+	legacyHeight, err := bs.legacyHeight()
+	if err != nil && !errors.Is(err, ErrCorrupted) {
+		return nil, err
+	}
+	if err != nil {
+		report.problem("%v", err)
+	}
+	var previous *types.BlockHeader
+	for height := uint64(1); height <= maxHeight; height++ {
+		if height == 2 && info.HeaderBase > 2 {
+			// the headers before the base are pruned, the first kept one can not be linked
+			height = info.HeaderBase
+			previous = nil
+		}
+		header, err := bs.checkHeader(height, previous, info, legacyHeight)
+		if err != nil {
+			report.problem("height %d: %v", height, err)
+			if consistent {
+				consistent = false
+				if height - 1 < report.ConsistentHeight {
+					report.ConsistentHeight = height - 1
+				}
+			}
+		}
+		if header != nil {
+			report.Headers++
+		}
+		previous = header
+	}
+	if err := bs.checkBlocks(report, legacyHeight); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// checkHeader checks the header at height and that its body is stored unless it has been pruned. The header is
+// returned if it decodes to the header of height, even if a check fails. Headers up to the legacy height hash to
+// their id in an earlier layout, their commits are not checked.
+func (bs *BlockStore) checkHeader(height uint64, previous *types.BlockHeader, info *prunedInfo, legacyHeight uint64) (*types.BlockHeader, error) {
+	header, err := bs.readHeader(height, legacyHeight)
+	if err != nil {
+		return nil, err
+	}
+	if header.Height() != height {
+		return nil, fmt.Errorf("header of height %d is stored", header.Height())
+	}
+	if height > legacyHeight && !header.VerifyId(encoding.MarshalBinary) {
+		return header, fmt.Errorf("header does not hash to id %s", header.Id().String())
+	}
+	if height == 1 {
+		return header, nil
+	}
+	if previous != nil && !header.PreviousId.Equals(previous.Id()) {
+		return header, fmt.Errorf("previous id %s does not link to %s", header.PreviousId.String(), previous.HeightId.String())
+	}
+	if height > legacyHeight {
+		// the record is read directly, the bound of GetValidators depends on the last height which may be damaged
+		record, _, err := bs.getValidatorsRecord(height)
+		if err != nil {
+			return header, err
+		}
+		if err := header.VerifyCommits(record.Validators, encoding.MarshalBinary); err != nil {
+			return header, err
+		}
+	}
+	if height >= info.BlockBase {
+		has, err := bs.has(keyFromId(header.Id()))
+		if err != nil {
+			return header, err
+		}
+		if !has {
+			return header, fmt.Errorf("block %s is missing", header.Id().String())
+		}
+	}
+	return header, nil
+}
+
+// checkBlocks checks every stored body against the header of its height, bodies without a header are orphans
+func (bs *BlockStore) checkBlocks(report *CheckReport, legacyHeight uint64) error {
+	prefix := []byte(BlockKeyPrefix)
+	it, err := bs.db.Iterator(prefix, prefixEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key := copyBytes(it.Key())
+		block, err := decodeBlock(it.Value(), legacyHeight)
+		if err != nil {
+			report.problem("block key %x: %v", key, err)
+			report.orphans = append(report.orphans, key)
+			continue
+		}
+		report.Blocks++
+		if !bytes.Equal(keyFromId(block.Id()), key) {
+			report.problem("block key %x holds block %s", key, block.Header().HeightId.String())
+			report.orphans = append(report.orphans, key)
+			continue
+		}
+		header, err := bs.readHeader(block.Height(), legacyHeight)
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupted) {
+			return err
+		}
+		if err != nil || !header.Id().Equals(block.Id()) {
+			report.problem("block %s has no header", block.Header().HeightId.String())
+			report.orphans = append(report.orphans, key)
+			continue
+		}
+		if block.Height() == 1 {
+			continue
+		}
+		blockId := block.Id()
+		signature := block.Signature()
+		if !signature.Verify(header.Proposer.Address, blockId[:]) {
+			report.problem("block %s is not signed by its proposer", block.Header().HeightId.String())
+			if block.Height() - 1 < report.ConsistentHeight {
+				report.ConsistentHeight = block.Height() - 1
+			}
+		}
+	}
+	return it.Error()
+}
+
+// decodeBlock reads a block of the current layout, or of an earlier one if the store has legacy blocks. A block of
+// an earlier layout has to hash to its id, so it is not mistaken for a block of the current layout.
+func decodeBlock(value []byte, legacyHeight uint64) (*types.Block, error) {
+	if legacyHeight > 0 {
+		if block, err := decodeLegacyBlock(value); err == nil && block.Height() <= legacyHeight {
+			return block, nil
+		}
+	}
+	block := types.Block{}
+	if err := encoding.UnmarshalBinary(value, &block); err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// Repair truncates the store to the consistent height of report and deletes the orphaned bodies
+func (bs *BlockStore) Repair(report *CheckReport) error {
+	if report.ConsistentHeight == 0 {
+		return fmt.Errorf("the genesis block is damaged, the database has to be reset")
+	}
+	if err := bs.Truncate(report.ConsistentHeight); err != nil {
+		return err
+	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	for _, key := range report.orphans {
+		batch.Delete(key)
+	}
+	return batch.Write()
+}
+
+// storedHeights returns the heights of the keys of a height keyed prefix in ascending order, and the keys of the
+// prefix which do not end with a height
+func (bs *BlockStore) storedHeights(prefix string) ([]uint64, [][]byte, error) {
+	it, err := bs.db.Iterator([]byte(prefix), prefixEnd([]byte(prefix)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+	heights := make([]uint64, 0)
+	invalidKeys := make([][]byte, 0)
+	for ; it.Valid(); it.Next() {
+		height, err := strconv.ParseUint(string(it.Key()[len(prefix):]), 10, 64)
+		if err != nil || height == 0 {
+			invalidKeys = append(invalidKeys, copyBytes(it.Key()))
+			continue
+		}
+		heights = append(heights, height)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(heights, func(i, j int) bool {
+		return heights[i] < heights[j]
+	})
+	return heights, invalidKeys, nil
+}
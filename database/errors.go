@@ -0,0 +1,12 @@
+package database
+
+import "errors"
+
+// errors of the stores, wrapped errors are matched with errors.Is
+var (
+	ErrNotFound = errors.New("not found")
+	ErrCorrupted = errors.New("corrupted data")
+	ErrClosed = errors.New("database is closed")
+	ErrSignedCommit = errors.New("validator signed a commit")
+	ErrReadOnly = errors.New("snapshot is read only")
+)
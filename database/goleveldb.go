@@ -0,0 +1,199 @@
+package database
+
+import (
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbErrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"time"
+)
+
+// GoLevelDBStore is a pure Go store, it needs no cgo
+type GoLevelDBStore struct {
+	db *leveldb.DB
+	writeOptions *opt.WriteOptions
+}
+
+func NewGoLevelDBStore(path string, options Options) (*GoLevelDBStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &GoLevelDBStore{
+		db: db,
+		writeOptions: &opt.WriteOptions{Sync: options.Sync},
+	}, nil
+}
+
+func (s *GoLevelDBStore) Get(key []byte) ([]byte, error) {
+	defer readDuration.ObserveSince(time.Now(), GoLevelDBBackend)
+	value, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, convertError(err)
+}
+
+func (s *GoLevelDBStore) Has(key []byte) (bool, error) {
+	has, err := s.db.Has(key, nil)
+	return has, convertError(err)
+}
+
+func (s *GoLevelDBStore) Put(key, value []byte) error {
+	defer writeDuration.ObserveSince(time.Now(), GoLevelDBBackend, "put")
+	return convertError(s.db.Put(key, value, s.writeOptions))
+}
+
+func (s *GoLevelDBStore) PutSync(key, value []byte) error {
+	defer writeDuration.ObserveSince(time.Now(), GoLevelDBBackend, "put")
+	return convertError(s.db.Put(key, value, &opt.WriteOptions{Sync: true}))
+}
+
+func (s *GoLevelDBStore) Delete(key []byte) error {
+	defer writeDuration.ObserveSince(time.Now(), GoLevelDBBackend, "delete")
+	return convertError(s.db.Delete(key, s.writeOptions))
+}
+
+func (s *GoLevelDBStore) Iterator(start, end []byte) (Iterator, error) {
+	return newGoLevelDBIterator(s.db.NewIterator(&util.Range{Start: start, Limit: end}, nil), false), nil
+}
+
+func (s *GoLevelDBStore) ReverseIterator(start, end []byte) (Iterator, error) {
+	return newGoLevelDBIterator(s.db.NewIterator(&util.Range{Start: start, Limit: end}, nil), true), nil
+}
+
+func (s *GoLevelDBStore) NewBatch() Batch {
+	return &goLevelDBBatch{store: s, batch: new(leveldb.Batch)}
+}
+
+func (s *GoLevelDBStore) Snapshot() (Snapshot, error) {
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return &goLevelDBSnapshot{snapshot: snapshot}, nil
+}
+
+func (s *GoLevelDBStore) Compact(start, end []byte) error {
+	return convertError(s.db.CompactRange(util.Range{Start: start, Limit: end}))
+}
+
+func (s *GoLevelDBStore) Close() error {
+	return convertError(s.db.Close())
+}
+
+type goLevelDBBatch struct {
+	store *GoLevelDBStore
+	batch *leveldb.Batch
+}
+
+func (b *goLevelDBBatch) Put(key, value []byte) {
+	b.batch.Put(key, value)
+}
+
+func (b *goLevelDBBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+}
+
+func (b *goLevelDBBatch) Write() error {
+	defer writeDuration.ObserveSince(time.Now(), GoLevelDBBackend, "batch")
+	return convertError(b.store.db.Write(b.batch, b.store.writeOptions))
+}
+
+func (b *goLevelDBBatch) Close() {
+	b.batch.Reset()
+}
+
+type goLevelDBSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *goLevelDBSnapshot) Get(key []byte) ([]byte, error) {
+	value, err := s.snapshot.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, convertError(err)
+}
+
+func (s *goLevelDBSnapshot) Has(key []byte) (bool, error) {
+	has, err := s.snapshot.Has(key, nil)
+	return has, convertError(err)
+}
+
+func (s *goLevelDBSnapshot) Iterator(start, end []byte) (Iterator, error) {
+	return newGoLevelDBIterator(s.snapshot.NewIterator(&util.Range{Start: start, Limit: end}, nil), false), nil
+}
+
+func (s *goLevelDBSnapshot) ReverseIterator(start, end []byte) (Iterator, error) {
+	return newGoLevelDBIterator(s.snapshot.NewIterator(&util.Range{Start: start, Limit: end}, nil), true), nil
+}
+
+func (s *goLevelDBSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+// goLevelDBIterator is positioned on the first key when it is created, or on the last key if it is reversed
+type goLevelDBIterator struct {
+	source iterator.Iterator
+	valid bool
+	reverse bool
+}
+
+func newGoLevelDBIterator(source iterator.Iterator, reverse bool) *goLevelDBIterator {
+	it := &goLevelDBIterator{
+		source: source,
+		reverse: reverse,
+	}
+	if reverse {
+		it.valid = source.Last()
+	} else {
+		it.valid = source.First()
+	}
+	return it
+}
+
+func (it *goLevelDBIterator) Valid() bool {
+	return it.valid
+}
+
+func (it *goLevelDBIterator) Next() {
+	if it.reverse {
+		it.valid = it.source.Prev()
+	} else {
+		it.valid = it.source.Next()
+	}
+}
+
+// Key and Value copy, the iterator reuses its buffers
+func (it *goLevelDBIterator) Key() []byte {
+	return copyBytes(it.source.Key())
+}
+
+func (it *goLevelDBIterator) Value() []byte {
+	return copyBytes(it.source.Value())
+}
+
+func (it *goLevelDBIterator) Error() error {
+	return convertError(it.source.Error())
+}
+
+func (it *goLevelDBIterator) Close() {
+	it.source.Release()
+}
+
+// convertError maps the errors of goleveldb to the errors of the package
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == leveldb.ErrClosed || err == leveldb.ErrSnapshotReleased || err == leveldb.ErrIterReleased {
+		return ErrClosed
+	}
+	if leveldbErrors.IsCorrupted(err) {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// backends of OpenKVStore
+const (
+	RocksDBBackend = "rocksdb"
+	GoLevelDBBackend = "goleveldb"
+	MemoryBackend = "memory"
+)
+
+// openRocksDB opens the RocksDB backend, it needs cgo and is built in with the rocksdb build tag only
+var openRocksDB func(path string, options Options) (KVStore, error)
+
+// Reader reads keys, which are ordered bytewise
+type Reader interface {
+	// Get returns nil if the key does not exist
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	// Iterator walks the keys in [start, end) in ascending order, a nil start or end leaves the range open
+	Iterator(start, end []byte) (Iterator, error)
+	// ReverseIterator walks the keys in [start, end) in descending order
+	ReverseIterator(start, end []byte) (Iterator, error)
+}
+
+// KVStore is the storage engine of a BlockStore
+type KVStore interface {
+	Reader
+	Put(key, value []byte) error
+	// PutSync is a Put which waits until the write is flushed to disk, whatever the Sync option
+	PutSync(key, value []byte) error
+	Delete(key []byte) error
+	NewBatch() Batch
+	// Snapshot reads the keys as they are now, later writes are not visible
+	Snapshot() (Snapshot, error)
+	// Compact reclaims the space of deleted keys in [start, end), a nil start or end leaves the range open
+	Compact(start, end []byte) error
+	Close() error
+}
+
+type Iterator interface {
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close()
+}
+
+// Batch collects writes which Write applies at once
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	Write() error
+	Close()
+}
+
+type Snapshot interface {
+	Reader
+	Release()
+}
+
+// Options of the on disk backends
+type Options struct {
+	Sync bool // every write waits until it is flushed to disk
+}
+
+// HasBackend tells whether OpenKVStore can open the stores of backend
+func HasBackend(backend string) bool {
+	switch backend {
+	case RocksDBBackend:
+		return openRocksDB != nil
+	case GoLevelDBBackend, MemoryBackend:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultBackend is RocksDB if it is built in, goleveldb otherwise
+func DefaultBackend() string {
+	if HasBackend(RocksDBBackend) {
+		return RocksDBBackend
+	}
+	return GoLevelDBBackend
+}
+
+// OpenKVStore opens the store of a backend at path, the memory backend ignores the path and the options
+func OpenKVStore(backend string, path string, options Options) (KVStore, error) {
+	switch backend {
+	case RocksDBBackend:
+		if openRocksDB == nil {
+			return nil, fmt.Errorf("database backend %s is not built in, build with -tags rocksdb", backend)
+		}
+		return openRocksDB(path, options)
+	case GoLevelDBBackend:
+		store, err := NewGoLevelDBStore(path, options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case MemoryBackend:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown database backend %s", backend)
+	}
+}
+
+// inRange checks key against the bounds of an iterator
+func inRange(key, start, end []byte) bool {
+	if start != nil && bytes.Compare(key, start) < 0 {
+		return false
+	}
+	return end == nil || bytes.Compare(key, end) < 0
+}
+
+// snapshotStore is a KVStore which reads a snapshot and refuses writes, Close releases the snapshot
+type snapshotStore struct {
+	Reader
+	snapshot Snapshot
+}
+
+func (s *snapshotStore) Put(key, value []byte) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) PutSync(key, value []byte) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) Delete(key []byte) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) NewBatch() Batch {
+	return readOnlyBatch{}
+}
+
+func (s *snapshotStore) Snapshot() (Snapshot, error) {
+	return nil, ErrReadOnly
+}
+
+func (s *snapshotStore) Compact(start, end []byte) error {
+	return ErrReadOnly
+}
+
+func (s *snapshotStore) Close() error {
+	s.snapshot.Release()
+	return nil
+}
+
+type readOnlyBatch struct{}
+
+func (readOnlyBatch) Put(key, value []byte) {}
+
+func (readOnlyBatch) Delete(key []byte) {}
+
+func (readOnlyBatch) Write() error {
+	return ErrReadOnly
+}
+
+func (readOnlyBatch) Close() {}
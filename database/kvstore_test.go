@@ -0,0 +1,216 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encode(i int) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(i))
+	return buf
+}
+
+func decode(buf []byte) int {
+	return int(binary.BigEndian.Uint64(buf))
+}
+
+// testStores opens an empty store of every backend, the returned function closes them
+func testStores(t *testing.T) (map[string]KVStore, func()) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := make(map[string]KVStore, 0)
+	for _, backend := range []string{MemoryBackend, GoLevelDBBackend, RocksDBBackend} {
+		if !HasBackend(backend) {
+			continue
+		}
+		store, err := OpenKVStore(backend, filepath.Join(dir, backend), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[backend] = store
+	}
+	return stores, func() {
+		for _, store := range stores {
+			store.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestKVStore_PutGetDelete(t *testing.T) {
+	stores, closeStores := testStores(t)
+	defer closeStores()
+	for backend, store := range stores {
+		if value, err := store.Get(encode(1)); err != nil || value != nil {
+			t.Fatalf("%s: missing key should read nil, got %v %v", backend, value, err)
+		}
+		if err := store.Put(encode(1), encode(10)); err != nil {
+			t.Fatal(err)
+		}
+		value, err := store.Get(encode(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, encode(10)) {
+			t.Fatalf("%s: expected %v, got %v", backend, encode(10), value)
+		}
+		if has, _ := store.Has(encode(1)); !has {
+			t.Fatalf("%s: %d is not inserted", backend, 1)
+		}
+		if err := store.Delete(encode(1)); err != nil {
+			t.Fatal(err)
+		}
+		if has, _ := store.Has(encode(1)); has {
+			t.Fatalf("%s: %d is not deleted", backend, 1)
+		}
+		if err := store.PutSync(encode(2), encode(20)); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := store.Get(encode(2)); err != nil || !bytes.Equal(value, encode(20)) {
+			t.Fatalf("%s: synced write should read %v, got %v %v", backend, encode(20), value, err)
+		}
+	}
+}
+
+func TestKVStore_Iterator(t *testing.T) {
+	stores, closeStores := testStores(t)
+	defer closeStores()
+	for backend, store := range stores {
+		for _, i := range []int{4, 1, 3, 2, 5} {
+			store.Put(encode(i), encode(i * 10))
+		}
+		check := func(reverse bool, start, end []byte, expected ...int) {
+			iterator := store.Iterator
+			if reverse {
+				iterator = store.ReverseIterator
+			}
+			it, err := iterator(start, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer it.Close()
+			keys := make([]int, 0)
+			for ; it.Valid(); it.Next() {
+				if decode(it.Value()) != decode(it.Key()) * 10 {
+					t.Fatalf("%s: wrong value %v of key %v", backend, it.Value(), it.Key())
+				}
+				keys = append(keys, decode(it.Key()))
+			}
+			if err := it.Error(); err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != len(expected) {
+				t.Fatalf("%s: expected keys %v, got %v", backend, expected, keys)
+			}
+			for i := range keys {
+				if keys[i] != expected[i] {
+					t.Fatalf("%s: expected keys %v, got %v", backend, expected, keys)
+				}
+			}
+		}
+		check(false, nil, nil, 1, 2, 3, 4, 5)
+		check(false, encode(2), encode(4), 2, 3)
+		check(false, encode(3), nil, 3, 4, 5)
+		check(false, nil, encode(2), 1)
+		check(false, encode(6), nil)
+		check(true, nil, nil, 5, 4, 3, 2, 1)
+		check(true, encode(2), encode(4), 3, 2)
+		check(true, encode(3), nil, 5, 4, 3)
+		check(true, nil, encode(2), 1)
+		check(true, nil, encode(9), 5, 4, 3, 2, 1)
+		check(true, encode(6), nil)
+	}
+}
+
+func TestKVStore_Batch(t *testing.T) {
+	stores, closeStores := testStores(t)
+	defer closeStores()
+	for backend, store := range stores {
+		store.Put(encode(1), encode(1))
+		batch := store.NewBatch()
+		batch.Put(encode(2), encode(2))
+		batch.Put(encode(3), encode(3))
+		batch.Delete(encode(1))
+		if has, _ := store.Has(encode(2)); has {
+			t.Fatalf("%s: batch should not be visible before Write", backend)
+		}
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+		batch.Close()
+		for i, expected := range map[int]bool{1: false, 2: true, 3: true} {
+			if has, _ := store.Has(encode(i)); has != expected {
+				t.Fatalf("%s: key %d should exist: %v", backend, i, expected)
+			}
+		}
+	}
+}
+
+func TestKVStore_Snapshot(t *testing.T) {
+	stores, closeStores := testStores(t)
+	defer closeStores()
+	for backend, store := range stores {
+		store.Put(encode(1), encode(1))
+		snapshot, err := store.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put(encode(1), encode(2))
+		store.Put(encode(2), encode(2))
+		value, err := snapshot.Get(encode(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, encode(1)) {
+			t.Fatalf("%s: snapshot should read the old value, got %v", backend, value)
+		}
+		if has, _ := snapshot.Has(encode(2)); has {
+			t.Fatalf("%s: snapshot should not see later writes", backend)
+		}
+		it, err := snapshot.Iterator(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for ; it.Valid(); it.Next() {
+			count++
+		}
+		it.Close()
+		if count != 1 {
+			t.Fatalf("%s: snapshot iterator should see 1 key, got %d", backend, count)
+		}
+		// a second snapshot sees the writes before it only, the first one keeps its view
+		second, err := store.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := store.NewBatch()
+		batch.Delete(encode(2))
+		batch.Put(encode(3), encode(3))
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+		batch.Close()
+		if value, _ := second.Get(encode(1)); !bytes.Equal(value, encode(2)) {
+			t.Fatalf("%s: second snapshot should read the new value, got %v", backend, value)
+		}
+		if has, _ := second.Has(encode(2)); !has {
+			t.Fatalf("%s: second snapshot should keep a key deleted after it", backend)
+		}
+		if has, _ := second.Has(encode(3)); has {
+			t.Fatalf("%s: second snapshot should not see later writes", backend)
+		}
+		if value, _ := snapshot.Get(encode(1)); !bytes.Equal(value, encode(1)) {
+			t.Fatalf("%s: first snapshot should still read the old value, got %v", backend, value)
+		}
+		second.Release()
+		snapshot.Release()
+	}
+}
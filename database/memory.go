@@ -0,0 +1,253 @@
+package database
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps everything in memory, it is meant for tests and throwaway nodes. A snapshot shares the map of
+// the store, the first write after it copies the map.
+type MemoryStore struct {
+	rwMutex sync.RWMutex
+	data map[string][]byte
+	shared bool // a snapshot reads data, it must not change
+	closed bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: make(map[string][]byte, 0),
+	}
+}
+
+func (m *MemoryStore) Get(key []byte) ([]byte, error) {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return copyBytes(m.data[string(key)]), nil
+}
+
+func (m *MemoryStore) Has(key []byte) (bool, error) {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+	_, ok := m.data[string(key)]
+	return ok, nil
+}
+
+func (m *MemoryStore) Put(key, value []byte) error {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.writableData()[string(key)] = copyBytes(value)
+	return nil
+}
+
+// PutSync is Put, the memory store has no disk
+func (m *MemoryStore) PutSync(key, value []byte) error {
+	return m.Put(key, value)
+}
+
+func (m *MemoryStore) Delete(key []byte) error {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	delete(m.writableData(), string(key))
+	return nil
+}
+
+// writableData copies the map shared with a snapshot, the values are never changed in place so they stay shared.
+// The caller holds the write lock.
+func (m *MemoryStore) writableData() map[string][]byte {
+	if m.shared {
+		data := make(map[string][]byte, len(m.data))
+		for k, v := range m.data {
+			data[k] = v
+		}
+		m.data = data
+		m.shared = false
+	}
+	return m.data
+}
+
+// Iterator walks a copy of the range, writes during the iteration are not visible
+func (m *MemoryStore) Iterator(start, end []byte) (Iterator, error) {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return newMemoryIterator(m.data, start, end, false), nil
+}
+
+func (m *MemoryStore) ReverseIterator(start, end []byte) (Iterator, error) {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return newMemoryIterator(m.data, start, end, true), nil
+}
+
+func (m *MemoryStore) NewBatch() Batch {
+	return &memoryBatch{store: m}
+}
+
+func (m *MemoryStore) Snapshot() (Snapshot, error) {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	m.shared = true
+	return &memorySnapshot{data: m.data}, nil
+}
+
+// Compact has nothing to reclaim, deleted keys are freed at once
+func (m *MemoryStore) Compact(start, end []byte) error {
+	m.rwMutex.RLock()
+	defer m.rwMutex.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	m.closed = true
+	return nil
+}
+
+type memoryOperation struct {
+	key string
+	value []byte
+	delete bool
+}
+
+type memoryBatch struct {
+	store *MemoryStore
+	operations []memoryOperation
+}
+
+func (b *memoryBatch) Put(key, value []byte) {
+	b.operations = append(b.operations, memoryOperation{key: string(key), value: copyBytes(value)})
+}
+
+func (b *memoryBatch) Delete(key []byte) {
+	b.operations = append(b.operations, memoryOperation{key: string(key), delete: true})
+}
+
+func (b *memoryBatch) Write() error {
+	b.store.rwMutex.Lock()
+	defer b.store.rwMutex.Unlock()
+	if b.store.closed {
+		return ErrClosed
+	}
+	data := b.store.writableData()
+	for _, operation := range b.operations {
+		if operation.delete {
+			delete(data, operation.key)
+		} else {
+			data[operation.key] = operation.value
+		}
+	}
+	b.operations = nil
+	return nil
+}
+
+func (b *memoryBatch) Close() {
+	b.operations = nil
+}
+
+type memorySnapshot struct {
+	data map[string][]byte
+}
+
+func (s *memorySnapshot) Get(key []byte) ([]byte, error) {
+	return copyBytes(s.data[string(key)]), nil
+}
+
+func (s *memorySnapshot) Has(key []byte) (bool, error) {
+	_, ok := s.data[string(key)]
+	return ok, nil
+}
+
+func (s *memorySnapshot) Iterator(start, end []byte) (Iterator, error) {
+	return newMemoryIterator(s.data, start, end, false), nil
+}
+
+func (s *memorySnapshot) ReverseIterator(start, end []byte) (Iterator, error) {
+	return newMemoryIterator(s.data, start, end, true), nil
+}
+
+func (s *memorySnapshot) Release() {
+	s.data = nil
+}
+
+type memoryIterator struct {
+	keys []string
+	values [][]byte
+	position int
+}
+
+func newMemoryIterator(data map[string][]byte, start, end []byte, reverse bool) *memoryIterator {
+	it := &memoryIterator{}
+	for k := range data {
+		if inRange([]byte(k), start, end) {
+			it.keys = append(it.keys, k)
+		}
+	}
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(it.keys)))
+	} else {
+		sort.Strings(it.keys)
+	}
+	for _, k := range it.keys {
+		it.values = append(it.values, data[k])
+	}
+	return it
+}
+
+func (it *memoryIterator) Valid() bool {
+	return it.position < len(it.keys)
+}
+
+func (it *memoryIterator) Next() {
+	it.position++
+}
+
+func (it *memoryIterator) Key() []byte {
+	return []byte(it.keys[it.position])
+}
+
+func (it *memoryIterator) Value() []byte {
+	return copyBytes(it.values[it.position])
+}
+
+func (it *memoryIterator) Error() error {
+	return nil
+}
+
+func (it *memoryIterator) Close() {
+	it.keys = nil
+	it.values = nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,10 @@
+package database
+
+import "bft/metrics"
+
+// store is the backend which serves the operation, rocksdb or goleveldb
+var (
+	readDuration = metrics.NewHistogram("bft_db_read_duration_seconds", "Latency of database reads.", metrics.DefaultBuckets, "store")
+	writeDuration = metrics.NewHistogram("bft_db_write_duration_seconds", "Latency of database writes.", metrics.DefaultBuckets, "store", "operation")
+	prunedHeight = metrics.NewGauge("bft_db_pruned_height", "Highest height whose blocks or headers have been pruned.", "data")
+)
@@ -0,0 +1,546 @@
+package database
+
+import (
+	"bft/crypto"
+	"bft/encoding"
+	"bft/logging"
+	"bft/types"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const SchemaVersionKey = "schemaversion"
+const LegacyHeightKey = "legacyheight"
+
+// SchemaVersion is the layout of the keys and values written by this code. A change of either adds a migration
+// which upgrades the stores of the previous version.
+const SchemaVersion = 2
+
+// migration upgrades a store of version Version - 1 to Version. A step may be interrupted, it runs again on the next
+// start, so it must be safe to repeat.
+type migration struct {
+	Version uint64
+	Description string
+	Migrate func(bs *BlockStore) error
+}
+
+// migrations are in version order, stores written before versioning have version 0
+var migrations = []migration{
+	{1, "rewrite blocks of the first layout and index them by proposer and timestamp", upgradeLegacyBlocks},
+	{2, "key validator records by big endian height with proposer priorities, rewrite blocks without transactions", upgradeVersion1},
+}
+
+// legacyBlock is the layout of the blocks written before the schema was versioned. The headers had neither voting
+// powers nor validator hashes, and their ids are hashes of this layout.
+type legacyBlock struct {
+	SignedHeader legacySignedBlockHeader
+}
+
+type legacySignedBlockHeader struct {
+	Header legacyBlockHeader
+	Signature crypto.Signature
+}
+
+type legacyBlockHeader struct {
+	HeightId types.BlockHeightId
+	PreviousId types.Hash
+	Proposer legacyValidator
+	Timestamp time.Time
+	Commits []types.Vote
+}
+
+type legacyValidator struct {
+	Address string
+	PublicKey crypto.PublicKey
+}
+
+// version1Block is the layout of the blocks written by schema version 1, before blocks carried transactions
+type version1Block struct {
+	SignedHeader version1SignedBlockHeader
+}
+
+type version1SignedBlockHeader struct {
+	Header version1BlockHeader
+	Signature crypto.Signature
+}
+
+type version1BlockHeader struct {
+	HeightId types.BlockHeightId
+	PreviousId types.Hash
+	Proposer types.Validator
+	Timestamp time.Time
+	ValidatorsHash types.Hash
+	NextValidatorsHash types.Hash
+	ValidatorUpdates types.Validators
+	ParamsUpdates []types.ConsensusParamsUpdate
+	Commits []types.Vote
+}
+
+// version1ValidatorsInfo is the validator record of schema version 1. It is stored at every height under the
+// decimal height, only the heights where the set changed hold the validators.
+type version1ValidatorsInfo struct {
+	LastHeightChanged uint64
+	Validators types.Validators
+}
+
+func (h legacyBlockHeader) upgrade() types.BlockHeader {
+	return types.BlockHeader{
+		HeightId: h.HeightId,
+		PreviousId: h.PreviousId,
+		Proposer: types.Validator{Address: h.Proposer.Address, PublicKey: h.Proposer.PublicKey},
+		Timestamp: h.Timestamp,
+		Commits: h.Commits,
+	}
+}
+
+func (h version1BlockHeader) upgrade() types.BlockHeader {
+	return types.BlockHeader{
+		HeightId: h.HeightId,
+		PreviousId: h.PreviousId,
+		Proposer: h.Proposer,
+		Timestamp: h.Timestamp,
+		ValidatorsHash: h.ValidatorsHash,
+		NextValidatorsHash: h.NextValidatorsHash,
+		ValidatorUpdates: h.ValidatorUpdates,
+		ParamsUpdates: h.ParamsUpdates,
+		Commits: h.Commits,
+	}
+}
+
+// legacyId is the id of a header in the first layout, the hash of its content without the id and the commits
+func legacyId(header *types.BlockHeader) types.Hash {
+	legacy := legacyBlockHeader{
+		HeightId: types.BlockHeightId{Height: header.Height()},
+		PreviousId: header.PreviousId,
+		Proposer: legacyValidator{header.Proposer.Address, header.Proposer.PublicKey},
+		Timestamp: header.Timestamp,
+	}
+	b, err := encoding.MarshalBinary(legacy)
+	if err != nil {
+		return types.Hash{}
+	}
+	return sha256.Sum256(b)
+}
+
+// version1Id is the id of a header in the layout of version 1, which had no transactions hash
+func version1Id(header *types.BlockHeader) types.Hash {
+	version1 := version1BlockHeader{
+		HeightId: types.BlockHeightId{Height: header.Height()},
+		PreviousId: header.PreviousId,
+		Proposer: header.Proposer,
+		Timestamp: header.Timestamp,
+		ValidatorsHash: header.ValidatorsHash,
+		NextValidatorsHash: header.NextValidatorsHash,
+		ValidatorUpdates: header.ValidatorUpdates,
+		ParamsUpdates: header.ParamsUpdates,
+	}
+	b, err := encoding.MarshalBinary(version1)
+	if err != nil {
+		return types.Hash{}
+	}
+	return sha256.Sum256(b)
+}
+
+// hasLegacyId tells whether header hashes to its id in the first layout or in the one of version 1
+func hasLegacyId(header *types.BlockHeader) bool {
+	if legacyId(header).Equals(header.Id()) {
+		return true
+	}
+	return header.TransactionsHash.IsEmpty() && version1Id(header).Equals(header.Id())
+}
+
+// decodeLegacyHeader reads a header of the first layout or of version 1, or one which a migration already rewrote.
+// Either way the header has to hash to its id in the layout it was written in.
+func decodeLegacyHeader(value []byte) (*types.BlockHeader, error) {
+	header := types.BlockHeader{}
+	if err := encoding.UnmarshalBinary(value, &header); err == nil && hasLegacyId(&header) {
+		return &header, nil
+	}
+	version1 := version1BlockHeader{}
+	if err := encoding.UnmarshalBinary(value, &version1); err == nil {
+		header = version1.upgrade()
+		if version1Id(&header).Equals(header.Id()) {
+			return &header, nil
+		}
+	}
+	legacy := legacyBlockHeader{}
+	if err := encoding.UnmarshalBinary(value, &legacy); err != nil {
+		return nil, err
+	}
+	header = legacy.upgrade()
+	if !legacyId(&header).Equals(header.Id()) {
+		return nil, fmt.Errorf("header does not hash to id %s", header.Id().String())
+	}
+	return &header, nil
+}
+
+// decodeLegacyBlock reads a block of the first layout or of version 1, or one which a migration already rewrote
+func decodeLegacyBlock(value []byte) (*types.Block, error) {
+	block := types.Block{}
+	if err := encoding.UnmarshalBinary(value, &block); err == nil && hasLegacyId(block.Header()) {
+		return &block, nil
+	}
+	version1 := version1Block{}
+	if err := encoding.UnmarshalBinary(value, &version1); err == nil {
+		block = types.Block{
+			SignedHeader: types.SignedBlockHeader{
+				Header: version1.SignedHeader.Header.upgrade(),
+				Signature: version1.SignedHeader.Signature,
+			},
+		}
+		if version1Id(block.Header()).Equals(block.Id()) {
+			return &block, nil
+		}
+	}
+	legacy := legacyBlock{}
+	if err := encoding.UnmarshalBinary(value, &legacy); err != nil {
+		return nil, err
+	}
+	block = types.Block{
+		SignedHeader: types.SignedBlockHeader{
+			Header: legacy.SignedHeader.Header.upgrade(),
+			Signature: legacy.SignedHeader.Signature,
+		},
+	}
+	if !legacyId(block.Header()).Equals(block.Id()) {
+		return nil, fmt.Errorf("block does not hash to id %s", block.Id().String())
+	}
+	return &block, nil
+}
+
+// SchemaVersion is the version of the stored layout, 0 if the store has no version
+func (bs *BlockStore) SchemaVersion() (uint64, error) {
+	value, err := bs.get([]byte(SchemaVersionKey))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, nil
+	}
+	version := uint64(0)
+	if err := encoding.UnmarshalBinary(value, &version); err != nil {
+		return 0, corrupted("schema version", err)
+	}
+	return version, nil
+}
+
+// legacyHeight is the last height whose id is a hash of an earlier layout, the first one or the one of version 1. It
+// is 0 if the store was created in the current layout.
+func (bs *BlockStore) legacyHeight() (uint64, error) {
+	value, err := bs.get([]byte(LegacyHeightKey))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, nil
+	}
+	height := uint64(0)
+	if err := encoding.UnmarshalBinary(value, &height); err != nil {
+		return 0, corrupted("legacy height", err)
+	}
+	return height, nil
+}
+
+func (bs *BlockStore) saveLegacyHeight(batch Batch, height uint64) error {
+	value, err := encoding.MarshalBinary(height)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(LegacyHeightKey), value)
+	return nil
+}
+
+// isLegacy tells whether the store holds blocks of an earlier layout, rewritten or not
+func (bs *BlockStore) isLegacy() (bool, error) {
+	version, err := bs.SchemaVersion()
+	if err != nil {
+		return false, err
+	}
+	legacyHeight, err := bs.legacyHeight()
+	if err != nil {
+		return false, err
+	}
+	return version < SchemaVersion || legacyHeight > 0, nil
+}
+
+// legacyHeader reads the header of a height up to the legacy height
+func (bs *BlockStore) legacyHeader(height uint64) (*types.BlockHeader, error) {
+	value, err := bs.get(keyFromHeight(height))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("block height %v: %w", height, ErrNotFound)
+	}
+	header, err := decodeLegacyHeader(value)
+	if err != nil {
+		return nil, corrupted(fmt.Sprintf("block height %v", height), err)
+	}
+	if header.Height() != height {
+		return nil, corrupted(fmt.Sprintf("block height %v", height), fmt.Errorf("header of height %d is stored", header.Height()))
+	}
+	return header, nil
+}
+
+// readHeader reads the header of height in the layout which its height was written in
+func (bs *BlockStore) readHeader(height uint64, legacyHeight uint64) (*types.BlockHeader, error) {
+	if height <= legacyHeight {
+		return bs.legacyHeader(height)
+	}
+	return bs.GetBlockHeader(height)
+}
+
+// migrate runs the migrations the store has not seen yet, an empty store gets the current version
+func (bs *BlockStore) migrate() error {
+	version, err := bs.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("database schema version %d is newer than version %d of this node", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil
+	}
+	lastHeight, err := bs.storedLastHeight()
+	if err != nil {
+		return err
+	}
+	if version == 0 && lastHeight == 0 {
+		return bs.saveSchemaVersion(SchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		bs.logger.Info("migrate database", logging.F("version", m.Version), logging.F("migration", m.Description))
+		if err := m.Migrate(bs); err != nil {
+			return fmt.Errorf("migration to schema version %d: %v", m.Version, err)
+		}
+		if err := bs.saveSchemaVersion(m.Version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BlockStore) saveSchemaVersion(version uint64) error {
+	value, err := encoding.MarshalBinary(version)
+	if err != nil {
+		return err
+	}
+	return bs.db.Put([]byte(SchemaVersionKey), value)
+}
+
+// upgradeLegacyBlocks rewrites the headers and blocks of the earlier layouts in the current one and indexes them.
+// The ids stay hashes of the layout they were written in, the legacy height records up to which height. A block
+// which can not be read is skipped and the migration fails once the others are rewritten, so the version is not
+// recorded before verify-db has truncated the store. Pruned heights are skipped.
+func upgradeLegacyBlocks(bs *BlockStore) error {
+	legacyHeight, err := bs.legacyHeight()
+	if err != nil {
+		return err
+	}
+	lastHeight, err := bs.storedLastHeight()
+	if err != nil {
+		return err
+	}
+	if legacyHeight < lastHeight {
+		batch := bs.db.NewBatch()
+		err = bs.saveLegacyHeight(batch, lastHeight)
+		if err == nil {
+			err = batch.Write()
+		}
+		batch.Close()
+		if err != nil {
+			return err
+		}
+		legacyHeight = lastHeight
+	}
+	info, err := bs.getPrunedInfo()
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	for start := uint64(1); start <= legacyHeight; start += types.MigrationBatchSize {
+		batch := bs.db.NewBatch()
+		for height := start; height < start + types.MigrationBatchSize && height <= legacyHeight; height++ {
+			if height > 1 && height < info.HeaderBase {
+				// the pruned headers are gone
+				continue
+			}
+			if err := bs.upgradeLegacyBlock(batch, height); err != nil {
+				if !errors.Is(err, ErrCorrupted) && !errors.Is(err, ErrNotFound) {
+					batch.Close()
+					return err
+				}
+				bs.logger.Warn("can not migrate block", logging.Height(height), logging.Err(err))
+				skipped++
+			}
+		}
+		err := batch.Write()
+		batch.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		return fmt.Errorf("%d blocks could not be migrated, verify-db can truncate the store below them", skipped)
+	}
+	return nil
+}
+
+func (bs *BlockStore) upgradeLegacyBlock(batch Batch, height uint64) error {
+	header, err := bs.legacyHeader(height)
+	if err != nil {
+		return err
+	}
+	value, err := bs.get(keyFromId(header.Id()))
+	if err != nil {
+		return err
+	}
+	// a missing block is left to verify-db
+	if value != nil {
+		block, err := decodeLegacyBlock(value)
+		if err != nil {
+			return corrupted(fmt.Sprintf("block %s", header.HeightId.String()), err)
+		}
+		blockData, err := encoding.MarshalBinary(*block)
+		if err != nil {
+			return err
+		}
+		batch.Put(keyFromId(header.Id()), blockData)
+		putTransactionIndexes(batch, block)
+	}
+	headerData, err := encoding.MarshalBinary(header)
+	if err != nil {
+		return err
+	}
+	batch.Put(keyFromHeight(height), headerData)
+	putIndexes(batch, header)
+	return nil
+}
+
+// upgradeVersion1 replaces the validator records of version 1, then rewrites the blocks of version 1 like the ones of
+// the first layout
+func upgradeVersion1(bs *BlockStore) error {
+	if err := bs.upgradeValidatorRecords(); err != nil {
+		return err
+	}
+	return upgradeLegacyBlocks(bs)
+}
+
+// upgradeValidatorRecords writes the records of the current layout for the version 1 records, then deletes those. A
+// store which has records of both layouts was interrupted while deleting, the current records are kept.
+func (bs *BlockStore) upgradeValidatorRecords() error {
+	prefix := []byte(ValidatorsKeyPrefix)
+	it, err := bs.db.Iterator(prefix, prefixEnd(prefix))
+	if err != nil {
+		return err
+	}
+	values := make(map[uint64][]byte)
+	upgraded := false
+	for ; it.Valid(); it.Next() {
+		height, ok := version1ValidatorsHeight(it.Key())
+		if !ok {
+			upgraded = true
+			continue
+		}
+		values[height] = copyBytes(it.Value())
+	}
+	err = it.Error()
+	it.Close()
+	if err != nil || len(values) == 0 {
+		return err
+	}
+	heights := make([]uint64, 0, len(values))
+	for height := range values {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool {
+		return heights[i] < heights[j]
+	})
+	if !upgraded {
+		if err := bs.saveUpgradedValidators(values, heights[len(heights) - 1]); err != nil {
+			return err
+		}
+	}
+	for start := 0; start < len(heights); start += types.MigrationBatchSize {
+		batch := bs.db.NewBatch()
+		for i := start; i < start + types.MigrationBatchSize && i < len(heights); i++ {
+			batch.Delete(keyFromVersion1ValidatorsHeight(heights[i]))
+		}
+		err := batch.Write()
+		batch.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveUpgradedValidators stores a record wherever the set changed and at the checkpoints, with the priorities which
+// the rotation gives from height 1 on. This is what the blocks up to maxHeight - ValidatorUpdateDelay would have
+// recorded in the current layout.
+func (bs *BlockStore) saveUpgradedValidators(values map[uint64][]byte, maxHeight uint64) error {
+	decode := func(height uint64) (*version1ValidatorsInfo, error) {
+		value, ok := values[height]
+		if !ok {
+			return nil, corrupted(fmt.Sprintf("validators of height %v", height), fmt.Errorf("record is missing"))
+		}
+		info := version1ValidatorsInfo{}
+		if err := encoding.UnmarshalBinary(value, &info); err != nil {
+			return nil, corrupted(fmt.Sprintf("validators of height %v", height), err)
+		}
+		return &info, nil
+	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	var vs *types.ValidatorSet
+	var changed *version1ValidatorsInfo
+	changedHeight := uint64(0)
+	recordHeight := uint64(0)
+	for height := uint64(1); height <= maxHeight; height++ {
+		info, err := decode(height)
+		if err != nil {
+			return err
+		}
+		if info.LastHeightChanged == height {
+			changed, changedHeight = info, height
+		}
+		if changed == nil || info.LastHeightChanged != changedHeight {
+			return corrupted(fmt.Sprintf("validators of height %v", height), fmt.Errorf("changed at height %d", info.LastHeightChanged))
+		}
+		if height == 1 {
+			vs = types.NewValidatorSet(changed.Validators, "")
+		} else {
+			vs = vs.NextHeight(changed.Validators)
+		}
+		if info.LastHeightChanged == height || height - recordHeight >= types.ValidatorSetCheckpoint {
+			if err := bs.saveValidatorsRecord(batch, height, validatorsRecord{vs.GetValidators(), vs.Priorities()}); err != nil {
+				return err
+			}
+			recordHeight = height
+		}
+	}
+	return batch.Write()
+}
+
+// version1ValidatorsHeight parses the key of a version 1 record, which ends with the decimal height. The keys of the
+// current records end with the big endian height, which starts with a zero byte below 2^56.
+func version1ValidatorsHeight(key []byte) (uint64, bool) {
+	suffix := key[len(ValidatorsKeyPrefix):]
+	if len(suffix) == 0 || suffix[0] < '1' || suffix[0] > '9' {
+		return 0, false
+	}
+	height, err := strconv.ParseUint(string(suffix), 10, 64)
+	return height, err == nil
+}
+
+func keyFromVersion1ValidatorsHeight(height uint64) []byte {
+	return []byte(ValidatorsKeyPrefix + strconv.FormatUint(height, 10))
+}
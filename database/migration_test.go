@@ -0,0 +1,223 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// schemaFixture is a store dumped as hex encoded keys and values with the genesis of its chain
+type schemaFixture struct {
+	Genesis *types.Genesis
+	Entries map[string]string
+}
+
+func loadFixture(t *testing.T, fileName string) (*MemoryStore, *types.Genesis) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := schemaFixture{Genesis: &types.Genesis{ConsensusParams: types.DefaultConsensusParams()}}
+	if err := json.Unmarshal(b, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	for k, v := range fixture.Entries {
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := hex.DecodeString(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Put(key, value)
+	}
+	return store, fixture.Genesis
+}
+
+func TestOpenForCheckRefusesUnmigratedStore(t *testing.T) {
+	store, genesis := loadFixture(t, "testdata/schema_v0.json")
+	if _, err := OpenForCheck(store, genesis); err == nil {
+		t.Fatal("a store of the first layout should be migrated before it is checked")
+	}
+	if has, _ := store.Has([]byte(SchemaVersionKey)); has {
+		t.Fatal("a refused store should not be written")
+	}
+	if _, err := NewBlockStore(store, genesis); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := OpenForCheck(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := bs.Check(); err != nil || !report.OK() {
+		t.Fatalf("the migrated store should pass the check, got %+v %v", report, err)
+	}
+}
+
+// testdata/schema_v0.json is a chain of 5 signed blocks written by the code before the schema was versioned. Its
+// genesis block has the genesis time and proposer of that code, the genesis lists that proposer as a validator.
+func TestMigrateFixture(t *testing.T) {
+	store, genesis := loadFixture(t, "testdata/schema_v0.json")
+	if has, _ := store.Has([]byte(SchemaVersionKey)); has {
+		t.Fatal("the fixture should have no schema version")
+	}
+	bs, err := NewBlockStore(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := bs.SchemaVersion(); err != nil || version != SchemaVersion {
+		t.Fatalf("expected schema version %d, got %d %v", SchemaVersion, version, err)
+	}
+	head, err := bs.Head()
+	if err != nil || head.Height() != 5 {
+		t.Fatalf("head should be at height 5, got %v", err)
+	}
+	// the blocks keep their ids, which are hashes of the first layout
+	if legacyId(head.Header()) != head.Id() || head.Header().VerifyId(encoding.MarshalBinary) {
+		t.Fatal("the head should keep the id of the first layout")
+	}
+	for _, q := range []BlockQuery{{Proposer: head.Header().Proposer.Address, Start: 2}, {From: genesis.Time.Add(time.Second)}} {
+		page, err := bs.QueryBlocks(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Blocks) != 4 {
+			t.Fatalf("query %+v: blocks 2 to 5 should be indexed, got %d blocks", q, len(page.Blocks))
+		}
+	}
+	if report, err := bs.Check(); err != nil || !report.OK() || report.ConsistentHeight != 5 {
+		t.Fatalf("migrated store should pass the checks: %+v %v", report, err)
+	}
+	// reopening does not run the migrations again
+	if _, err := NewBlockStore(store, genesis); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testdata/schema_v1.json is a chain of 6 blocks written by schema version 1. Block 3 adds a second validator from
+// height 5 on, block 4 lowers the max transactions from height 6 on.
+func TestMigrateVersion1Fixture(t *testing.T) {
+	store, genesis := loadFixture(t, "testdata/schema_v1.json")
+	if _, err := OpenForCheck(store, genesis); err == nil {
+		t.Fatal("a store of version 1 should be migrated before it is checked")
+	}
+	bs, err := NewBlockStore(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := bs.SchemaVersion(); err != nil || version != SchemaVersion {
+		t.Fatalf("expected schema version %d, got %d %v", SchemaVersion, version, err)
+	}
+	head, err := bs.Head()
+	if err != nil || head.Height() != 6 {
+		t.Fatalf("head should be at height 6, got %v", err)
+	}
+	if version1Id(head.Header()) != head.Id() || head.Header().VerifyId(encoding.MarshalBinary) {
+		t.Fatal("the head should keep the id of version 1")
+	}
+	for height, size := range map[uint64]int{1: 1, 4: 1, 5: 2, 8: 2} {
+		validators, err := bs.GetValidators(height)
+		if err != nil || len(validators) != size {
+			t.Fatalf("height %d should have %d validators, got %v %v", height, size, validators, err)
+		}
+	}
+	// the priorities continue the rotation of the current rules from height 1
+	vs := types.NewValidatorSet(genesis.Validators, "")
+	for height := uint64(2); height <= 8; height++ {
+		validators, _ := bs.GetValidators(height)
+		vs = vs.NextHeight(validators)
+	}
+	stored, err := bs.GetValidatorSet(8, "")
+	if err != nil || fmt.Sprint(stored.Priorities()) != fmt.Sprint(vs.Priorities()) {
+		t.Fatalf("expected priorities %v, got %v", vs.Priorities(), err)
+	}
+	if has, _ := store.Has(keyFromVersion1ValidatorsHeight(3)); has {
+		t.Fatal("the records of version 1 should be deleted")
+	}
+	for height, max := range map[uint64]uint64{5: types.MaxBlockTransactions, 6: 50} {
+		params, err := bs.GetConsensusParams(height)
+		if err != nil || params.MaxTransactions != max {
+			t.Fatalf("height %d should allow %d transactions, got %d %v", height, max, params.MaxTransactions, err)
+		}
+	}
+	if report, err := bs.Check(); err != nil || !report.OK() || report.ConsistentHeight != 6 {
+		t.Fatalf("migrated store should pass the checks: %+v %v", report, err)
+	}
+	checked, err := OpenForCheck(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := checked.Check(); err != nil || !report.OK() {
+		t.Fatalf("the migrated store should pass the check, got %+v %v", report, err)
+	}
+	// a migration interrupted while deleting the records of version 1 keeps the new records
+	value, _ := encoding.MarshalBinary(version1ValidatorsInfo{LastHeightChanged: 1})
+	store.Put(keyFromVersion1ValidatorsHeight(6), value)
+	version, _ := encoding.MarshalBinary(uint64(1))
+	store.Put([]byte(SchemaVersionKey), version)
+	if bs, err = NewBlockStore(store, genesis); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := store.Has(keyFromVersion1ValidatorsHeight(6)); has {
+		t.Fatal("the records of version 1 should be deleted")
+	}
+	if validators, err := bs.GetValidators(6); err != nil || len(validators) != 2 {
+		t.Fatalf("the new records should be kept, got %v %v", validators, err)
+	}
+}
+
+func TestMigrateFixtureOfAnotherChain(t *testing.T) {
+	store, genesis := loadFixture(t, "testdata/schema_v0.json")
+	genesis.Time = genesis.Time.Add(time.Second)
+	if _, err := NewBlockStore(store, genesis); err == nil {
+		t.Fatal("the chain of another genesis should be rejected")
+	}
+	if has, _ := store.Has([]byte(LegacyHeightKey)); has {
+		t.Fatal("the store of another chain should not be migrated")
+	}
+}
+
+func TestMigrationWithCorruptedHeader(t *testing.T) {
+	store, genesis := loadFixture(t, "testdata/schema_v0.json")
+	key := keyFromHeight(3)
+	value, _ := store.Get(key)
+	store.Put(key, value[:len(value) / 2])
+	if _, err := NewBlockStore(store, genesis); err == nil {
+		t.Fatal("the migration should fail on a corrupted header")
+	}
+	if has, _ := store.Has([]byte(SchemaVersionKey)); has {
+		t.Fatal("the version should not be recorded while a block is not migrated")
+	}
+	// the other blocks are rewritten, the next start continues once the header is repaired
+	store.Put(key, value)
+	bs, err := NewBlockStore(store, genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := bs.Check(); err != nil || !report.OK() || report.ConsistentHeight != 5 {
+		t.Fatalf("migrated store should pass the checks: %+v %v", report, err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	store := NewMemoryStore()
+	bs, err := NewBlockStore(store, testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := bs.SchemaVersion(); err != nil || version != SchemaVersion {
+		t.Fatalf("a new store should have schema version %d, got %d %v", SchemaVersion, version, err)
+	}
+	value, _ := encoding.MarshalBinary(uint64(SchemaVersion + 1))
+	store.Put([]byte(SchemaVersionKey), value)
+	if _, err := NewBlockStore(store, testGenesis()); err == nil {
+		t.Fatal("a store of a newer schema version should be rejected")
+	}
+}
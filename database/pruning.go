@@ -0,0 +1,324 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/logging"
+	"bft/types"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const PrunedKey = "pruned"
+
+// HeightRange is the heights in [From, To], the zero value is empty
+type HeightRange struct {
+	From uint64
+	To uint64
+}
+
+func (r HeightRange) Empty() bool {
+	return r.To == 0 || r.To < r.From
+}
+
+func (r HeightRange) String() string {
+	if r.Empty() {
+		return "none"
+	}
+	return fmt.Sprintf("%d-%d", r.From, r.To)
+}
+
+// prunedInfo holds the first kept height of the bodies and of the headers, 0 if nothing is pruned. The genesis block
+// at height 1 is never pruned.
+type prunedInfo struct {
+	BlockBase uint64
+	HeaderBase uint64
+}
+
+// Pruned returns the heights whose bodies and whose headers have been pruned
+func (bs *BlockStore) Pruned() (blocks HeightRange, headers HeightRange, err error) {
+	info, err := bs.getPrunedInfo()
+	if err != nil {
+		return HeightRange{}, HeightRange{}, err
+	}
+	if info.BlockBase > 2 {
+		blocks = HeightRange{2, info.BlockBase - 1}
+	}
+	if info.HeaderBase > 2 {
+		headers = HeightRange{2, info.HeaderBase - 1}
+	}
+	return blocks, headers, nil
+}
+
+// PruneBlocks deletes the bodies below retainHeight, the headers with their commits are kept. The genesis block and
+// the head are never pruned. It returns the heights pruned by this call.
+func (bs *BlockStore) PruneBlocks(retainHeight uint64) (HeightRange, error) {
+	return bs.prune(retainHeight, false)
+}
+
+// PruneHeaders deletes the headers, their index keys and the bodies below retainHeight. The validators of the heights
+// are kept.
+func (bs *BlockStore) PruneHeaders(retainHeight uint64) (HeightRange, error) {
+	return bs.prune(retainHeight, true)
+}
+
+// prune deletes types.PruneBatchSize heights per batch, every batch moves the pruned bases on so an interrupted
+// pruning resumes where it stopped
+func (bs *BlockStore) prune(retainHeight uint64, headers bool) (HeightRange, error) {
+	bs.pruneMutex.Lock()
+	defer bs.pruneMutex.Unlock()
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return HeightRange{}, err
+	}
+	if retainHeight > lastHeight {
+		retainHeight = lastHeight
+	}
+	info, err := bs.getPrunedInfo()
+	if err != nil {
+		return HeightRange{}, err
+	}
+	from := info.BlockBase
+	if headers {
+		from = info.HeaderBase
+	}
+	if from < 2 {
+		from = 2
+	}
+	if retainHeight <= from {
+		return HeightRange{}, nil
+	}
+	for start := from; start < retainHeight; start += types.PruneBatchSize {
+		end := start + types.PruneBatchSize
+		if end > retainHeight {
+			end = retainHeight
+		}
+		if err := bs.pruneBatch(start, end, headers, info); err != nil {
+			return HeightRange{}, err
+		}
+	}
+	return HeightRange{from, retainHeight - 1}, nil
+}
+
+// pruneBatch prunes the heights in [start, end) and updates info
+func (bs *BlockStore) pruneBatch(start, end uint64, headers bool, info *prunedInfo) error {
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	for height := start; height < end; height++ {
+		header, err := bs.GetBlockHeader(height)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// a body which does not decode is pruned with the keys of its transactions left, lookups skip them
+		if err := bs.deleteTransactionIndexes(batch, header, 0); err != nil {
+			if !errors.Is(err, ErrCorrupted) {
+				return err
+			}
+			bs.logger.Warn("can not delete transaction index", logging.Height(height), logging.Err(err))
+		}
+		batch.Delete(keyFromId(header.Id()))
+		if headers {
+			batch.Delete(keyFromHeight(height))
+			deleteIndexes(batch, header)
+		}
+	}
+	next := *info
+	if next.BlockBase < end {
+		next.BlockBase = end
+	}
+	if headers {
+		next.HeaderBase = end
+	}
+	value, err := encoding.MarshalBinary(next)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(PrunedKey), value)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	*info = next
+	prunedHeight.Set(float64(info.BlockBase - 1), "blocks")
+	if info.HeaderBase > 0 {
+		prunedHeight.Set(float64(info.HeaderBase - 1), "headers")
+	}
+	return nil
+}
+
+func (bs *BlockStore) getPrunedInfo() (*prunedInfo, error) {
+	value, err := bs.get([]byte(PrunedKey))
+	if err != nil {
+		return nil, err
+	}
+	info := prunedInfo{}
+	if value == nil {
+		return &info, nil
+	}
+	if err := encoding.UnmarshalBinary(value, &info); err != nil {
+		return nil, corrupted("pruned heights", err)
+	}
+	return &info, nil
+}
+
+// firstHeightSince looks up the first block with a timestamp at or after t in the time index, ok is false if every
+// block is older
+func (bs *BlockStore) firstHeightSince(t time.Time) (height uint64, ok bool, err error) {
+	prefix := []byte(TimeIndexPrefix)
+	it, err := bs.db.Iterator(appendTime(prefix, t), prefixEnd(prefix))
+	if err != nil {
+		return 0, false, err
+	}
+	defer it.Close()
+	if !it.Valid() {
+		return 0, false, it.Error()
+	}
+	key := it.Key()
+	if len(key) < 8 {
+		return 0, false, corrupted("block index", fmt.Errorf("key %x is too short", key))
+	}
+	return binary.BigEndian.Uint64(key[len(key) - 8:]), true, nil
+}
+
+// RetentionPolicy tells which blocks a node keeps. Bodies are kept for the last KeepBlocks blocks and for the blocks
+// of the last KeepTime, a block is kept if either keeps it, and nothing is pruned if both are 0. Headers with their
+// commits are kept for the last KeepHeaders blocks, and at least as long as the bodies, 0 keeps them all.
+type RetentionPolicy struct {
+	KeepBlocks uint64
+	KeepTime time.Duration
+	KeepHeaders uint64
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.KeepBlocks > 0 || p.KeepTime > 0
+}
+
+// retainHeights returns the first heights whose bodies and headers are kept, 0 keeps everything
+func (p RetentionPolicy) retainHeights(bs *BlockStore, now time.Time) (blocks uint64, headers uint64, err error) {
+	if !p.Enabled() {
+		return 0, 0, nil
+	}
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	blocks = lastHeight
+	if p.KeepBlocks > 0 {
+		blocks = keepLast(lastHeight, p.KeepBlocks)
+	}
+	if p.KeepTime > 0 {
+		height, ok, err := bs.firstHeightSince(now.Add(-p.KeepTime))
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok && height < blocks {
+			blocks = height
+		}
+	}
+	if p.KeepHeaders > 0 {
+		headers = keepLast(lastHeight, p.KeepHeaders)
+		if headers > blocks {
+			headers = blocks
+		}
+	}
+	return blocks, headers, nil
+}
+
+// keepLast is the first of the last n heights
+func keepLast(lastHeight, n uint64) uint64 {
+	if lastHeight <= n {
+		return 1
+	}
+	return lastHeight - n + 1
+}
+
+// Pruner applies a retention policy to a block store in the background, every types.PruneInterval
+type Pruner struct {
+	blockStore *BlockStore
+	policy RetentionPolicy
+	now func() time.Time
+	stop chan struct{}
+	done chan struct{}
+	logger logging.Logger
+}
+
+func NewPruner(blockStore *BlockStore, policy RetentionPolicy) *Pruner {
+	return &Pruner{
+		blockStore: blockStore,
+		policy: policy,
+		now: time.Now,
+		logger: logging.Default().With(logging.Module("database")),
+	}
+}
+
+func (p *Pruner) SetLogger(logger logging.Logger) {
+	p.logger = logger
+}
+
+// Start runs the pruning in the background, it does nothing if the policy keeps every block
+func (p *Pruner) Start() {
+	if !p.policy.Enabled() || p.stop != nil {
+		return
+	}
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	go p.run()
+}
+
+// Stop waits for a running pruning to finish
+func (p *Pruner) Stop() {
+	if p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.stop = nil
+}
+
+func (p *Pruner) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(types.PruneInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		if err := p.Prune(); err != nil {
+			p.logger.Error("can not prune blocks", logging.Err(err))
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes what the policy does not keep and compacts the store if anything was deleted
+func (p *Pruner) Prune() error {
+	blockRetain, headerRetain, err := p.policy.retainHeights(p.blockStore, p.now())
+	if err != nil {
+		return err
+	}
+	blocks, err := p.blockStore.PruneBlocks(blockRetain)
+	if err != nil {
+		return err
+	}
+	headers := HeightRange{}
+	if headerRetain > 0 {
+		headers, err = p.blockStore.PruneHeaders(headerRetain)
+		if err != nil {
+			return err
+		}
+	}
+	if blocks.Empty() && headers.Empty() {
+		return nil
+	}
+	p.logger.Info("pruned blocks", logging.F("blocks", blocks.String()), logging.F("headers", headers.String()))
+	start := time.Now()
+	if err := p.blockStore.db.Compact(nil, nil); err != nil {
+		return err
+	}
+	p.logger.Debug("compacted database", logging.F("duration", time.Since(start)))
+	return nil
+}
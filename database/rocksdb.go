@@ -1,53 +1,73 @@
+// +build rocksdb
+
 package database
 
 import (
 	"github.com/tecbot/gorocksdb"
 	"sync"
-	"log"
 	"fmt"
+	"time"
 )
 
-const DBPath  = "db2"
-
 type RocksDB struct {
 	db *gorocksdb.DB
 	cfHandlers map[string]*gorocksdb.ColumnFamilyHandle
-	rwMutex sync.RWMutex
+	snapshots map[*gorocksdb.Snapshot]bool // snapshots which are not released yet
+	iterators map[*CFIterator]bool // iterators which are not closed yet
+	rwMutex sync.RWMutex // every use of db holds it, Close takes it for writing
+	sync bool
 }
 
-var db = NewRocksDB(DBPath)
-
-func NewRocksDB(path string) *RocksDB {
+func NewRocksDB(path string) (*RocksDB, error) {
 	rocksDB := &RocksDB{
 		cfHandlers: make(map[string]*gorocksdb.ColumnFamilyHandle, 0),
+		snapshots: make(map[*gorocksdb.Snapshot]bool, 0),
+		iterators: make(map[*CFIterator]bool, 0),
 	}
-	err := rocksDB.open(path)
-	if err != nil {
-		log.Fatal(err)
+	if err := rocksDB.open(path); err != nil {
+		return nil, err
 	}
-	return rocksDB
+	return rocksDB, nil
 }
 
-func GetDB() *RocksDB {
-	return db
+// SetSync makes every write wait until it is flushed to disk
+func (r *RocksDB) SetSync(sync bool) {
+	r.sync = sync
 }
 
+// Close closes the iterators and releases the snapshots which are still open, their later Close or Release does
+// nothing. It waits for the operations which are running.
 func (r *RocksDB) Close() {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	if r.db == nil {
+		return
+	}
+	for it, _ := range r.iterators {
+		it.close()
+	}
+	for snapshot, _ := range r.snapshots {
+		r.db.ReleaseSnapshot(snapshot)
+		delete(r.snapshots, snapshot)
+	}
 	for _, chf := range r.cfHandlers {
 		chf.Destroy()
 	}
 	r.db.Close()
-	r.rwMutex.Lock()
 	r.db = nil
 	for cfName, _ := range r.cfHandlers {
 		delete(r.cfHandlers, cfName)
 	}
-	r.rwMutex.Unlock()
 }
 
 func (r *RocksDB) AddCF(cfName string) error {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
 	if r.db == nil {
-		fmt.Errorf("database should be created first\n")
+		return ErrClosed
+	}
+	if _, ok := r.cfHandlers[cfName]; ok {
+		return fmt.Errorf("column family %s is existing\n", cfName)
 	}
 	opts := gorocksdb.NewDefaultOptions()
 	defer  opts.Destroy()
@@ -57,20 +77,17 @@ func (r *RocksDB) AddCF(cfName string) error {
 	if err != nil {
 		return err
 	}
-	r.rwMutex.Lock()
-	defer r.rwMutex.Unlock()
-	if _, ok := r.cfHandlers[cfName]; ok {
-		return fmt.Errorf("column family %s is existing\n", cfName)
-	}
 	r.cfHandlers[cfName] = cfh
 	return nil
 }
 
 func (r *RocksDB) RemoveCF(cfName string) error {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
 	if r.db == nil {
-		return fmt.Errorf("database should be created first")
+		return ErrClosed
 	}
-	cfHandler := r.columnFamilyHandle(cfName)
+	cfHandler := r.cfHandlers[cfName]
 	if cfHandler == nil {
 		return fmt.Errorf("column family %s does not exist\n", cfName)
 	}
@@ -78,103 +95,312 @@ func (r *RocksDB) RemoveCF(cfName string) error {
 	if err != nil {
 		return err
 	}
-	r.rwMutex.Lock()
-	defer r.rwMutex.Unlock()
 	delete(r.cfHandlers, cfName)
 	return nil
 }
 
-func (r *RocksDB) Get(cfName string, key []byte) []byte {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
+func (r *RocksDB) Get(cfName string, key []byte) ([]byte, error) {
+	return r.get(cfName, nil, key)
+}
+
+func (r *RocksDB) Put(cfName string, key, value []byte) error {
+	return r.put(cfName, key, value, r.sync)
+}
+
+// PutSync waits until the write is flushed to disk, whatever SetSync set
+func (r *RocksDB) PutSync(cfName string, key, value []byte) error {
+	return r.put(cfName, key, value, true)
+}
+
+func (r *RocksDB) put(cfName string, key, value []byte, sync bool) error {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
+	cfHandler, err := r.columnFamily(cfName)
+	if err != nil {
+		return err
+	}
+	writeOpt := gorocksdb.NewDefaultWriteOptions()
+	writeOpt.SetSync(sync)
+	defer writeOpt.Destroy()
+	defer writeDuration.ObserveSince(time.Now(), RocksDBBackend, "put")
+	return r.db.PutCF(writeOpt, cfHandler, key, value)
+}
+
+func (r *RocksDB) Delete(cfName string, key []byte) error {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
+	cfHandler, err := r.columnFamily(cfName)
+	if err != nil {
+		return err
+	}
+	writeOpt := r.writeOptions()
+	defer writeOpt.Destroy()
+	defer writeDuration.ObserveSince(time.Now(), RocksDBBackend, "delete")
+	return r.db.DeleteCF(writeOpt, cfHandler, key)
+}
+
+func (r *RocksDB) Has(cfName string, key []byte) (bool, error) {
+	value, err := r.Get(cfName, key)
+	return value != nil, err
+}
+
+// GetFromSnapshot reads key as it was when snapshot was taken
+func (r *RocksDB) GetFromSnapshot(cfName string, snapshot *gorocksdb.Snapshot, key []byte) ([]byte, error) {
+	return r.get(cfName, snapshot, key)
+}
+
+// get reads from snapshot, or the latest data if snapshot is nil
+func (r *RocksDB) get(cfName string, snapshot *gorocksdb.Snapshot, key []byte) ([]byte, error) {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
+	cfHandler, err := r.columnFamily(cfName)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkSnapshot(snapshot); err != nil {
+		return nil, err
 	}
 	readOpt := gorocksdb.NewDefaultReadOptions()
 	defer readOpt.Destroy()
+	if snapshot != nil {
+		readOpt.SetSnapshot(snapshot)
+	}
+	defer readDuration.ObserveSince(time.Now(), RocksDBBackend)
 	result, err := r.db.GetCF(readOpt, cfHandler, key)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer result.Free()
 	if result.Data() == nil {
-		return nil
+		return nil, nil
 	}
 	data := make([]byte, result.Size())
 	copy(data, result.Data())
-	return data
+	return data, nil
 }
 
-func (r *RocksDB) Put(cfName string, key, value []byte) {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
-	}
-	writeOpt := gorocksdb.NewDefaultWriteOptions()
-	defer writeOpt.Destroy()
-	err := r.db.PutCF(writeOpt, cfHandler, key, value)
-	if err != nil {
-		log.Fatal(err)
+// CFIterator owns the read options of a gorocksdb iterator, they have to outlive it. Its methods hold the read lock
+// of the database, an iterator which the database closed is not valid.
+type CFIterator struct {
+	db *RocksDB
+	iterator *gorocksdb.Iterator
+	readOpt *gorocksdb.ReadOptions
+}
+
+func (it *CFIterator) Valid() bool {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	return it.iterator != nil && it.iterator.Valid()
+}
+
+func (it *CFIterator) SeekToFirst() {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator != nil {
+		it.iterator.SeekToFirst()
 	}
 }
 
-func (r *RocksDB) Delete(cfName string, key []byte) {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
+func (it *CFIterator) SeekToLast() {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator != nil {
+		it.iterator.SeekToLast()
 	}
-	writeOpt := gorocksdb.NewDefaultWriteOptions()
-	defer writeOpt.Destroy()
-	err := r.db.DeleteCF(writeOpt, cfHandler, key)
-	if err != nil {
-		log.Fatal(err)
+}
+
+func (it *CFIterator) Seek(key []byte) {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator != nil {
+		it.iterator.Seek(key)
 	}
 }
 
-func (r *RocksDB) Has(cfName string, key []byte) bool {
-	return r.Get(cfName, key) != nil
+func (it *CFIterator) Next() {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator != nil {
+		it.iterator.Next()
+	}
 }
 
-func (r *RocksDB) GetFromSnapshot(cfName string, snapshot *gorocksdb.Snapshot, key []byte) []byte {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
+func (it *CFIterator) Prev() {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator != nil {
+		it.iterator.Prev()
 	}
-	readOpt := gorocksdb.NewDefaultReadOptions()
-	defer readOpt.Destroy()
-	readOpt.SetSnapshot(snapshot)
-	result, err := r.db.GetCF(readOpt, cfHandler, key)
-	if err != nil {
-		log.Fatal(err)
+}
+
+// Key returns a copy of the key, the data of the iterator is freed when it closes
+func (it *CFIterator) Key() []byte {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator == nil {
+		return nil
 	}
-	defer result.Free()
-	if result.Data() == nil {
+	return copySlice(it.iterator.Key())
+}
+
+// Value returns a copy of the value
+func (it *CFIterator) Value() []byte {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator == nil {
 		return nil
 	}
-	data := make([]byte, 0)
-	copy(data, result.Data())
-	return data
+	return copySlice(it.iterator.Value())
 }
 
-func (r *RocksDB) GetIterator(cfName string) *gorocksdb.Iterator {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
+// Err returns ErrClosed once the iterator is closed
+func (it *CFIterator) Err() error {
+	it.db.rwMutex.RLock()
+	defer it.db.rwMutex.RUnlock()
+	if it.iterator == nil {
+		return ErrClosed
+	}
+	return it.iterator.Err()
+}
+
+// Close closes the iterator and then frees its read options, it does nothing if the database closed it already
+func (it *CFIterator) Close() {
+	it.db.rwMutex.Lock()
+	defer it.db.rwMutex.Unlock()
+	it.close()
+}
+
+func (it *CFIterator) close() {
+	if it.iterator == nil {
+		return
+	}
+	it.iterator.Close()
+	it.readOpt.Destroy()
+	it.iterator = nil
+	delete(it.db.iterators, it)
+}
+
+func (r *RocksDB) GetIterator(cfName string) (*CFIterator, error) {
+	return r.newIterator(cfName, nil)
+}
+
+// GetSnapshotIterator walks the keys as they were when snapshot was taken
+func (r *RocksDB) GetSnapshotIterator(cfName string, snapshot *gorocksdb.Snapshot) (*CFIterator, error) {
+	return r.newIterator(cfName, snapshot)
+}
+
+func (r *RocksDB) newIterator(cfName string, snapshot *gorocksdb.Snapshot) (*CFIterator, error) {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	cfHandler, err := r.columnFamily(cfName)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkSnapshot(snapshot); err != nil {
+		return nil, err
 	}
 	readOpt := gorocksdb.NewDefaultReadOptions()
 	readOpt.SetFillCache(true)
-	defer readOpt.Destroy()
-	return r.db.NewIteratorCF(readOpt, cfHandler)
+	if snapshot != nil {
+		readOpt.SetSnapshot(snapshot)
+	}
+	it := &CFIterator{
+		db: r,
+		iterator: r.db.NewIteratorCF(readOpt, cfHandler),
+		readOpt: readOpt,
+	}
+	r.iterators[it] = true
+	return it, nil
 }
 
-func (r *RocksDB) GetSnapshotIterator(cfName string, snapshot *gorocksdb.Snapshot) *gorocksdb.Iterator {
-	cfHandler := r.columnFamilyHandle(cfName)
-	if cfHandler == nil {
-		log.Fatalf("column family %s does not exist\n", cfName)
+// WriteBatch collects writes to several column families, Write applies all of them or none
+type WriteBatch struct {
+	db *RocksDB
+	batch *gorocksdb.WriteBatch
+}
+
+func (r *RocksDB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		db: r,
+		batch: gorocksdb.NewWriteBatch(),
 	}
-	readOpt := gorocksdb.NewDefaultReadOptions()
-	defer readOpt.Destroy()
-	readOpt.SetSnapshot(snapshot)
-	return r.db.NewIteratorCF(readOpt, cfHandler)
+}
+
+func (wb *WriteBatch) Put(cfName string, key, value []byte) error {
+	wb.db.rwMutex.RLock()
+	defer wb.db.rwMutex.RUnlock()
+	cfHandler, err := wb.db.columnFamily(cfName)
+	if err != nil {
+		return err
+	}
+	wb.batch.PutCF(cfHandler, key, value)
+	return nil
+}
+
+func (wb *WriteBatch) Delete(cfName string, key []byte) error {
+	wb.db.rwMutex.RLock()
+	defer wb.db.rwMutex.RUnlock()
+	cfHandler, err := wb.db.columnFamily(cfName)
+	if err != nil {
+		return err
+	}
+	wb.batch.DeleteCF(cfHandler, key)
+	return nil
+}
+
+func (wb *WriteBatch) Count() int {
+	return wb.batch.Count()
+}
+
+func (wb *WriteBatch) Destroy() {
+	wb.batch.Destroy()
+}
+
+// Write applies the batch atomically
+func (r *RocksDB) Write(batch *WriteBatch) error {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
+	if r.db == nil {
+		return ErrClosed
+	}
+	writeOpt := r.writeOptions()
+	defer writeOpt.Destroy()
+	defer writeDuration.ObserveSince(time.Now(), RocksDBBackend, "batch")
+	return r.db.Write(writeOpt, batch.batch)
+}
+
+// Compact compacts the keys in [start, end) of a column family, a nil start or end leaves the range open
+func (r *RocksDB) Compact(cfName string, start, end []byte) error {
+	r.rwMutex.RLock()
+	defer r.rwMutex.RUnlock()
+	cfHandler, err := r.columnFamily(cfName)
+	if err != nil {
+		return err
+	}
+	r.db.CompactRangeCF(cfHandler, gorocksdb.Range{Start: start, Limit: end})
+	return nil
+}
+
+func (r *RocksDB) NewSnapshot() (*gorocksdb.Snapshot, error) {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	if r.db == nil {
+		return nil, ErrClosed
+	}
+	snapshot := r.db.NewSnapshot()
+	r.snapshots[snapshot] = true
+	return snapshot, nil
+}
+
+// ReleaseSnapshot frees snapshot, Close has released it already if the database is closed
+func (r *RocksDB) ReleaseSnapshot(snapshot *gorocksdb.Snapshot) {
+	r.rwMutex.Lock()
+	defer r.rwMutex.Unlock()
+	if r.db == nil || !r.snapshots[snapshot] {
+		return
+	}
+	delete(r.snapshots, snapshot)
+	r.db.ReleaseSnapshot(snapshot)
 }
 
 func (r *RocksDB) open(path string) error {
@@ -205,8 +431,40 @@ func (r *RocksDB) open(path string) error {
 	return nil
 }
 
+func (r *RocksDB) writeOptions() *gorocksdb.WriteOptions {
+	writeOpt := gorocksdb.NewDefaultWriteOptions()
+	writeOpt.SetSync(r.sync)
+	return writeOpt
+}
+
+// columnFamily returns the handle of cfName, or ErrClosed once the database has been closed. The caller holds
+// rwMutex until it is done with the handle.
+func (r *RocksDB) columnFamily(cfName string) (*gorocksdb.ColumnFamilyHandle, error) {
+	if r.db == nil {
+		return nil, ErrClosed
+	}
+	cfHandler, ok := r.cfHandlers[cfName]
+	if !ok {
+		return nil, fmt.Errorf("column family %s does not exist", cfName)
+	}
+	return cfHandler, nil
+}
+
+// checkSnapshot refuses a snapshot which has been released, the caller holds rwMutex
+func (r *RocksDB) checkSnapshot(snapshot *gorocksdb.Snapshot) error {
+	if snapshot != nil && !r.snapshots[snapshot] {
+		return fmt.Errorf("snapshot is released")
+	}
+	return nil
+}
+
 func (r *RocksDB) columnFamilyHandle(cfName string) *gorocksdb.ColumnFamilyHandle {
 	r.rwMutex.RLock()
 	defer r.rwMutex.RUnlock()
 	return r.cfHandlers[cfName]
 }
+
+func copySlice(slice *gorocksdb.Slice) []byte {
+	defer slice.Free()
+	return copyBytes(slice.Data())
+}
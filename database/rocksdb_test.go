@@ -1,22 +1,26 @@
+// +build rocksdb
+
 package database
 
 import (
 	"testing"
 	"github.com/tecbot/gorocksdb"
 	"os"
-	"encoding/binary"
 	"bytes"
+	"errors"
+	"sync"
+	"time"
 )
 
 var fileName = "test.db"
 
 func TestNewRocksDB(t *testing.T) {
-	rocksDB := setup()
+	rocksDB := setup(t)
 	defer rocksDB.Close()
 }
 
 func TestRocksDB_AddCF(t *testing.T) {
-	rocksDB := setup()
+	rocksDB := setup(t)
 	defer rocksDB.Close()
 	cfName := "blockchain"
 	rocksDB.RemoveCF(cfName)
@@ -43,7 +47,7 @@ func TestRocksDB_AddCF(t *testing.T) {
 }
 
 func TestRocksDB_RemoveCF(t *testing.T) {
-	rocksDB := setup()
+	rocksDB := setup(t)
 	defer rocksDB.Close()
 	cfName := "blockchain"
 	rocksDB.AddCF(cfName)
@@ -70,15 +74,20 @@ func TestRocksDB_RemoveCF(t *testing.T) {
 }
 
 func TestRocksDB_PutGet(t *testing.T) {
-	rocksDB := setup()
+	rocksDB := setup(t)
 	defer rocksDB.Close()
 	cfName := "blockchain"
 	rocksDB.AddCF(cfName)
 	for i := 1; i < 5; i++ {
-		rocksDB.Put(cfName, encode(i), encode(i))
+		if err := rocksDB.Put(cfName, encode(i), encode(i)); err != nil {
+			t.Fatal(err)
+		}
 	}
 	for i := 1; i < 5; i++ {
-		result := rocksDB.Get(cfName, encode(i))
+		result, err := rocksDB.Get(cfName, encode(i))
+		if err != nil {
+			t.Fatal(err)
+		}
 		if !bytes.Equal(result, encode(i)) {
 			t.Fatal(result)
 		}
@@ -86,31 +95,148 @@ func TestRocksDB_PutGet(t *testing.T) {
 }
 
 func TestRocksDB_Delete(t *testing.T) {
-	rocksDB := setup()
+	rocksDB := setup(t)
 	defer rocksDB.Close()
 	cfName := "blockchain"
 	rocksDB.AddCF(cfName)
 	rocksDB.Put(cfName, encode(1), encode(1))
-	if !rocksDB.Has(cfName, encode(1)) {
+	if has, _ := rocksDB.Has(cfName, encode(1)); !has {
 		t.Fatalf("%d is not inserted", 1)
 	}
 	rocksDB.Delete(cfName, encode(1))
-	if rocksDB.Has(cfName, encode(1)) {
+	if has, _ := rocksDB.Has(cfName, encode(1)); has {
 		t.Fatalf("%d is not deleted", 1)
 	}
 }
 
-func setup() *RocksDB {
-	os.RemoveAll(fileName)
-	return NewRocksDB(fileName)
+func TestRocksDB_MissingColumnFamily(t *testing.T) {
+	rocksDB := setup(t)
+	defer rocksDB.Close()
+	if _, err := rocksDB.Get("missing", encode(1)); err == nil {
+		t.Fatal("reading a missing column family should fail")
+	}
+	if err := rocksDB.Put("missing", encode(1), encode(1)); err == nil {
+		t.Fatal("writing a missing column family should fail")
+	}
+}
+
+func TestRocksDB_Closed(t *testing.T) {
+	rocksDB := setup(t)
+	cfName := "blockchain"
+	rocksDB.AddCF(cfName)
+	snapshot, err := rocksDB.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rocksDB.Put(cfName, encode(1), encode(1))
+	it, err := rocksDB.GetIterator(cfName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.SeekToFirst()
+	rocksDB.Close()
+	if len(rocksDB.snapshots) != 0 {
+		t.Fatal("close should release the open snapshots")
+	}
+	if len(rocksDB.iterators) != 0 || it.Valid() || it.Key() != nil {
+		t.Fatal("close should close the open iterators")
+	}
+	if err := it.Err(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	// the owner of the iterator closes it after the close
+	it.Close()
+	// the owner of the snapshot releases it after the close
+	rocksDB.ReleaseSnapshot(snapshot)
+	if _, err := rocksDB.NewSnapshot(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := rocksDB.Get(cfName, encode(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if err := rocksDB.Put(cfName, encode(1), encode(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRocksDB_CloseWhileUsed(t *testing.T) {
+	rocksDB := setup(t)
+	cfName := "blockchain"
+	rocksDB.AddCF(cfName)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				if err := rocksDB.Put(cfName, encode(i), encode(i)); err != nil {
+					return
+				}
+				if _, err := rocksDB.Get(cfName, encode(i)); err != nil {
+					return
+				}
+				batch := rocksDB.NewWriteBatch()
+				batch.Put(cfName, encode(i + 10), encode(i))
+				err := rocksDB.Write(batch)
+				batch.Destroy()
+				if err != nil {
+					return
+				}
+				it, err := rocksDB.GetIterator(cfName)
+				if err != nil {
+					return
+				}
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+					it.Key()
+				}
+				it.Close()
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	rocksDB.Close()
+	wg.Wait()
 }
 
-func encode(i int) []byte {
-	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, uint64(i))
-	return buf
+func setup(t *testing.T) *RocksDB {
+	os.RemoveAll(fileName)
+	rocksDB, err := NewRocksDB(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rocksDB
 }
 
-func decode(buf []byte) int {
-	return int(binary.BigEndian.Uint64(buf))
-}
\ No newline at end of file
+func TestRocksDB_Snapshot(t *testing.T) {
+	rocksDB := setup(t)
+	defer rocksDB.Close()
+	cfName := "blockchain"
+	rocksDB.AddCF(cfName)
+	rocksDB.Put(cfName, encode(1), encode(1))
+	snapshot, err := rocksDB.NewSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rocksDB.ReleaseSnapshot(snapshot)
+	rocksDB.Put(cfName, encode(1), encode(2))
+	rocksDB.Put(cfName, encode(2), encode(2))
+	value, err := rocksDB.GetFromSnapshot(cfName, snapshot, encode(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, encode(1)) {
+		t.Fatalf("snapshot should read %v, got %v", encode(1), value)
+	}
+	it, err := rocksDB.GetSnapshotIterator(cfName, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 1 {
+		t.Fatalf("snapshot iterator should see 1 key, got %d", count)
+	}
+}
@@ -0,0 +1,233 @@
+// +build rocksdb
+
+package database
+
+import "github.com/tecbot/gorocksdb"
+
+func init() {
+	openRocksDB = func(path string, options Options) (KVStore, error) {
+		store, err := NewRocksDBStore(path, BlockStoreCF, options)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+}
+
+// RocksDBStore keeps the keys in one column family of a RocksDB
+type RocksDBStore struct {
+	db *RocksDB
+	cfName string
+}
+
+// NewRocksDBStore opens the RocksDB at path and creates the column family if it is missing
+func NewRocksDBStore(path string, cfName string, options Options) (*RocksDBStore, error) {
+	db, err := NewRocksDB(path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetSync(options.Sync)
+	if db.columnFamilyHandle(cfName) == nil {
+		if err := db.AddCF(cfName); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &RocksDBStore{db: db, cfName: cfName}, nil
+}
+
+func (s *RocksDBStore) Get(key []byte) ([]byte, error) {
+	return s.db.Get(s.cfName, key)
+}
+
+func (s *RocksDBStore) Has(key []byte) (bool, error) {
+	return s.db.Has(s.cfName, key)
+}
+
+func (s *RocksDBStore) Put(key, value []byte) error {
+	return s.db.Put(s.cfName, key, value)
+}
+
+func (s *RocksDBStore) PutSync(key, value []byte) error {
+	return s.db.PutSync(s.cfName, key, value)
+}
+
+func (s *RocksDBStore) Delete(key []byte) error {
+	return s.db.Delete(s.cfName, key)
+}
+
+func (s *RocksDBStore) Iterator(start, end []byte) (Iterator, error) {
+	it, err := s.db.GetIterator(s.cfName)
+	if err != nil {
+		return nil, err
+	}
+	return newRocksDBIterator(it, start, end, false), nil
+}
+
+func (s *RocksDBStore) ReverseIterator(start, end []byte) (Iterator, error) {
+	it, err := s.db.GetIterator(s.cfName)
+	if err != nil {
+		return nil, err
+	}
+	return newRocksDBIterator(it, start, end, true), nil
+}
+
+func (s *RocksDBStore) NewBatch() Batch {
+	return &rocksDBBatch{
+		store: s,
+		batch: s.db.NewWriteBatch(),
+	}
+}
+
+func (s *RocksDBStore) Snapshot() (Snapshot, error) {
+	snapshot, err := s.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &rocksDBSnapshot{
+		store: s,
+		snapshot: snapshot,
+	}, nil
+}
+
+func (s *RocksDBStore) Compact(start, end []byte) error {
+	return s.db.Compact(s.cfName, start, end)
+}
+
+func (s *RocksDBStore) Close() error {
+	s.db.Close()
+	return nil
+}
+
+// rocksDBBatch keeps the first error of Put and Delete, Write returns it
+type rocksDBBatch struct {
+	store *RocksDBStore
+	batch *WriteBatch
+	err error
+}
+
+func (b *rocksDBBatch) Put(key, value []byte) {
+	if err := b.batch.Put(b.store.cfName, key, value); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *rocksDBBatch) Delete(key []byte) {
+	if err := b.batch.Delete(b.store.cfName, key); err != nil && b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *rocksDBBatch) Write() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.store.db.Write(b.batch)
+}
+
+func (b *rocksDBBatch) Close() {
+	b.batch.Destroy()
+}
+
+type rocksDBSnapshot struct {
+	store *RocksDBStore
+	snapshot *gorocksdb.Snapshot
+}
+
+func (s *rocksDBSnapshot) Get(key []byte) ([]byte, error) {
+	return s.store.db.GetFromSnapshot(s.store.cfName, s.snapshot, key)
+}
+
+func (s *rocksDBSnapshot) Has(key []byte) (bool, error) {
+	value, err := s.Get(key)
+	return value != nil, err
+}
+
+func (s *rocksDBSnapshot) Iterator(start, end []byte) (Iterator, error) {
+	it, err := s.store.db.GetSnapshotIterator(s.store.cfName, s.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return newRocksDBIterator(it, start, end, false), nil
+}
+
+func (s *rocksDBSnapshot) ReverseIterator(start, end []byte) (Iterator, error) {
+	it, err := s.store.db.GetSnapshotIterator(s.store.cfName, s.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return newRocksDBIterator(it, start, end, true), nil
+}
+
+// Release can be called more than once
+func (s *rocksDBSnapshot) Release() {
+	if s.snapshot == nil {
+		return
+	}
+	s.store.db.ReleaseSnapshot(s.snapshot)
+	s.snapshot = nil
+}
+
+// rocksDBIterator checks the bound opposite to where it was positioned, a reversed iterator starts below end
+type rocksDBIterator struct {
+	source *CFIterator
+	start []byte
+	end []byte
+	reverse bool
+}
+
+func newRocksDBIterator(source *CFIterator, start, end []byte, reverse bool) *rocksDBIterator {
+	switch {
+	case !reverse && start == nil:
+		source.SeekToFirst()
+	case !reverse:
+		source.Seek(start)
+	case end == nil:
+		source.SeekToLast()
+	default:
+		// the first key not below end, the key before it is the last one in range
+		source.Seek(end)
+		if source.Valid() {
+			source.Prev()
+		} else {
+			source.SeekToLast()
+		}
+	}
+	return &rocksDBIterator{
+		source: source,
+		start: start,
+		end: end,
+		reverse: reverse,
+	}
+}
+
+func (it *rocksDBIterator) Valid() bool {
+	if !it.source.Valid() {
+		return false
+	}
+	return inRange(it.Key(), it.start, it.end)
+}
+
+func (it *rocksDBIterator) Next() {
+	if it.reverse {
+		it.source.Prev()
+	} else {
+		it.source.Next()
+	}
+}
+
+func (it *rocksDBIterator) Key() []byte {
+	return it.source.Key()
+}
+
+func (it *rocksDBIterator) Value() []byte {
+	return it.source.Value()
+}
+
+func (it *rocksDBIterator) Error() error {
+	return it.source.Err()
+}
+
+func (it *rocksDBIterator) Close() {
+	it.source.Close()
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Rollback removes the blocks above height, the block at height becomes the head. A validator which removes a
+// block it committed could later commit a conflicting block at the same height, so blocks above a commit signed by
+// address are only removed if force is set. The signed commits are the ones in the stored blocks and the sign state,
+// which also records a commit that did not make it into a block. A forced rollback raises the sign state of address
+// to the old head, so the validator does not vote at the removed heights again. It returns the removed heights.
+func (bs *BlockStore) Rollback(height uint64, address string, force bool) (HeightRange, error) {
+	lastHeight, err := bs.LastHeight()
+	if err != nil {
+		return HeightRange{}, err
+	}
+	if height >= lastHeight {
+		return HeightRange{}, nil
+	}
+	if !force {
+		state, err := bs.SignState()
+		if err != nil {
+			return HeightRange{}, err
+		}
+		if state != nil && state.Address == address && state.Height > height {
+			return HeightRange{}, fmt.Errorf("commit of height %d round %d: %w", state.Height, state.Round, ErrSignedCommit)
+		}
+		for h := lastHeight; h > height; h-- {
+			header, err := bs.GetBlockHeader(h)
+			if err != nil {
+				return HeightRange{}, err
+			}
+			for _, vote := range header.Commits {
+				if vote.Address == address {
+					return HeightRange{}, fmt.Errorf("block %s: %w", header.HeightId.String(), ErrSignedCommit)
+				}
+			}
+		}
+	} else {
+		if err := bs.holdHeights(address, lastHeight); err != nil {
+			return HeightRange{}, err
+		}
+	}
+	if err := bs.Truncate(height); err != nil {
+		return HeightRange{}, err
+	}
+	return HeightRange{height + 1, lastHeight}, nil
+}
+
+// Truncate deletes the blocks above height with their index keys, validators and consensus params updates, the
+// block at height becomes the head. Headers which do not decode are deleted too.
+func (bs *BlockStore) Truncate(height uint64) error {
+	if height == 0 {
+		return fmt.Errorf("the genesis block can not be removed")
+	}
+	info, err := bs.getPrunedInfo()
+	if err != nil {
+		return err
+	}
+	if height > 1 && height < info.BlockBase {
+		return fmt.Errorf("block %d is pruned and can not become the head", height)
+	}
+	legacyHeight, err := bs.legacyHeight()
+	if err != nil {
+		return err
+	}
+	head, err := bs.readHeader(height, legacyHeight)
+	if err != nil {
+		return err
+	}
+	has, err := bs.has(keyFromId(head.Id()))
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("block %s: %w", head.HeightId.String(), ErrNotFound)
+	}
+	heights, _, err := bs.storedHeights(HeightKeyPrefix)
+	if err != nil {
+		return err
+	}
+	batch := bs.db.NewBatch()
+	defer batch.Close()
+	scanIndexes := false
+	for _, h := range heights {
+		if h <= height {
+			continue
+		}
+		header, err := bs.readHeader(h, legacyHeight)
+		if err != nil && !errors.Is(err, ErrCorrupted) {
+			return err
+		}
+		batch.Delete(keyFromHeight(h))
+		if err != nil {
+			scanIndexes = true
+			continue
+		}
+		if err := bs.deleteTransactionIndexes(batch, header, legacyHeight); err != nil {
+			if !errors.Is(err, ErrCorrupted) {
+				return err
+			}
+			scanIndexes = true
+		}
+		batch.Delete(keyFromId(header.Id()))
+		deleteIndexes(batch, header)
+	}
+	if scanIndexes {
+		for _, prefix := range []string{ProposerIndexPrefix, TimeIndexPrefix, TransactionIndexPrefix} {
+			if err := bs.deleteIndexesAbove(batch, []byte(prefix), height); err != nil {
+				return err
+			}
+		}
+	}
+	if err := bs.deleteValidatorsFrom(batch, height + types.ValidatorUpdateDelay + 1); err != nil {
+		return err
+	}
+	if err := bs.truncateParamsChanges(batch, height); err != nil {
+		return err
+	}
+	if err := bs.saveLastHeight(batch, height); err != nil {
+		return err
+	}
+	// blocks added above the head again have the current layout
+	if legacyHeight > height {
+		if err := bs.saveLegacyHeight(batch, height); err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	bs.setHead(nil)
+	return nil
+}
+
+// truncateParamsChanges drops the consensus params updates of the blocks above height
+func (bs *BlockStore) truncateParamsChanges(batch Batch, height uint64) error {
+	changes, err := bs.getParamsChanges()
+	if err != nil {
+		return err
+	}
+	kept := make([]paramsChange, 0, len(changes))
+	for _, change := range changes {
+		if change.SourceHeight <= height {
+			kept = append(kept, change)
+		}
+	}
+	if len(kept) == len(changes) {
+		return nil
+	}
+	value, err := encoding.MarshalBinary(kept)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(ConsensusParamsKey), value)
+	return nil
+}
+
+// deleteIndexesAbove deletes the index keys of prefix which end with a height above height
+func (bs *BlockStore) deleteIndexesAbove(batch Batch, prefix []byte, height uint64) error {
+	it, err := bs.db.Iterator(prefix, prefixEnd(prefix))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) >= 8 && binary.BigEndian.Uint64(key[len(key) - 8:]) <= height {
+			continue
+		}
+		batch.Delete(copyBytes(key))
+	}
+	return it.Error()
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"fmt"
+	"math"
+)
+
+const SignStateKey = "signstate"
+
+// SignState is the last commit which the validator of the node signed. It is stored before the commit is broadcast,
+// so it also covers a commit which never made it into a stored block. A forced rollback records every round of the
+// old head, so the validator does not sign the removed heights again.
+type SignState struct {
+	Address string
+	Height uint64
+	Round uint64
+}
+
+// Allows tells whether the validator at address may vote for a block at view, a vote below the recorded commit could
+// conflict with it
+func (s *SignState) Allows(address string, view types.View) bool {
+	if s == nil || s.Address != address {
+		return true
+	}
+	if view.Height != s.Height {
+		return view.Height > s.Height
+	}
+	return view.Round >= s.Round
+}
+
+// SignState returns nil if the node has not signed a commit
+func (bs *BlockStore) SignState() (*SignState, error) {
+	value, err := bs.get([]byte(SignStateKey))
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	state := SignState{}
+	if err := encoding.UnmarshalBinary(value, &state); err != nil {
+		return nil, corrupted("sign state", err)
+	}
+	return &state, nil
+}
+
+// SaveSignState is flushed to disk whatever the Sync option, a sign state lost in a crash lets the validator sign
+// the same height twice
+func (bs *BlockStore) SaveSignState(state SignState) error {
+	value, err := encoding.MarshalBinary(state)
+	if err != nil {
+		return err
+	}
+	if err := bs.db.PutSync([]byte(SignStateKey), value); err != nil {
+		return fmt.Errorf("can not save sign state: %w", err)
+	}
+	return nil
+}
+
+// holdHeights raises the sign state of address to every round of height unless it is above already
+func (bs *BlockStore) holdHeights(address string, height uint64) error {
+	state, err := bs.SignState()
+	if err != nil {
+		return err
+	}
+	if state != nil && state.Address == address && state.Height > height {
+		return nil
+	}
+	return bs.SaveSignState(SignState{Address: address, Height: height, Round: math.MaxUint64})
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"fmt"
+)
+
+// VerifyNext checks that block extends the head, that it carries the stored validator sets and that more than 2/3
+// of its validators committed it. Blocks which pass can be added without running consensus.
+func (bs *BlockStore) VerifyNext(block *types.Block) error {
+	head, err := bs.Head()
+	if err != nil {
+		return fmt.Errorf("can not load head: %v", err)
+	}
+	header := block.Header()
+	if !block.IsValid() {
+		return fmt.Errorf("block %s is invalid", header.HeightId.String())
+	}
+	if header.Height() != head.Height() + 1 || !header.PreviousId.Equals(head.Id()) {
+		return fmt.Errorf("block %s does not link to head %s", header.HeightId.String(), head.Header().HeightId.String())
+	}
+	if !header.VerifyId(encoding.MarshalBinary) {
+		return fmt.Errorf("id of block %s does not match its header", header.HeightId.String())
+	}
+	if err := block.VerifyTransactions(); err != nil {
+		return err
+	}
+	blockId := header.Id()
+	signature := block.Signature()
+	if !signature.Verify(header.Proposer.Address, blockId[:]) {
+		return fmt.Errorf("block %s is not signed by its proposer", header.HeightId.String())
+	}
+	nextValidators, err := bs.GetValidators(header.Height() + 1)
+	if err != nil {
+		return err
+	}
+	nextValidatorsHash, err := nextValidators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return err
+	}
+	if !header.NextValidatorsHash.Equals(nextValidatorsHash) {
+		return fmt.Errorf("next validators hash of block %s does not match", header.HeightId.String())
+	}
+	validators, err := bs.GetValidators(header.Height())
+	if err != nil {
+		return err
+	}
+	return header.VerifyCommits(validators, encoding.MarshalBinary)
+}
@@ -0,0 +1,140 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSubscriberTooSlow closes a subscription whose buffer is full. Events are never dropped silently,
+// the subscriber has to subscribe again and catch up from the block store.
+var ErrSubscriberTooSlow = errors.New("subscriber did not keep up with events")
+
+// Filter selects events by type, an empty filter matches every event
+type Filter struct {
+	Types []EventType
+}
+
+func (f Filter) Matches(event Event) bool {
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, et := range f.Types {
+		if et == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type Subscription struct {
+	mutex sync.Mutex
+	id uint64
+	filter Filter
+	out chan Event
+	closed bool
+	err error
+}
+
+// Events is closed when the subscription ends, Err tells why
+func (s *Subscription) Events() <-chan Event {
+	return s.out
+}
+
+func (s *Subscription) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// send never blocks, it reports false if the buffer is full
+func (s *Subscription) send(event Event) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.out <- event:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Subscription) close(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.out)
+}
+
+// EventBus delivers events to subscribers without ever blocking the publisher. A nil bus discards events.
+type EventBus struct {
+	rwMutex sync.RWMutex
+	subscriptions map[uint64]*Subscription
+	nextId uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: make(map[uint64]*Subscription, 0),
+	}
+}
+
+// Subscribe buffers up to capacity events for the subscriber
+func (eb *EventBus) Subscribe(filter Filter, capacity int) *Subscription {
+	eb.rwMutex.Lock()
+	defer eb.rwMutex.Unlock()
+	eb.nextId++
+	s := &Subscription{
+		id: eb.nextId,
+		filter: filter,
+		out: make(chan Event, capacity),
+	}
+	eb.subscriptions[s.id] = s
+	return s
+}
+
+func (eb *EventBus) Unsubscribe(s *Subscription) {
+	eb.remove(s, nil)
+}
+
+func (eb *EventBus) NumSubscriptions() int {
+	eb.rwMutex.RLock()
+	defer eb.rwMutex.RUnlock()
+	return len(eb.subscriptions)
+}
+
+func (eb *EventBus) Publish(eventType EventType, data interface{}) {
+	if eb == nil {
+		return
+	}
+	event := Event{
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+	slow := make([]*Subscription, 0)
+	eb.rwMutex.RLock()
+	for _, s := range eb.subscriptions {
+		if s.filter.Matches(event) && !s.send(event) {
+			slow = append(slow, s)
+		}
+	}
+	eb.rwMutex.RUnlock()
+	for _, s := range slow {
+		eb.remove(s, ErrSubscriberTooSlow)
+	}
+}
+
+func (eb *EventBus) remove(s *Subscription, err error) {
+	eb.rwMutex.Lock()
+	delete(eb.subscriptions, s.id)
+	eb.rwMutex.Unlock()
+	s.close(err)
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"bft/types"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription) Event {
+	select {
+	case event, ok := <-s.Events():
+		if !ok {
+			t.Fatalf("subscription is closed: %v", s.Err())
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return Event{}
+}
+
+func TestEventBus_Filter(t *testing.T) {
+	bus := NewEventBus()
+	blocks := bus.Subscribe(Filter{Types: []EventType{NewBlock}}, 10)
+	all := bus.Subscribe(Filter{}, 10)
+	bus.Publish(PeerConnected, PeerEvent{PeerId: "QmPeer"})
+	bus.Publish(NewBlock, BlockEvent{Header: types.BlockHeader{HeightId: types.BlockHeightId{Height: 2}}})
+	if event := receive(t, blocks); event.Type != NewBlock || event.Data.(BlockEvent).Header.Height() != 2 {
+		t.Fatalf("unexpected event %v", event)
+	}
+	if event := receive(t, all); event.Type != PeerConnected {
+		t.Fatalf("unexpected event %v", event)
+	}
+	if event := receive(t, all); event.Type != NewBlock {
+		t.Fatalf("unexpected event %v", event)
+	}
+	select {
+	case event := <-blocks.Events():
+		t.Fatalf("filtered subscription received %v", event)
+	default:
+	}
+}
+
+func TestEventBus_SlowSubscriber(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(Filter{}, 2)
+	fast := bus.Subscribe(Filter{}, 100)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			bus.Publish(RoundChange, RoundEvent{View: types.View{Round: uint64(i), Height: 2}})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing should not block on a slow subscriber")
+	}
+	// the slow subscriber gets what fits in its buffer, then the subscription ends
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	if received != 2 || slow.Err() != ErrSubscriberTooSlow {
+		t.Fatalf("expected 2 events and %v, got %d and %v", ErrSubscriberTooSlow, received, slow.Err())
+	}
+	for i := 0; i < 10; i++ {
+		if event := receive(t, fast); event.Data.(RoundEvent).View.Round != uint64(i) {
+			t.Fatalf("unexpected event %v", event)
+		}
+	}
+	if bus.NumSubscriptions() != 1 {
+		t.Fatal("slow subscription should be removed")
+	}
+}
+
+func TestEventBus_Unsubscribe(t *testing.T) {
+	bus := NewEventBus()
+	s := bus.Subscribe(Filter{}, 1)
+	bus.Unsubscribe(s)
+	bus.Publish(NewBlock, BlockEvent{})
+	if _, ok := <-s.Events(); ok || s.Err() != nil {
+		t.Fatal("subscription should be closed without error")
+	}
+	var nilBus *EventBus
+	nilBus.Publish(NewBlock, BlockEvent{})
+}
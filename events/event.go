@@ -0,0 +1,87 @@
+package events
+
+import (
+	"bft/types"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type EventType uint8
+
+const (
+	NewBlock EventType = iota
+	StateChange
+	RoundChange
+	PeerConnected
+	PeerDisconnected
+)
+
+func (et EventType) String() string {
+	switch et {
+	case NewBlock:
+		return "new_block"
+	case StateChange:
+		return "state_change"
+	case RoundChange:
+		return "round_change"
+	case PeerConnected:
+		return "peer_connected"
+	case PeerDisconnected:
+		return "peer_disconnected"
+	default:
+		return ""
+	}
+}
+
+func ParseEventType(name string) (EventType, error) {
+	for et := NewBlock; et <= PeerDisconnected; et++ {
+		if et.String() == name {
+			return et, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown event type %s", name)
+}
+
+func (et EventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(et.String())
+}
+
+func (et *EventType) UnmarshalJSON(b []byte) error {
+	name := ""
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	parsed, err := ParseEventType(name)
+	if err != nil {
+		return err
+	}
+	*et = parsed
+	return nil
+}
+
+type Event struct {
+	Type EventType
+	Time time.Time
+	Data interface{}
+}
+
+// BlockEvent is published once a block is committed, the header carries the commits
+type BlockEvent struct {
+	Header types.BlockHeader
+}
+
+// StateEvent is published when the consensus state of a view changes
+type StateEvent struct {
+	View types.View
+	State string
+}
+
+// RoundEvent is published when the validator starts a new round or moves to a higher round of the height
+type RoundEvent struct {
+	View types.View
+}
+
+type PeerEvent struct {
+	PeerId string
+}
@@ -0,0 +1,241 @@
+package lightclient
+
+import (
+	"bft/types"
+	"bft/encoding"
+	"errors"
+	"fmt"
+	"bft/logging"
+	"sync"
+	"time"
+)
+
+const DefaultTrustingPeriod = 14 * 24 * time.Hour
+
+// ErrNotEnoughTrust means that trusted validators did not commit a header, an intermediate header has to be verified first
+var ErrNotEnoughTrust = errors.New("not enough trusted validators committed the header")
+var ErrTrustExpired = errors.New("trusted header is older than the trusting period")
+
+// ConflictError is returned when a witness serves a committed header which differs from the primary's one,
+// either the primary or the witness is faulty
+type ConflictError struct {
+	Primary *types.BlockHeader
+	Witness *types.BlockHeader
+	WitnessIndex int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("witness %d has block %s, primary has block %s", e.WitnessIndex, e.Witness.HeightId.String(), e.Primary.HeightId.String())
+}
+
+// Client follows the chain from a trusted header without running consensus. It verifies later headers through
+// their commits and validator set hashes, and cross-checks them against witnesses.
+type Client struct {
+	mutex sync.Mutex
+	primary Provider
+	witnesses []Provider
+	trusted *types.BlockHeader
+	trustingPeriod time.Duration
+	now func() time.Time
+	logger logging.Logger
+}
+
+// NewClient starts from a header obtained from a source the user trusts, for example a hash published by validators
+func NewClient(trusted *types.BlockHeader, trustingPeriod time.Duration, primary Provider, witnesses ...Provider) (*Client, error) {
+	if trusted == nil || !trusted.HeightId.IsValid() {
+		return nil, fmt.Errorf("trusted header is invalid")
+	}
+	if !trusted.VerifyId(encoding.MarshalBinary) {
+		return nil, fmt.Errorf("id of trusted header does not match its content")
+	}
+	return &Client{
+		primary: primary,
+		witnesses: witnesses,
+		trusted: trusted,
+		trustingPeriod: trustingPeriod,
+		now: time.Now,
+		logger: logging.Default().With(logging.Module("lightclient")),
+	}, nil
+}
+
+func (c *Client) SetLogger(logger logging.Logger) {
+	c.logger = logger
+}
+
+func (c *Client) TrustedHeader() *types.BlockHeader {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.trusted
+}
+
+// Update verifies the primary's latest header
+func (c *Client) Update() (*types.BlockHeader, error) {
+	lastHeight, err := c.primary.LastHeight()
+	if err != nil {
+		return nil, err
+	}
+	if lastHeight <= c.TrustedHeader().Height() {
+		return c.TrustedHeader(), nil
+	}
+	return c.VerifySkipping(lastHeight)
+}
+
+// VerifySequential verifies every header from the trusted one up to the given height
+func (c *Client) VerifySequential(height uint64) (*types.BlockHeader, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkTrustingPeriod(); err != nil {
+		return nil, err
+	}
+	trusted := c.trusted
+	for trusted.Height() < height {
+		untrusted, err := c.primary.Header(trusted.Height() + 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.verify(trusted, untrusted); err != nil {
+			return nil, err
+		}
+		trusted = untrusted
+	}
+	return trusted, c.accept(trusted)
+}
+
+// VerifySkipping jumps from the trusted header to the given height as long as more than 1/3 of the trusted
+// validators committed the target, and bisects the range otherwise
+func (c *Client) VerifySkipping(height uint64) (*types.BlockHeader, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkTrustingPeriod(); err != nil {
+		return nil, err
+	}
+	verified, err := c.bisect(c.trusted, height)
+	if err != nil {
+		return nil, err
+	}
+	return verified, c.accept(verified)
+}
+
+func (c *Client) bisect(trusted *types.BlockHeader, height uint64) (*types.BlockHeader, error) {
+	untrusted, err := c.primary.Header(height)
+	if err != nil {
+		return nil, err
+	}
+	err = c.verify(trusted, untrusted)
+	if err == nil {
+		return untrusted, nil
+	}
+	if err != ErrNotEnoughTrust {
+		return nil, err
+	}
+	pivot := (trusted.Height() + height) / 2
+	c.logger.Debug("bisect headers", logging.F("from", trusted.Height()), logging.F("to", height), logging.Height(pivot))
+	middle, err := c.bisect(trusted, pivot)
+	if err != nil {
+		return nil, err
+	}
+	return c.bisect(middle, height)
+}
+
+// accept cross-checks a verified header with witnesses before trusting it
+func (c *Client) accept(header *types.BlockHeader) error {
+	if err := c.detectConflicts(header); err != nil {
+		return err
+	}
+	c.trusted = header
+	return nil
+}
+
+func (c *Client) checkTrustingPeriod() error {
+	if c.trusted.Timestamp.Add(c.trustingPeriod).Before(c.now()) {
+		return ErrTrustExpired
+	}
+	return nil
+}
+
+// verify checks untrusted against trusted: adjacent headers must link and carry the announced validators,
+// a skipped range needs commits of more than 1/3 of the trusted validators. Either way more than 2/3 of
+// the untrusted header's own validators must have committed it.
+func (c *Client) verify(trusted, untrusted *types.BlockHeader) error {
+	if untrusted.Height() <= trusted.Height() {
+		return fmt.Errorf("header %d is not after trusted header %d", untrusted.Height(), trusted.Height())
+	}
+	if !untrusted.VerifyId(encoding.MarshalBinary) {
+		return fmt.Errorf("id of header %d does not match its content", untrusted.Height())
+	}
+	if !untrusted.Timestamp.After(trusted.Timestamp) {
+		return fmt.Errorf("header %d is not later than trusted header %d", untrusted.Height(), trusted.Height())
+	}
+	if untrusted.Height() == trusted.Height() + 1 {
+		if !untrusted.PreviousId.Equals(trusted.Id()) {
+			return fmt.Errorf("header %d does not link to trusted header", untrusted.Height())
+		}
+		if !untrusted.ValidatorsHash.Equals(trusted.NextValidatorsHash) {
+			return fmt.Errorf("validators of header %d are not the ones announced by trusted header", untrusted.Height())
+		}
+	} else {
+		trustedValidators, err := c.validators(trusted.Height() + 1, trusted.NextValidatorsHash)
+		if err != nil {
+			return err
+		}
+		if err := untrusted.VerifyCommitsTrusting(trustedValidators, encoding.MarshalBinary); err != nil {
+			c.logger.Debug("trusted validators did not commit the header", logging.Height(untrusted.Height()), logging.Err(err))
+			return ErrNotEnoughTrust
+		}
+	}
+	validators, err := c.validators(untrusted.Height(), untrusted.ValidatorsHash)
+	if err != nil {
+		return err
+	}
+	return untrusted.VerifyCommits(validators, encoding.MarshalBinary)
+}
+
+// validators fetches the validators of a height from the primary and checks them against a verified hash
+func (c *Client) validators(height uint64, hash types.Hash) (types.Validators, error) {
+	validators, err := c.primary.Validators(height)
+	if err != nil {
+		return nil, err
+	}
+	validatorsHash, err := validators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		return nil, err
+	}
+	if !validatorsHash.Equals(hash) {
+		return nil, fmt.Errorf("validators of height %d do not match hash %s", height, hash.String())
+	}
+	return validators, nil
+}
+
+// detectConflicts asks every witness for the header at the same height. A different header that is committed
+// by its own validators proves that someone signed conflicting blocks.
+func (c *Client) detectConflicts(header *types.BlockHeader) error {
+	for i, witness := range c.witnesses {
+		witnessHeader, err := witness.Header(header.Height())
+		if err != nil {
+			c.logger.Warn("witness has no header", logging.F("witness", i), logging.Height(header.Height()), logging.Err(err))
+			continue
+		}
+		if witnessHeader.Id().Equals(header.Id()) {
+			continue
+		}
+		validators, err := witness.Validators(header.Height())
+		if err != nil {
+			c.logger.Warn("witness has no validators", logging.F("witness", i), logging.Height(header.Height()), logging.Err(err))
+			continue
+		}
+		if !witnessHeader.VerifyId(encoding.MarshalBinary) {
+			c.logger.Warn("witness served a header with a wrong id", logging.F("witness", i), logging.Height(header.Height()))
+			continue
+		}
+		if err := witnessHeader.VerifyCommits(validators, encoding.MarshalBinary); err != nil {
+			c.logger.Warn("witness served an uncommitted header", logging.F("witness", i), logging.Height(header.Height()), logging.Err(err))
+			continue
+		}
+		return &ConflictError{
+			Primary: header,
+			Witness: witnessHeader,
+			WitnessIndex: i,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package lightclient
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"bft/crypto"
+	"bft/encoding"
+	"bft/testutil"
+	"bft/types"
+)
+
+var genesisTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// chain is an in-memory provider
+type chain struct {
+	headers map[uint64]*types.BlockHeader
+	validators map[uint64]types.Validators
+	lastHeight uint64
+	requests int
+}
+
+func (c *chain) Header(height uint64) (*types.BlockHeader, error) {
+	c.requests++
+	header, ok := c.headers[height]
+	if !ok {
+		return nil, fmt.Errorf("header %d does not exist", height)
+	}
+	copied := *header
+	return &copied, nil
+}
+
+func (c *chain) Validators(height uint64) (types.Validators, error) {
+	validators, ok := c.validators[height]
+	if !ok {
+		return nil, fmt.Errorf("validators %d do not exist", height)
+	}
+	return validators, nil
+}
+
+func (c *chain) LastHeight() (uint64, error) {
+	return c.lastHeight, nil
+}
+
+func newKeys(t *testing.T, n int) []*crypto.PrivateKey {
+	keys := make([]*crypto.PrivateKey, 0)
+	for i := 0; i < n; i++ {
+		key, err := crypto.NewRandomPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func validatorsOf(keys []*crypto.PrivateKey, indexes []int) types.Validators {
+	validators := make(types.Validators, 0)
+	for _, i := range indexes {
+		validators = append(validators, types.Validator{
+			Address: keys[i].PublicKey().Address(),
+			PublicKey: *keys[i].PublicKey(),
+			VotingPower: 1,
+		})
+	}
+	return validators
+}
+
+// newChain builds n committed headers. setOf returns the indexes of the keys which validate a height,
+// fork shifts the timestamps from a height on to create a different chain with the same validators.
+func newChain(t *testing.T, keys []*crypto.PrivateKey, n uint64, setOf func(height uint64) []int, fork uint64) *chain {
+	c := &chain{
+		headers: make(map[uint64]*types.BlockHeader, 0),
+		validators: make(map[uint64]types.Validators, 0),
+		lastHeight: n,
+	}
+	for height := uint64(1); height <= n + 1; height++ {
+		c.validators[height] = validatorsOf(keys, setOf(height))
+	}
+	previousId := types.Hash{}
+	for height := uint64(1); height <= n; height++ {
+		validatorsHash, _ := c.validators[height].Hash(encoding.MarshalBinary)
+		nextValidatorsHash, _ := c.validators[height + 1].Hash(encoding.MarshalBinary)
+		timestamp := genesisTime.Add(time.Duration(height) * time.Minute)
+		if fork != 0 && height >= fork {
+			timestamp = timestamp.Add(time.Second)
+		}
+		header := types.BlockHeader{
+			HeightId: types.BlockHeightId{Height: height},
+			PreviousId: previousId,
+			Proposer: c.validators[height][0],
+			Timestamp: timestamp,
+			ValidatorsHash: validatorsHash,
+			NextValidatorsHash: nextValidatorsHash,
+		}
+		header.HeightId.Id = header.CalculateId(encoding.MarshalBinary)
+		for _, i := range setOf(height) {
+			header.Commits = append(header.Commits, testutil.NewCommit(t, keys[i], header))
+		}
+		c.headers[height] = &header
+		previousId = header.Id()
+	}
+	return c
+}
+
+func staticSet(height uint64) []int {
+	return []int{0, 1, 2, 3}
+}
+
+// rotatingSet replaces half of the validators every 10 heights
+func rotatingSet(height uint64) []int {
+	first := int((height - 1) / 10) * 2
+	return []int{first, first + 1, first + 2, first + 3}
+}
+
+func newTestClient(t *testing.T, primary *chain, witnesses ...Provider) *Client {
+	client, err := NewClient(primary.headers[1], DefaultTrustingPeriod, primary, witnesses...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.now = func() time.Time {
+		return genesisTime.Add(time.Hour)
+	}
+	return client
+}
+
+func TestClient_VerifySequential(t *testing.T) {
+	primary := newChain(t, newKeys(t, 4), 20, staticSet, 0)
+	client := newTestClient(t, primary)
+	header, err := client.VerifySequential(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Id().Equals(primary.headers[20].Id()) || !client.TrustedHeader().Id().Equals(header.Id()) {
+		t.Fatal("header 20 should be trusted")
+	}
+}
+
+func TestClient_VerifySkipping(t *testing.T) {
+	primary := newChain(t, newKeys(t, 10), 30, rotatingSet, 0)
+	client := newTestClient(t, primary)
+	header, err := client.VerifySkipping(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.Id().Equals(primary.headers[30].Id()) {
+		t.Fatal("header 30 should be trusted")
+	}
+	// none of the validators of height 2 validates height 30, so it bisects but skips most headers
+	if primary.requests >= 29 {
+		t.Fatalf("expected less headers than sequential verification, requested %d", primary.requests)
+	}
+}
+
+func TestClient_Update(t *testing.T) {
+	primary := newChain(t, newKeys(t, 4), 15, staticSet, 0)
+	client := newTestClient(t, primary)
+	header, err := client.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Height() != 15 {
+		t.Fatalf("expected height 15, got %d", header.Height())
+	}
+}
+
+func TestClient_RejectForgedCommits(t *testing.T) {
+	keys := newKeys(t, 8)
+	primary := newChain(t, keys, 10, staticSet, 0)
+	forged := newChain(t, keys, 10, func(height uint64) []int {
+		return []int{4, 5, 6, 7}
+	}, 0)
+	// the header announces the right validators but outsiders signed it
+	header := *primary.headers[5]
+	header.Commits = nil
+	for _, i := range []int{4, 5, 6, 7} {
+		header.Commits = append(header.Commits, testutil.NewCommit(t, keys[i], header))
+	}
+	primary.headers[5] = &header
+	client := newTestClient(t, primary)
+	if _, err := client.VerifySequential(10); err == nil {
+		t.Fatal("header committed by outsiders should be rejected")
+	}
+	// a whole chain of outsiders can not be reached by skipping either
+	primary.headers[5] = forged.headers[5]
+	primary.validators[5] = forged.validators[5]
+	if _, err := client.VerifySkipping(5); err == nil {
+		t.Fatal("header of another validator set should be rejected")
+	}
+	if client.TrustedHeader().Height() != 1 {
+		t.Fatal("trusted header should not move")
+	}
+}
+
+func TestClient_DetectConflictingHeaders(t *testing.T) {
+	keys := newKeys(t, 4)
+	primary := newChain(t, keys, 20, staticSet, 0)
+	honestWitness := newChain(t, keys, 20, staticSet, 0)
+	// the same validators signed another chain from height 10
+	forkedWitness := newChain(t, keys, 20, staticSet, 10)
+	client := newTestClient(t, primary, honestWitness, forkedWitness)
+	if _, err := client.VerifySkipping(9); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.VerifySkipping(15)
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if conflict.WitnessIndex != 1 || conflict.Witness.Height() != 15 {
+		t.Fatalf("unexpected conflict %v", conflict)
+	}
+	if client.TrustedHeader().Height() != 9 {
+		t.Fatal("conflicting header should not be trusted")
+	}
+}
+
+func TestClient_TrustExpired(t *testing.T) {
+	primary := newChain(t, newKeys(t, 4), 5, staticSet, 0)
+	client := newTestClient(t, primary)
+	client.now = func() time.Time {
+		return genesisTime.Add(DefaultTrustingPeriod + time.Hour)
+	}
+	if _, err := client.VerifySkipping(5); err != ErrTrustExpired {
+		t.Fatalf("expected %v, got %v", ErrTrustExpired, err)
+	}
+}
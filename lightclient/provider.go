@@ -0,0 +1,39 @@
+package lightclient
+
+import (
+	"bft/database"
+	"bft/types"
+)
+
+// Provider serves committed headers and validator sets, usually on behalf of a full node
+type Provider interface {
+	// Header returns the header at the given height, including its commits
+	Header(height uint64) (*types.BlockHeader, error)
+	// Validators returns the validators which commit the block at the given height
+	Validators(height uint64) (types.Validators, error)
+	// LastHeight returns the height of the latest committed header
+	LastHeight() (uint64, error)
+}
+
+// StoreProvider serves headers from a local block store
+type StoreProvider struct {
+	blockStore *database.BlockStore
+}
+
+func NewStoreProvider(blockStore *database.BlockStore) *StoreProvider {
+	return &StoreProvider{
+		blockStore: blockStore,
+	}
+}
+
+func (sp *StoreProvider) Header(height uint64) (*types.BlockHeader, error) {
+	return sp.blockStore.GetBlockHeader(height)
+}
+
+func (sp *StoreProvider) Validators(height uint64) (types.Validators, error) {
+	return sp.blockStore.GetValidators(height)
+}
+
+func (sp *StoreProvider) LastHeight() (uint64, error) {
+	return sp.blockStore.LastHeight()
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type Level uint8
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return ""
+	}
+}
+
+func ParseLevel(name string) (Level, error) {
+	for l := DebugLevel; l <= ErrorLevel; l++ {
+		if l.String() == strings.ToLower(name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s", name)
+}
+
+// Levels holds the minimum level of every module, it can be changed while the node runs
+type Levels struct {
+	rwMutex sync.RWMutex
+	defaultLevel Level
+	modules map[string]Level
+}
+
+func NewLevels(defaultLevel Level) *Levels {
+	return &Levels{
+		defaultLevel: defaultLevel,
+		modules: make(map[string]Level, 0),
+	}
+}
+
+func (ls *Levels) Set(module string, level Level) {
+	ls.rwMutex.Lock()
+	defer ls.rwMutex.Unlock()
+	ls.modules[module] = level
+}
+
+// SetDefault sets the level of modules which have no level of their own
+func (ls *Levels) SetDefault(level Level) {
+	ls.rwMutex.Lock()
+	defer ls.rwMutex.Unlock()
+	ls.defaultLevel = level
+}
+
+func (ls *Levels) Get(module string) Level {
+	ls.rwMutex.RLock()
+	defer ls.rwMutex.RUnlock()
+	if level, ok := ls.modules[module]; ok {
+		return level
+	}
+	return ls.defaultLevel
+}
+
+func (ls *Levels) Enabled(module string, level Level) bool {
+	return level >= ls.Get(module)
+}
+
+// Parse applies a comma separated list of levels, for example "info,consensus=debug,network=warn".
+// An entry without module sets the default level.
+func (ls *Levels) Parse(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			level, err := ParseLevel(parts[0])
+			if err != nil {
+				return err
+			}
+			ls.SetDefault(level)
+			continue
+		}
+		level, err := ParseLevel(parts[1])
+		if err != nil {
+			return err
+		}
+		ls.Set(strings.TrimSpace(parts[0]), level)
+	}
+	return nil
+}
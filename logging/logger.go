@@ -0,0 +1,172 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ModuleKey = "module"
+
+type Field struct {
+	Key string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Module(name string) Field {
+	return F(ModuleKey, name)
+}
+
+func Height(height uint64) Field {
+	return F("height", height)
+}
+
+func Round(round uint64) Field {
+	return F("round", round)
+}
+
+func Peer(peerId string) Field {
+	return F("peer", peerId)
+}
+
+func VoteType(voteType fmt.Stringer) Field {
+	return F("vote_type", voteType.String())
+}
+
+func Err(err error) Field {
+	return F("err", err)
+}
+
+// Logger writes leveled entries made of a message and structured fields
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	// With returns a logger which adds the fields to every entry, a module field selects the module's level
+	With(fields ...Field) Logger
+}
+
+// DefaultLevels are the levels of the default logger
+var DefaultLevels = NewLevels(InfoLevel)
+
+var defaultLogger = New(os.Stderr, DefaultLevels)
+
+func Default() Logger {
+	return defaultLogger
+}
+
+type sink struct {
+	mutex sync.Mutex
+	writer io.Writer
+	levels *Levels
+}
+
+type logger struct {
+	sink *sink
+	module string
+	fields []Field
+}
+
+// New returns a logger which writes logfmt lines to writer
+func New(writer io.Writer, levels *Levels) Logger {
+	return &logger{
+		sink: &sink{
+			writer: writer,
+			levels: levels,
+		},
+	}
+}
+
+func (l *logger) Debug(msg string, fields ...Field) {
+	l.log(DebugLevel, msg, fields)
+}
+
+func (l *logger) Info(msg string, fields ...Field) {
+	l.log(InfoLevel, msg, fields)
+}
+
+func (l *logger) Warn(msg string, fields ...Field) {
+	l.log(WarnLevel, msg, fields)
+}
+
+func (l *logger) Error(msg string, fields ...Field) {
+	l.log(ErrorLevel, msg, fields)
+}
+
+func (l *logger) With(fields ...Field) Logger {
+	child := &logger{
+		sink: l.sink,
+		module: l.module,
+		fields: make([]Field, 0),
+	}
+	child.fields = append(child.fields, l.fields...)
+	for _, field := range fields {
+		if field.Key == ModuleKey {
+			child.module = fmt.Sprint(field.Value)
+			continue
+		}
+		child.fields = append(child.fields, field)
+	}
+	return child
+}
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if !l.sink.levels.Enabled(l.module, level) {
+		return
+	}
+	buf := &bytes.Buffer{}
+	writeField(buf, "time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	writeField(buf, "level", level.String())
+	if l.module != "" {
+		writeField(buf, ModuleKey, l.module)
+	}
+	writeField(buf, "msg", msg)
+	for _, field := range l.fields {
+		writeField(buf, field.Key, field.Value)
+	}
+	for _, field := range fields {
+		writeField(buf, field.Key, field.Value)
+	}
+	buf.WriteByte('\n')
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	buf.WriteTo(l.sink.writer)
+}
+
+func writeField(buf *bytes.Buffer, key string, value interface{}) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+type nop struct{}
+
+// Nop discards every entry
+func Nop() Logger {
+	return nop{}
+}
+
+func (nop) Debug(msg string, fields ...Field) {}
+func (nop) Info(msg string, fields ...Field) {}
+func (nop) Warn(msg string, fields ...Field) {}
+func (nop) Error(msg string, fields ...Field) {}
+func (n nop) With(fields ...Field) Logger {
+	return n
+}
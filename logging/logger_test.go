@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var timeField = regexp.MustCompile(`^time=\S+ `)
+
+func lines(buf *bytes.Buffer) []string {
+	result := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line != "" {
+			result = append(result, timeField.ReplaceAllString(line, ""))
+		}
+	}
+	buf.Reset()
+	return result
+}
+
+func TestLogger_Fields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf, NewLevels(DebugLevel)).With(Module("consensus"), Height(2))
+	logger.Info("received vote", Round(1), Peer("QmPeer"), F("reason", "not \"valid\""), Err(fmt.Errorf("bad signature")))
+	expected := `level=info module=consensus msg="received vote" height=2 round=1 peer=QmPeer reason="not \"valid\"" err="bad signature"`
+	if result := lines(buf); len(result) != 1 || result[0] != expected {
+		t.Fatalf("expected\n%s\ngot\n%v", expected, result)
+	}
+}
+
+func TestLogger_ModuleLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	levels := NewLevels(InfoLevel)
+	root := New(buf, levels)
+	consensus := root.With(Module("consensus"))
+	network := root.With(Module("network"))
+	consensus.Debug("hidden")
+	network.Info("shown")
+	if result := lines(buf); len(result) != 1 || !strings.Contains(result[0], "module=network") {
+		t.Fatalf("unexpected lines %v", result)
+	}
+	// levels change while loggers are in use
+	if err := levels.Parse("warn,consensus=debug"); err != nil {
+		t.Fatal(err)
+	}
+	consensus.Debug("shown")
+	network.Info("hidden")
+	network.Warn("shown")
+	result := lines(buf)
+	if len(result) != 2 || !strings.Contains(result[0], "level=debug module=consensus") || !strings.Contains(result[1], "level=warn module=network") {
+		t.Fatalf("unexpected lines %v", result)
+	}
+	if err := levels.Parse("consensus=loud"); err == nil {
+		t.Fatal("unknown level should be rejected")
+	}
+}
@@ -1,19 +1,342 @@
 package main
 
-import "bft/network"
+import (
+	"bft/archive"
+	"bft/config"
+	"bft/database"
+	"bft/network"
+	"bft/node"
+	"bft/types"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
 
-//func main() {
-//	targets := make([]string, 0)
-//	nm := network.NewNetManager("127.0.0.1", 2000, targets)
-//	//done := make(chan struct{})
-//	nm.Run()
-//	//<- done
-//}
+const usage = `usage: bft <command> [flags]
+
+commands:
+  init          create the home directory with a config file, a validator key and a libp2p identity
+  start         run the node
+  keygen        generate a new validator key
+  show-address  print the validator address and the peer id
+  reset         delete the database, keys and config are kept
+  testnet       generate the homes of a local multi-validator network
+  export        write the chain to an archive file, the node must be stopped
+  import        add the blocks of an archive file to the chain, the node must be stopped
+  verify-db     check the stored chain and optionally repair it, the node must be stopped
+  rollback      remove the blocks above a height, the node must be stopped
+
+run "bft <command> --help" for the flags of a command
+`
 
 func main() {
-	targets := []string{"/ip4/127.0.0.1/tcp/2000/ipfs/QmVJih4nhy6TGVrJKBmtinPFimDD83N3FrmMyQPZmNF7hE"}
-	nm := network.NewNetManager("127.0.0.1", 2001, targets)
-	//done := make(chan struct{})
-	nm.Run()
-	//<- done
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	commands := map[string]func(args []string) error{
+		"init": initCommand,
+		"start": startCommand,
+		"keygen": keygenCommand,
+		"show-address": showAddressCommand,
+		"reset": resetCommand,
+		"testnet": testnetCommand,
+		"export": exportCommand,
+		"import": importCommand,
+		"verify-db": verifyDBCommand,
+		"rollback": rollbackCommand,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet registers --home and the flags which override the config file
+func newFlagSet(name string) (*flag.FlagSet, *string, *config.Flags) {
+	flagSet := flag.NewFlagSet(name, flag.ExitOnError)
+	home := flagSet.String("home", config.DefaultHome(), "home directory of the node")
+	return flagSet, home, config.RegisterFlags(flagSet)
+}
+
+// loadConfig reads the config file of home and applies the flags which have been set
+func loadConfig(home string, flags *config.Flags) (*config.Config, error) {
+	cfg, err := config.Load(home)
+	if err != nil {
+		return nil, err
+	}
+	if err := flags.Apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func initCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("init")
+	chainId := flagSet.String("chain-id", "bft-local", "chain id of the genesis")
+	flagSet.Parse(args)
+	cfg := config.DefaultConfig(*home)
+	if err := flags.Apply(cfg); err != nil {
+		return err
+	}
+	validator, peerId, err := node.InitHome(cfg)
+	if err != nil {
+		return err
+	}
+	// a single validator network until the genesis is replaced by a shared one
+	genesis := types.NewGenesis(*chainId, types.Validators{validator})
+	if err := genesis.Save(cfg.GenesisPath()); err != nil {
+		return err
+	}
+	fmt.Printf("initialized %s\naddress: %s\npeer id: %s\n", cfg.Home, validator.Address, peerId)
+	return nil
+}
+
+func testnetCommand(args []string) error {
+	options := node.DefaultTestnetOptions()
+	flagSet := flag.NewFlagSet("testnet", flag.ExitOnError)
+	flagSet.StringVar(&options.ChainId, "chain-id", options.ChainId, "chain id of the genesis")
+	flagSet.IntVar(&options.Validators, "validators", options.Validators, "number of validators")
+	flagSet.StringVar(&options.OutputDir, "output", options.OutputDir, "directory of the node homes")
+	flagSet.StringVar(&options.IpAddress, "ip", options.IpAddress, "ip address of all nodes")
+	flagSet.IntVar(&options.BasePort, "base-port", options.BasePort, "p2p port of the first node, the others use the following ports")
+	flagSet.IntVar(&options.RPCBasePort, "rpc-base-port", options.RPCBasePort, "rpc port of the first node, the others use the following ports")
+	flagSet.StringVar(&options.LogLevel, "log-level", options.LogLevel, "log levels of all nodes")
+	flagSet.StringVar(&options.Binary, "binary", options.Binary, "command which runs a node in the start files")
+	flagSet.Parse(args)
+	configs, err := node.GenerateTestnet(options)
+	if err != nil {
+		return err
+	}
+	for _, cfg := range configs {
+		fmt.Printf("%s p2p %s:%d rpc %s\n", cfg.Home, cfg.ListenAddress, cfg.ListenPort, cfg.RPCAddress)
+	}
+	fmt.Printf("start the nodes with %s or the %s\n", filepath.Join(options.OutputDir, node.StartScript), node.Procfile)
+	return nil
+}
+
+func startCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("start")
+	flagSet.Parse(args)
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	n, err := node.NewNode(cfg)
+	if err != nil {
+		return err
+	}
+	if err := n.Start(); err != nil {
+		return err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	n.Stop()
+	return nil
+}
+
+func keygenCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("keygen")
+	force := flagSet.Bool("force", false, "replace the existing key")
+	flagSet.Parse(args)
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	privateKey, err := node.GenerateKey(cfg.KeyPath(), *force)
+	if err != nil {
+		return err
+	}
+	fmt.Println(privateKey.PublicKey().Address())
+	return nil
+}
+
+func showAddressCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("show-address")
+	flagSet.Parse(args)
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	privateKey, err := node.LoadKey(cfg.KeyPath())
+	if err != nil {
+		return err
+	}
+	peerId, err := network.PeerId(cfg.IdentityPath())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("address: %s\npeer id: %s\n", privateKey.PublicKey().Address(), peerId)
+	return nil
+}
+
+func resetCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("reset")
+	flagSet.Parse(args)
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(cfg.DBDir()); err != nil {
+		return err
+	}
+	fmt.Printf("removed %s\n", cfg.DBDir())
+	return nil
+}
+
+func exportCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("export")
+	output := flagSet.String("output", "", "archive file to write")
+	start := flagSet.Uint64("start", 1, "first height to export")
+	end := flagSet.Uint64("end", 0, "last height to export, 0 is the last height")
+	flagSet.Parse(args)
+	if *output == "" {
+		return fmt.Errorf("--output is missing")
+	}
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	blockStore, err := node.OpenBlockStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer blockStore.Close()
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	exported, err := archive.Export(blockStore, f, *start, *end)
+	if err != nil {
+		f.Close()
+		os.Remove(*output)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported blocks %s of chain %s to %s\n", exported, blockStore.ChainId(), *output)
+	return nil
+}
+
+// importCommand writes the genesis of the archive to a home which has none, so an initialized home can be seeded
+func importCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("import")
+	input := flagSet.String("input", "", "archive file to read")
+	flagSet.Parse(args)
+	if *input == "" {
+		return fmt.Errorf("--input is missing")
+	}
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := archive.NewReader(f)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.GenesisPath()); os.IsNotExist(err) {
+		if err := reader.Genesis.Save(cfg.GenesisPath()); err != nil {
+			return err
+		}
+		fmt.Printf("wrote genesis of chain %s to %s\n", reader.Genesis.ChainId, cfg.GenesisPath())
+	}
+	blockStore, err := node.OpenBlockStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer blockStore.Close()
+	imported, err := archive.Import(blockStore, reader)
+	if err != nil {
+		return fmt.Errorf("imported blocks %s, then: %v", imported, err)
+	}
+	fmt.Printf("imported blocks %s of chain %s\n", imported, blockStore.ChainId())
+	return nil
+}
+
+// verifyDBCommand repairs a damaged store by truncating it to the last height which passed every check
+func verifyDBCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("verify-db")
+	repair := flagSet.Bool("repair", false, "truncate the chain to the last consistent height")
+	flagSet.Parse(args)
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	blockStore, err := node.OpenBlockStoreForCheck(cfg)
+	if err != nil {
+		return err
+	}
+	defer blockStore.Close()
+	report, err := blockStore.Check()
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("checked %d headers and %d blocks, last height %d, consistent up to height %d\n", report.Headers, report.Blocks, report.LastHeight, report.ConsistentHeight)
+	if report.OK() {
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("found %d problems, run with --repair to truncate the chain to height %d", len(report.Problems), report.ConsistentHeight)
+	}
+	if err := blockStore.Repair(report); err != nil {
+		return err
+	}
+	fmt.Printf("truncated the chain to height %d\n", report.ConsistentHeight)
+	return nil
+}
+
+// rollbackCommand refuses to remove blocks the validator committed, unless forced
+func rollbackCommand(args []string) error {
+	flagSet, home, flags := newFlagSet("rollback")
+	toHeight := flagSet.Uint64("to-height", 0, "height of the new head")
+	force := flagSet.Bool("force", false, "also remove blocks the validator committed, it does not vote at these heights again")
+	flagSet.Parse(args)
+	if *toHeight == 0 {
+		return fmt.Errorf("--to-height is missing")
+	}
+	cfg, err := loadConfig(*home, flags)
+	if err != nil {
+		return err
+	}
+	privateKey, err := node.LoadKey(cfg.KeyPath())
+	if err != nil {
+		return err
+	}
+	blockStore, err := node.OpenBlockStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer blockStore.Close()
+	removed, err := blockStore.Rollback(*toHeight, privateKey.PublicKey().Address(), *force)
+	if errors.Is(err, database.ErrSignedCommit) {
+		return fmt.Errorf("%v, run with --force to remove it anyway", err)
+	}
+	if err != nil {
+		return err
+	}
+	if removed.Empty() {
+		fmt.Printf("the chain does not go above height %d\n", *toHeight)
+		return nil
+	}
+	fmt.Printf("removed blocks %s, the head is at height %d\n", removed, *toHeight)
+	return nil
 }
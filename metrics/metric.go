@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Counter only goes up
+type Counter struct {
+	series
+	counts map[string]float64
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{
+		counts: make(map[string]float64, 0),
+	}
+	c.init(name, help, labelNames)
+	r.register(c)
+	return c
+}
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return DefaultRegistry.NewCounter(name, help, labelNames...)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s can not decrease", c.metricName))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counts[c.key(labelValues)] += v
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[c.lookup(labelValues)]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, c.labels(key, "", ""), formatValue(c.counts[key]))
+	}
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	series
+	gauges map[string]float64
+}
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{
+		gauges: make(map[string]float64, 0),
+	}
+	g.init(name, help, labelNames)
+	r.register(g)
+	return g
+}
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	return DefaultRegistry.NewGauge(name, help, labelNames...)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.gauges[g.key(labelValues)] = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.gauges[g.key(labelValues)] += v
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.gauges[g.lookup(labelValues)]
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, g.labels(key, "", ""), formatValue(g.gauges[key]))
+	}
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	series
+	buckets []float64
+	counts map[string][]uint64 // per bucket, not cumulative
+	sums map[string]float64
+	totals map[string]uint64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{
+		buckets: sorted,
+		counts: make(map[string][]uint64, 0),
+		sums: make(map[string]float64, 0),
+		totals: make(map[string]uint64, 0),
+	}
+	h.init(name, help, labelNames)
+	r.register(h)
+	return h
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return DefaultRegistry.NewHistogram(name, help, buckets, labelNames...)
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := h.key(labelValues)
+	if _, ok := h.counts[key]; !ok {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			h.counts[key][i]++
+			break
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.totals[h.lookup(labelValues)]
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range h.sortedKeys() {
+		cumulative := uint64(0)
+		for i, upperBound := range h.buckets {
+			if counts, ok := h.counts[key]; ok {
+				cumulative += counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labels(key, "le", formatValue(upperBound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labels(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labels(key, "", ""), formatValue(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labels(key, "", ""), h.totals[key])
+	}
+}
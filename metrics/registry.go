@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"bft/logging"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the Prometheus text exposition format version 0.0.4
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets fit latencies in seconds, from half a millisecond to ten seconds
+var DefaultBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// DefaultRegistry holds the node's metrics, it is served on /metrics
+var DefaultRegistry = NewRegistry()
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mutex sync.Mutex
+	metrics []metric
+	names map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make([]metric, 0),
+		names: make(map[string]bool, 0),
+	}
+}
+
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[m.name()] {
+		panic(fmt.Sprintf("metric %s is registered twice", m.name()))
+	}
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the text exposition format, in registration order
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	if _, err := r.WriteTo(w); err != nil {
+		logging.Default().Debug("can not write metrics", logging.Module("metrics"), logging.Err(err))
+	}
+}
+
+// series keeps the values of a metric per combination of label values
+type series struct {
+	mutex sync.Mutex
+	metricName string
+	help string
+	labelNames []string
+	values map[string][]string // key of label values -> label values
+}
+
+func (s *series) init(name, help string, labelNames []string) {
+	s.metricName = name
+	s.help = help
+	s.labelNames = labelNames
+	s.values = make(map[string][]string, 0)
+	// a metric without labels is exposed from the start
+	if len(labelNames) == 0 {
+		s.values[""] = []string{}
+	}
+}
+
+func (s *series) name() string {
+	return s.metricName
+}
+
+func (s *series) lookup(labelValues []string) string {
+	if len(labelValues) != len(s.labelNames) {
+		panic(fmt.Sprintf("metric %s expects labels %v, got values %v", s.metricName, s.labelNames, labelValues))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// key adds the label values to the series, it must be called with the mutex held
+func (s *series) key(labelValues []string) string {
+	key := s.lookup(labelValues)
+	if _, ok := s.values[key]; !ok {
+		s.values[key] = append([]string{}, labelValues...)
+	}
+	return key
+}
+
+// sortedKeys must be called with the mutex held
+func (s *series) sortedKeys() []string {
+	keys := make([]string, 0)
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *series) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", s.metricName, escapeHelp(s.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.metricName, metricType)
+}
+
+func (s *series) labels(key string, extraName string, extraValue string) string {
+	pairs := make([]string, 0)
+	for i, value := range s.values[key] {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", s.labelNames[i], escapeLabelValue(value)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapeLabelValue(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"").Replace(value)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestRegistry_Exposition(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("test_messages_total", "Messages by type.\nSecond line with \\.", "type")
+	gauge := r.NewGauge("test_height", "Height.")
+	histogram := r.NewHistogram("test_latency_seconds", "Latency.", []float64{1, 0.1}, "op")
+	counter.Inc("Vote")
+	counter.Add(2.5, "Vote")
+	counter.Inc("say \"hi\"\n")
+	gauge.Set(math.Inf(1))
+	histogram.Observe(0.05, "get")
+	histogram.Observe(0.5, "get")
+	histogram.Observe(3, "get")
+	expected := `# HELP test_messages_total Messages by type.\nSecond line with \\.
+# TYPE test_messages_total counter
+test_messages_total{type="Vote"} 3.5
+test_messages_total{type="say \"hi\"\n"} 1
+# HELP test_height Height.
+# TYPE test_height gauge
+test_height +Inf
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="get",le="0.1"} 1
+test_latency_seconds_bucket{op="get",le="1"} 2
+test_latency_seconds_bucket{op="get",le="+Inf"} 3
+test_latency_seconds_sum{op="get"} 3.55
+test_latency_seconds_count{op="get"} 3
+`
+	buf := &bytes.Buffer{}
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestRegistry_UnlabeledMetricsStartAtZero(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Total.")
+	r.NewHistogram("test_seconds", "Seconds.", []float64{1})
+	expected := `# HELP test_total Total.
+# TYPE test_total counter
+test_total 0
+# HELP test_seconds Seconds.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 0
+test_seconds_bucket{le="+Inf"} 0
+test_seconds_sum 0
+test_seconds_count 0
+`
+	buf := &bytes.Buffer{}
+	r.WriteTo(buf)
+	if buf.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, buf.String())
+	}
+}
+
+func TestRegistry_DuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_gauge", "Gauge.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice should panic")
+		}
+	}()
+	r.NewCounter("test_gauge", "Counter.")
+}
@@ -5,7 +5,7 @@ import (
 	"bufio"
 	"sync"
 	"fmt"
-	"log"
+	"bft/logging"
 	"github.com/libp2p/go-libp2p-net"
 	"bft/encoding"
 	"strings"
@@ -20,21 +20,31 @@ type Connection struct {
 	readWriter *bufio.ReadWriter
 	lastHeightId types.BlockHeightId
 	syncing bool
-	lastReceivedHandshake *types.Handshake
+	nonce types.Hash // challenge sent in every handshake on this connection
+	lastReceivedHandshake *types.Handshake // set only once the remote peer answered our challenge
 	lastSentHandshake *types.Handshake
 	onReceive ReceiveFunc
 	onFinish FinishFunc
+	logger logging.Logger
 }
 
-func newConnection(stream net.Stream, onReceive ReceiveFunc, onFinish FinishFunc) *Connection {
+// newConnection fails when no challenge can be drawn for the connection, the handshakes on it could be replayed
+func newConnection(stream net.Stream, onReceive ReceiveFunc, onFinish FinishFunc, logger logging.Logger) (*Connection, error) {
 	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	logger = logger.With(logging.Peer(stream.Conn().RemotePeer().String()))
+	nonce, err := types.NewNonce()
+	if err != nil {
+		return nil, fmt.Errorf("can not create nonce: %w", err)
+	}
 	return &Connection{
 		stream:stream,
 		readWriter:rw,
 		syncing:false,
+		nonce:nonce,
 		onReceive:onReceive,
 		onFinish:onFinish,
-	}
+		logger:logger,
+	}, nil
 }
 
 func (c *Connection) Send(message types.Message) error {
@@ -46,6 +56,8 @@ func (c *Connection) Send(message types.Message) error {
 	c.readWriter.WriteString(fmt.Sprintf("%s\n", string(buf)))
 	c.readWriter.Flush()
 	c.mutex.Unlock()
+	messagesSent.Inc(message.Type.String())
+	bytesSent.Add(float64(len(buf) + 1), message.Type.String())
 	return err
 }
 
@@ -94,8 +106,13 @@ func (c *Connection) readLoop() {
 			message := types.Message{}
 			err = encoding.UnmarshalBinary(buf, &message)
 			if err != nil {
-				log.Fatal(err)
+				// a peer which sends garbage is disconnected
+				c.logger.Warn("unable to parse message", logging.Err(err))
+				c.onFinish(c)
+				return
 			}
+			messagesReceived.Inc(message.Type.String())
+			bytesReceived.Add(float64(len(str) + 1), message.Type.String())
 			c.onReceive(message, c)
 		}
 	}
@@ -8,20 +8,19 @@ import (
 	"fmt"
 	"context"
 	"github.com/libp2p/go-libp2p-net"
-	"log"
+	"bft/logging"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/libp2p/go-libp2p-protocol"
 	"github.com/libp2p/go-libp2p-peer"
 	"github.com/libp2p/go-libp2p-peerstore"
 	"os"
 	"io/ioutil"
-	"strconv"
 	"bft/consensus"
 	"bft/types"
 	"sync"
 	"bft/database"
 	"bft/encoding"
-	crypto2 "bft/crypto"
+	"bft/events"
 )
 
 type NetManager struct {
@@ -34,39 +33,34 @@ type NetManager struct {
 	keyPair			types.KeyPair
 	address			string
 	chainId 		types.Hash
+	blockStore		*database.BlockStore
+	skewWindow		types.SkewWindow
 	consensusManager *consensus.ConsensusManager
 	synchonizer		*Synchronizer
 	dispatcher		*Dispatcher
+	eventBus		*events.EventBus
+	logger			logging.Logger
 }
 
-func NewNetManager(ipAddress string, listenPort int, targets []string) *NetManager {
+// NewNetManager creates the libp2p host with the identity stored in identityFile, a new identity is generated
+// if the file does not exist. keyPair is the validator key which signs handshakes.
+func NewNetManager(ipAddress string, listenPort int, targets []string, identityFile string, keyPair types.KeyPair, blockStore *database.BlockStore) (*NetManager, error) {
 	netManager := &NetManager{
 		ipAddress:		ipAddress,
 		listenPort:		listenPort,
 		targets:		targets,
 		connections:	make(map[string]*Connection),
-		chainId: 		database.GetBlockStore().ChainId(),
-		synchonizer:	NewSynchronizer(),
-	}
-	////TODO: get initial validators
-	//validators := types.Validators{}
-	//enDecoder := types.EnDecoder{
-	//	encoding.MarshalBinary,
-	//	encoding.UnmarshalBinary,
-	//}
-	////TODO: load key pair from wallet
-	privateKey, _ := crypto2.NewRandomPrivateKey()
-	netManager.keyPair.PrivateKey = *privateKey
-	netManager.keyPair.PublicKey = *privateKey.PublicKey()
-	//signer := netManager.keyPair.PrivateKey.Sign
-	//address := netManager.keyPair.PublicKey.Address()
-	//netManager.consensusManager = consensus.NewConsensusManager(validators, address)
-	//netManager.consensusManager.SetEnDecoder(enDecoder)
-	//netManager.consensusManager.SetSigner(signer)
-	//netManager.consensusManager.SetBroadcaster(netManager.broadcast)
-	priv, err := loadIdentity(types.HostIdentity + strconv.Itoa(listenPort))
-	if err != nil {
-		return nil
+		keyPair:		keyPair,
+		address:		keyPair.PublicKey.Address(),
+		chainId: 		blockStore.GenesisHash(),
+		blockStore:		blockStore,
+		skewWindow:		types.DefaultSkewWindow(),
+		synchonizer:	NewSynchronizer(blockStore),
+		logger:			logging.Default().With(logging.Module("network")),
+	}
+	priv, err := loadIdentity(identityFile)
+	if err != nil {
+		return nil, err
 	}
 	opts := []libp2p.Option{
 		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/%s/tcp/%d", ipAddress, listenPort)),
@@ -74,22 +68,60 @@ func NewNetManager(ipAddress string, listenPort int, targets []string) *NetManag
 	}
 	host, err := libp2p.New(context.Background(), opts...)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	hostAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ipfs/%s", host.ID().Pretty()))
 	addr := host.Addrs()[0]
 	fullAddr := addr.Encapsulate(hostAddr)
-	log.Printf("address: %s", fullAddr)
+	netManager.logger.Info("listening", logging.F("address", fullAddr))
 	netManager.host = host
-	return netManager
+	return netManager, nil
 }
 
-func (nm *NetManager) Run() {
+// SetConsensusManager passes consensus messages to consensusManager and broadcasts the messages it sends
+func (nm *NetManager) SetConsensusManager(consensusManager *consensus.ConsensusManager) {
+	nm.consensusManager = consensusManager
+	consensusManager.SetBroadcaster(nm.broadcast)
+}
+
+// SetSkewWindow sets how much clock drift is tolerated in handshakes, in both directions
+func (nm *NetManager) SetSkewWindow(window types.SkewWindow) {
+	nm.skewWindow = window
+}
+
+func (nm *NetManager) SetLogger(logger logging.Logger) {
+	nm.logger = logger
+}
+
+// Synchronizer catches up with peers which have a higher head
+func (nm *NetManager) Synchronizer() *Synchronizer {
+	return nm.synchonizer
+}
+
+// SetEventBus publishes peer connections and disconnections to the bus
+func (nm *NetManager) SetEventBus(eventBus *events.EventBus) {
+	nm.eventBus = eventBus
+}
+
+func (nm *NetManager) SyncState() SyncState {
+	return nm.synchonizer.State()
+}
+
+// Start accepts inbound peers and connects to the configured ones
+func (nm *NetManager) Start() {
 	nm.listen()
 	nm.addPeers(nm.targets)
+}
+
+func (nm *NetManager) Run() {
+	nm.Start()
 	select {}
 }
 
+func (nm *NetManager) Close() error {
+	return nm.host.Close()
+}
+
 func (nm *NetManager) listen() {
 	pid := protocol.ID(types.P2P + types.NetworkVersion)
 	nm.host.SetStreamHandler(pid, nm.handleInStream)
@@ -102,17 +134,27 @@ func (nm *NetManager) addPeers(targets []string) {
 }
 
 func (nm *NetManager) handleInStream(s net.Stream) {
-	conn := newConnection(s, nm.onReceive, nm.removeConnection)
-	log.Printf("connected to inbound %s\n", conn.RemotePeerId())
+	conn, err := newConnection(s, nm.onReceive, nm.removeConnection, nm.logger)
+	if err != nil {
+		nm.logger.Error("dropping inbound peer", logging.Peer(s.Conn().RemotePeer().String()), logging.Err(err))
+		s.Close()
+		return
+	}
+	nm.logger.Info("connected to inbound peer", logging.Peer(conn.RemotePeerId()))
 	nm.addConnection(conn)
 	conn.Start()
 }
 
 func (nm *NetManager) handleOutStream(s net.Stream) {
-	conn := newConnection(s, nm.onReceive, nm.removeConnection)
-	log.Printf("connected to outbound %s\n", conn.RemotePeerId())
+	conn, err := newConnection(s, nm.onReceive, nm.removeConnection, nm.logger)
+	if err != nil {
+		nm.logger.Error("dropping outbound peer", logging.Peer(s.Conn().RemotePeer().String()), logging.Err(err))
+		s.Close()
+		return
+	}
+	nm.logger.Info("connected to outbound peer", logging.Peer(conn.RemotePeerId()))
 	nm.addConnection(conn)
-	nm.sendHandshake(conn)
+	nm.sendHandshake(conn, types.Hash{})
 	conn.Start()
 }
 
@@ -120,10 +162,37 @@ func (nm *NetManager) onReceive(message types.Message, connection *Connection) {
 	messageType := message.Type
 	switch messageType {
 	case types.HandshakeMessage:
-		handshake := message.ToHandshake(encoding.UnmarshalBinary)
+		handshake, err := message.ToHandshake(encoding.UnmarshalBinary)
+		if err != nil {
+			nm.logger.Warn("unable to parse handshake", logging.Peer(connection.RemotePeerId()), logging.Err(err))
+			return
+		}
 		nm.handleHandshake(handshake, connection)
-	case types.VoteMessage, types.ProposalMessage:
-		nm.consensusManager.Receive(message)
+	case types.VoteMessage, types.ProposalMessage, types.TransactionMessage:
+		if nm.consensusManager != nil {
+			nm.consensusManager.Receive(message)
+		}
+	case types.SyncRequestMessage:
+		syncRequest := message.ToSyncRequest(encoding.UnmarshalBinary)
+		if syncRequest == nil {
+			nm.logger.Warn("unable to parse sync request", logging.Peer(connection.RemotePeerId()))
+			return
+		}
+		nm.synchonizer.handleSyncRequest(syncRequest, connection)
+	case types.BlockMessage:
+		block, err := message.ToBlock(encoding.UnmarshalBinary)
+		if err != nil {
+			nm.logger.Warn("unable to parse block", logging.Peer(connection.RemotePeerId()), logging.Err(err))
+			return
+		}
+		nm.synchonizer.handleBlock(block, connection)
+	case types.SyncErrorMessage:
+		syncError, err := message.ToSyncError(encoding.UnmarshalBinary)
+		if err != nil {
+			nm.logger.Warn("unable to parse sync error", logging.Peer(connection.RemotePeerId()), logging.Err(err))
+			return
+		}
+		nm.synchonizer.handleSyncError(syncError, connection)
 	}
 }
 
@@ -136,27 +205,27 @@ func (nm *NetManager) broadcast(message types.Message) {
 func (nm *NetManager) addPeer(peerAddress string) {
 	fullAddr, err := multiaddr.NewMultiaddr(peerAddress)
 	if err != nil {
-		log.Println(err)
+		nm.logger.Error("invalid peer address", logging.F("address", peerAddress), logging.Err(err))
 		return
 	}
 	pid, err := fullAddr.ValueForProtocol(multiaddr.P_IPFS)
 	if err != nil {
-		log.Println(err)
+		nm.logger.Error("peer address has no peer id", logging.F("address", peerAddress), logging.Err(err))
 		return
 	}
 	peerId, err := peer.IDB58Decode(pid)
 	if err != nil {
-		log.Println(err)
+		nm.logger.Error("invalid peer id", logging.Peer(pid), logging.Err(err))
 		return
 	}
 	ipfsPart, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ipfs/%s", peer.IDB58Encode(peerId)))
 	targetAddr := fullAddr.Decapsulate(ipfsPart)
 	nm.host.Peerstore().AddAddr(peerId, targetAddr, peerstore.PermanentAddrTTL)
-	log.Println("opening stream")
+	nm.logger.Debug("opening stream", logging.Peer(pid))
 	protocolId := protocol.ID(types.P2P + types.NetworkVersion)
 	stream, err := nm.host.NewStream(context.Background(), peerId, protocolId)
 	if err != nil {
-		log.Println(err)
+		nm.logger.Warn("can not open stream", logging.Peer(pid), logging.Err(err))
 		return
 	}
 	nm.handleOutStream(stream)
@@ -165,64 +234,117 @@ func (nm *NetManager) addPeer(peerAddress string) {
 func (nm *NetManager) addConnection(c *Connection) {
 	nm.mutex.Lock()
 	nm.connections[c.RemotePeerId()] = c
+	peersGauge.Set(float64(len(nm.connections)))
 	nm.mutex.Unlock()
+	nm.eventBus.Publish(events.PeerConnected, events.PeerEvent{PeerId: c.RemotePeerId()})
 }
 
 func (nm *NetManager) removeConnection(c *Connection) {
 	nm.mutex.Lock()
-	log.Println("disconnected peer from address ", c.RemotePeerId())
+	nm.logger.Info("disconnected peer", logging.Peer(c.RemotePeerId()))
 	c.Close()
 	delete(nm.connections, c.RemotePeerId())
+	peersGauge.Set(float64(len(nm.connections)))
 	nm.mutex.Unlock()
+	nm.eventBus.Publish(events.PeerDisconnected, events.PeerEvent{PeerId: c.RemotePeerId()})
 }
 
-func (nm *NetManager) sendHandshake(c *Connection) {
-	blockStore := database.GetBlockStore()
-	lastHeightId := blockStore.Head().Header().HeightId
+// sendHandshake sends our challenge to the remote peer. remoteNonce is the remote peer's challenge that we answer,
+// it is empty when we open the handshake
+func (nm *NetManager) sendHandshake(c *Connection, remoteNonce types.Hash) {
+	head, err := nm.blockStore.Head()
+	if err != nil {
+		nm.logger.Error("can not load head", logging.Err(err))
+		return
+	}
+	lastHeightId := head.Header().HeightId
 	signer := nm.keyPair.PrivateKey.Sign
 	encoder := encoding.MarshalBinary
-	handshake := types.NewHandshake(nm.chainId, nm.address, lastHeightId, signer, encoder)
-	if handshake == nil {
+	handshake, err := types.NewHandshake(nm.chainId, nm.address, c.RemotePeerId(), lastHeightId, c.nonce, remoteNonce, signer, encoder)
+	if err != nil {
+		nm.logger.Error("can not create handshake", logging.Err(err))
 		return
 	}
 	payload, err := encoding.MarshalBinary(*handshake)
 	if err != nil {
-		log.Println(err)
+		nm.logger.Error("can not encode handshake", logging.Err(err))
 		return
 	}
 	message := types.NewMessage(types.HandshakeMessage, payload)
 	c.Send(message)
-	log.Println("sent handshake")
+	c.lastSentHandshake = handshake
+	nm.logger.Debug("sent handshake", logging.Peer(c.RemotePeerId()), logging.Height(lastHeightId.Height))
 }
 
 func (nm *NetManager) handleHandshake(handshake *types.Handshake, connection *Connection) {
-	log.Println("received handshake")
+	logger := nm.logger.With(logging.Peer(connection.RemotePeerId()))
 	if handshake == nil {
-		log.Println("unable to parse handshake")
+		logger.Warn("unable to parse handshake")
 		return
 	}
-	if !handshake.IsValid() {
-		log.Println("handshake message is invalid")
+	logger.Debug("received handshake", logging.Height(handshake.Height()))
+	if err := handshake.Validate(); err != nil {
+		logger.Warn("handshake message is invalid", logging.Err(err))
 		return
 	}
 	if !nm.chainId.Equals(handshake.ChainId) {
-		log.Println("local chain id and remote chain id are not the same")
+		logger.Warn("local chain id and remote chain id are not the same", logging.F("chain_id", handshake.ChainId.String()))
 		return
 	}
 	if handshake.NetworkVersion != types.NetworkVersion {
-		log.Println("network version does not match")
+		logger.Warn("network version does not match", logging.F("version", handshake.NetworkVersion))
 		return
 	}
-	if !handshake.Verify() {
-		log.Println("handshake is not verified")
+	if err := handshake.Verify(connection.LocalPeerId(), nm.skewWindow, encoding.MarshalBinary); err != nil {
+		logger.Warn("handshake is not verified", logging.Err(err))
 		return
 	}
-	if connection.lastSentHandshake == nil {
-		log.Println("should send handshake")
-		nm.sendHandshake(connection)
+	// answer the remote challenge unless it has been answered already
+	if connection.lastSentHandshake == nil || !connection.lastSentHandshake.RemoteNonce.Equals(handshake.Nonce) {
+		logger.Debug("should send handshake")
+		nm.sendHandshake(connection, handshake.Nonce)
+	}
+	if handshake.IsOpening() {
+		logger.Debug("waiting for the answer to our challenge")
+		return
+	}
+	// a replayed handshake can not answer the challenge of a new connection
+	if !handshake.RemoteNonce.Equals(connection.nonce) {
+		logger.Warn("handshake does not answer our challenge")
+		return
 	}
 	connection.lastReceivedHandshake = handshake
-	//nm.synchonizer.handleHandshake(handshake, connection)
+	nm.synchonizer.handleHandshake(handshake, connection)
+}
+
+// PeerId returns the libp2p peer id of the identity stored in fileName
+func PeerId(fileName string) (string, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	priv, err := crypto.UnmarshalPrivateKey(b)
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return id.Pretty(), nil
+}
+
+// GenerateIdentity writes a new libp2p identity to fileName and returns its peer id
+func GenerateIdentity(fileName string) (string, error) {
+	priv, err := generateNewIdentity(fileName)
+	if err != nil {
+		return "", err
+	}
+	id, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	return id.Pretty(), nil
 }
 
 func loadIdentity(fileName string) (crypto.PrivKey, error) {
@@ -245,7 +367,7 @@ func generateNewIdentity(fileName string) (crypto.PrivKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = ioutil.WriteFile(fileName, b, 0644)
+	err = ioutil.WriteFile(fileName, b, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,12 @@
+package network
+
+import "bft/metrics"
+
+var (
+	peersGauge = metrics.NewGauge("bft_network_peers", "Connected peers.")
+	messagesReceived = metrics.NewCounter("bft_network_messages_received_total", "Messages received from peers.", "message_type")
+	bytesReceived = metrics.NewCounter("bft_network_received_bytes_total", "Bytes received from peers.", "message_type")
+	messagesSent = metrics.NewCounter("bft_network_messages_sent_total", "Messages sent to peers.", "message_type")
+	bytesSent = metrics.NewCounter("bft_network_sent_bytes_total", "Bytes sent to peers.", "message_type")
+	syncLag = metrics.NewGauge("bft_sync_lag_blocks", "Blocks between the highest height announced by peers and the local head.")
+)
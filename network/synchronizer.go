@@ -2,9 +2,11 @@ package network
 
 import (
 	"bft/database"
-	"log"
+	"bft/logging"
 	"bft/types"
 	"bft/encoding"
+	"errors"
+	"fmt"
 )
 
 type SyncState uint8
@@ -26,21 +28,33 @@ func (syncState SyncState) String() string {
 }
 
 type Synchronizer struct {
+	blockStore *database.BlockStore
 	knownHeight uint64
 	lastRequestedHeight uint64
 	expectedHeight uint64
 	state SyncState
+	logger logging.Logger
 }
 
-func NewSynchronizer() *Synchronizer {
+func NewSynchronizer(blockStore *database.BlockStore) *Synchronizer {
 	return &Synchronizer{
+		blockStore:blockStore,
 		knownHeight:0,
 		lastRequestedHeight:0,
 		expectedHeight:1,
 		state:InSync,
+		logger:logging.Default().With(logging.Module("sync")),
 	}
 }
 
+func (s *Synchronizer) SetLogger(logger logging.Logger) {
+	s.logger = logger
+}
+
+func (s *Synchronizer) State() SyncState {
+	return s.state
+}
+
 func (s *Synchronizer) setState(state SyncState) {
 	if s.state == state {
 		return
@@ -48,15 +62,32 @@ func (s *Synchronizer) setState(state SyncState) {
 	s.state = state
 }
 
+// updateSyncLag exposes how far the local head is behind the highest height announced by peers
+func (s *Synchronizer) updateSyncLag() {
+	lastHeight, err := s.blockStore.LastHeight()
+	if err != nil {
+		s.logger.Error("can not load last height", logging.Err(err))
+		return
+	}
+	if s.knownHeight > lastHeight {
+		syncLag.Set(float64(s.knownHeight - lastHeight))
+	} else {
+		syncLag.Set(0)
+	}
+}
+
 func (s *Synchronizer) requestBlocks(c *Connection) {
-	blockStore := database.GetBlockStore()
-	lastHeight := blockStore.LastHeight()
+	lastHeight, err := s.blockStore.LastHeight()
+	if err != nil {
+		s.logger.Error("can not load last height", logging.Err(err))
+		return
+	}
 	if lastHeight < s.lastRequestedHeight && c.IsAvailable() {
 		return
 	}
 	if !c.IsAvailable() {
-		log.Println("This connection is not available to sync")
-		s.knownHeight = blockStore.LastHeight()
+		s.logger.Info("connection is not available to sync", logging.Peer(c.RemotePeerId()))
+		s.knownHeight = lastHeight
 		s.lastRequestedHeight = 0
 		s.setState(InSync)
 		return
@@ -64,6 +95,9 @@ func (s *Synchronizer) requestBlocks(c *Connection) {
 	if s.lastRequestedHeight != s.knownHeight {
 		start := s.expectedHeight
 		end := s.knownHeight
+		if end >= start && end - start >= types.MaxSyncBlocks {
+			end = start + types.MaxSyncBlocks - 1
+		}
 		if end > 0 && end >= start {
 			s.sendSyncRequest(c, start, end)
 			s.lastRequestedHeight = end
@@ -78,9 +112,10 @@ func (s *Synchronizer) sendSyncRequest(c *Connection, start, end uint64) {
 	}
 	payload, err := encoding.MarshalBinary(syncRequest)
 	if err != nil {
-		log.Println(err)
+		s.logger.Error("can not encode sync request", logging.Err(err))
 		return
 	}
+	s.logger.Debug("request blocks", logging.Peer(c.RemotePeerId()), logging.F("start", start), logging.F("end", end))
 	message := types.NewMessage(types.SyncRequestMessage, payload)
 	c.Send(message)
 }
@@ -93,16 +128,15 @@ func (s *Synchronizer) updateKnownHeight(connection *Connection) {
 	}
 }
 
-func (s *Synchronizer) shouldSync() bool {
-	blockStore := database.GetBlockStore()
-	return s.lastRequestedHeight < s.knownHeight || blockStore.LastHeight() < s.lastRequestedHeight
+func (s *Synchronizer) shouldSync(localLastHeight uint64) bool {
+	return s.lastRequestedHeight < s.knownHeight || localLastHeight < s.lastRequestedHeight
 }
 
 func (s *Synchronizer) startSync(connection *Connection, localLastHeight uint64, remoteLastHeight uint64) {
 	if remoteLastHeight > s.knownHeight {
 		s.knownHeight = remoteLastHeight
 	}
-	if !s.shouldSync() {
+	if !s.shouldSync(localLastHeight) {
 		return
 	}
 	if s.state == InSync {
@@ -113,15 +147,116 @@ func (s *Synchronizer) startSync(connection *Connection, localLastHeight uint64,
 }
 
 func (s *Synchronizer) handleHandshake(handshake *types.Handshake, connection *Connection) {
-	blockStore := database.GetBlockStore()
-	localLastHeight := blockStore.LastHeight()
+	localLastHeight, err := s.blockStore.LastHeight()
+	if err != nil {
+		s.logger.Error("can not load last height", logging.Err(err))
+		return
+	}
 	remoteLastHeight := handshake.LastHeightId.Height
 	s.updateKnownHeight(connection)
 	connection.Sync(false)
 	if localLastHeight < remoteLastHeight {
 		s.startSync(connection, localLastHeight, remoteLastHeight)
+	}
+	s.updateSyncLag()
+}
+
+// handleSyncRequest sends the requested blocks that the local chain has, at most types.MaxSyncBlocks of them.
+// The requester asks for the following blocks once it has stored these. A block which can not be sent ends the
+// response with a sync error.
+func (s *Synchronizer) handleSyncRequest(request *types.SyncRequest, c *Connection) {
+	lastHeight, err := s.blockStore.LastHeight()
+	if err != nil {
+		s.logger.Error("can not load last height", logging.Err(err))
+		return
+	}
+	end := request.EndHeight
+	if end > lastHeight {
+		end = lastHeight
+	}
+	if end >= request.StartHeight && end - request.StartHeight >= types.MaxSyncBlocks {
+		end = request.StartHeight + types.MaxSyncBlocks - 1
+	}
+	for height := request.StartHeight; height <= end; height++ {
+		block, err := s.blockStore.GetBlockFromHeight(height)
+		if errors.Is(err, database.ErrNotFound) {
+			s.logger.Info("requested block is pruned", logging.Peer(c.RemotePeerId()), logging.Height(height))
+			s.sendSyncError(c, request, fmt.Sprintf("block %d is pruned", height))
+			return
+		}
+		if err != nil {
+			s.logger.Error("can not load requested block", logging.Height(height), logging.Err(err))
+			s.sendSyncError(c, request, fmt.Sprintf("can not load block %d", height))
+			return
+		}
+		payload, err := encoding.MarshalBinary(*block)
+		if err != nil {
+			s.logger.Error("can not encode block", logging.Height(height), logging.Err(err))
+			s.sendSyncError(c, request, fmt.Sprintf("can not encode block %d", height))
+			return
+		}
+		c.Send(types.NewMessage(types.BlockMessage, payload))
+	}
+}
+
+// sendSyncError tells the requester why its request is not served and from which height the blocks are kept
+func (s *Synchronizer) sendSyncError(c *Connection, request *types.SyncRequest, reason string) {
+	syncError := types.SyncError{
+		StartHeight: request.StartHeight,
+		EndHeight: request.EndHeight,
+		Reason: reason,
+	}
+	if blocks, _, err := s.blockStore.Pruned(); err != nil {
+		s.logger.Error("can not load pruned heights", logging.Err(err))
+	} else if !blocks.Empty() {
+		syncError.BaseHeight = blocks.To + 1
+	} else {
+		syncError.BaseHeight = 2
+	}
+	payload, err := encoding.MarshalBinary(syncError)
+	if err != nil {
+		s.logger.Error("can not encode sync error", logging.Err(err))
 		return
 	}
+	c.Send(types.NewMessage(types.SyncErrorMessage, payload))
 }
 
+// handleSyncError stops the catchup from a peer which can not serve the requested blocks, the next handshake of a
+// peer which is ahead starts it again
+func (s *Synchronizer) handleSyncError(syncError *types.SyncError, c *Connection) {
+	s.logger.Warn("peer can not serve blocks", logging.Peer(c.RemotePeerId()), logging.F("start", syncError.StartHeight), logging.F("end", syncError.EndHeight), logging.F("base", syncError.BaseHeight), logging.F("reason", syncError.Reason))
+	if s.state != Catchup || syncError.EndHeight != s.lastRequestedHeight {
+		return
+	}
+	lastHeight, err := s.blockStore.LastHeight()
+	if err != nil {
+		s.logger.Error("can not load last height", logging.Err(err))
+		return
+	}
+	s.knownHeight = lastHeight
+	s.lastRequestedHeight = 0
+	s.setState(InSync)
+	s.updateSyncLag()
+}
 
+func (s *Synchronizer) handleBlock(block *types.Block, c *Connection) {
+	if err := s.blockStore.VerifyNext(block); err != nil {
+		s.logger.Warn("invalid synced block", logging.Peer(c.RemotePeerId()), logging.Height(block.Height()), logging.Err(err))
+		return
+	}
+	if err := s.blockStore.AddBlock(block); err != nil {
+		s.logger.Error("can not store synced block", logging.Height(block.Height()), logging.Err(err))
+		return
+	}
+	s.expectedHeight = block.Height() + 1
+	s.updateSyncLag()
+	if block.Height() >= s.knownHeight {
+		s.logger.Info("synchronized", logging.Height(block.Height()), logging.F("id", block.Id().String()))
+		s.lastRequestedHeight = 0
+		s.setState(InSync)
+		return
+	}
+	if block.Height() == s.lastRequestedHeight {
+		s.requestBlocks(c)
+	}
+}
@@ -0,0 +1,34 @@
+package node
+
+import (
+	"bft/config"
+	"bft/network"
+	"bft/types"
+	"fmt"
+	"os"
+)
+
+// InitHome writes the config, a new validator key and a new libp2p identity to the home directory of cfg.
+// It returns the validator with voting power 1 and the peer id.
+func InitHome(cfg *config.Config) (types.Validator, string, error) {
+	if _, err := os.Stat(cfg.File()); err == nil {
+		return types.Validator{}, "", fmt.Errorf("%s is existing", cfg.File())
+	}
+	if err := cfg.Save(); err != nil {
+		return types.Validator{}, "", err
+	}
+	privateKey, err := GenerateKey(cfg.KeyPath(), false)
+	if err != nil {
+		return types.Validator{}, "", err
+	}
+	peerId, err := network.GenerateIdentity(cfg.IdentityPath())
+	if err != nil {
+		return types.Validator{}, "", err
+	}
+	validator := types.Validator{
+		Address: privateKey.PublicKey().Address(),
+		PublicKey: *privateKey.PublicKey(),
+		VotingPower: 1,
+	}
+	return validator, peerId, nil
+}
@@ -0,0 +1,33 @@
+package node
+
+import (
+	"bft/crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// LoadKey reads the validator private key stored in WIF
+func LoadKey(fileName string) (*crypto.PrivateKey, error) {
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewPrivateKey(strings.TrimSpace(string(b)))
+}
+
+// GenerateKey writes a new validator private key to fileName, an existing key is only replaced if overwrite is set
+func GenerateKey(fileName string, overwrite bool) (*crypto.PrivateKey, error) {
+	if _, err := os.Stat(fileName); err == nil && !overwrite {
+		return nil, fmt.Errorf("key file %s is existing", fileName)
+	}
+	privateKey, err := crypto.NewRandomPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fileName, []byte(privateKey.String() + "\n"), 0600); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
@@ -0,0 +1,141 @@
+package node
+
+import (
+	"bft/config"
+	"bft/consensus"
+	"bft/database"
+	"bft/events"
+	"bft/logging"
+	"bft/network"
+	"bft/rpc"
+	"bft/types"
+	"net"
+	"net/http"
+)
+
+// Node wires the block store, consensus, network and rpc server of a validator
+type Node struct {
+	config *config.Config
+	keyPair types.KeyPair
+	blockStore *database.BlockStore
+	pruner *database.Pruner
+	consensusManager *consensus.ConsensusManager
+	netManager *network.NetManager
+	rpcServer *rpc.Server
+	rpcListener net.Listener
+	eventBus *events.EventBus
+	logger logging.Logger
+}
+
+func NewNode(cfg *config.Config) (*Node, error) {
+	if err := logging.DefaultLevels.Parse(cfg.LogLevel); err != nil {
+		return nil, err
+	}
+	privateKey, err := LoadKey(cfg.KeyPath())
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		config: cfg,
+		keyPair: types.KeyPair{
+			PrivateKey: *privateKey,
+			PublicKey: *privateKey.PublicKey(),
+		},
+		eventBus: events.NewEventBus(),
+		logger: logging.Default().With(logging.Module("node")),
+	}
+	n.blockStore, err = OpenBlockStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	n.pruner = database.NewPruner(n.blockStore, cfg.RetentionPolicy())
+	n.consensusManager, err = consensus.NewConsensusManager(n.blockStore, n.keyPair.PublicKey.Address())
+	if err != nil {
+		return nil, err
+	}
+	n.consensusManager.SetSigner(privateKey.Sign)
+	n.consensusManager.SetEventBus(n.eventBus)
+	n.netManager, err = network.NewNetManager(cfg.ListenAddress, cfg.ListenPort, cfg.Peers, cfg.IdentityPath(), n.keyPair, n.blockStore)
+	if err != nil {
+		return nil, err
+	}
+	n.netManager.SetSkewWindow(cfg.SkewWindow())
+	n.netManager.SetEventBus(n.eventBus)
+	n.netManager.SetConsensusManager(n.consensusManager)
+	n.rpcServer = rpc.NewServer(n.blockStore, n.consensusManager)
+	n.rpcServer.SetEventBus(n.eventBus)
+	n.rpcServer.SetLogLevels(logging.DefaultLevels)
+	n.rpcServer.SetSyncStateFunc(func() string {
+		return n.netManager.SyncState().String()
+	})
+	return n, nil
+}
+
+// OpenBlockStore opens the database of cfg with the chain of its genesis, for the node or for offline tools
+func OpenBlockStore(cfg *config.Config) (*database.BlockStore, error) {
+	return openBlockStore(cfg, database.NewBlockStore)
+}
+
+// OpenBlockStoreForCheck opens the database of cfg as it is for verify-db, see database.OpenForCheck
+func OpenBlockStoreForCheck(cfg *config.Config) (*database.BlockStore, error) {
+	return openBlockStore(cfg, database.OpenForCheck)
+}
+
+func openBlockStore(cfg *config.Config, open func(db database.KVStore, genesis *types.Genesis) (*database.BlockStore, error)) (*database.BlockStore, error) {
+	genesis, err := types.LoadGenesis(cfg.GenesisPath())
+	if err != nil {
+		return nil, err
+	}
+	store, err := database.OpenKVStore(cfg.DBBackend, cfg.DBDir(), database.Options{Sync: cfg.DBSync})
+	if err != nil {
+		return nil, err
+	}
+	blockStore, err := open(store, genesis)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return blockStore, nil
+}
+
+func (n *Node) Address() string {
+	return n.keyPair.PublicKey.Address()
+}
+
+// Start serves rpc requests, connects to the peers and enters the first round
+func (n *Node) Start() error {
+	lastHeight, err := n.blockStore.LastHeight()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", n.config.RPCAddress)
+	if err != nil {
+		return err
+	}
+	n.rpcListener = listener
+	go func() {
+		n.logger.Info("rpc server listening", logging.F("address", n.config.RPCAddress))
+		if err := http.Serve(listener, n.rpcServer); err != nil {
+			n.logger.Info("rpc server stopped", logging.Err(err))
+		}
+	}()
+	n.netManager.Start()
+	n.consensusManager.Start()
+	n.pruner.Start()
+	n.logger.Info("node started", logging.F("chain_id", n.blockStore.ChainId()), logging.F("address", n.Address()), logging.Height(lastHeight))
+	return nil
+}
+
+func (n *Node) Stop() {
+	if n.rpcListener != nil {
+		n.rpcListener.Close()
+	}
+	if err := n.netManager.Close(); err != nil {
+		n.logger.Warn("can not close network", logging.Err(err))
+	}
+	n.pruner.Stop()
+	if err := n.blockStore.Close(); err != nil {
+		n.logger.Warn("can not close database", logging.Err(err))
+	}
+	n.logger.Info("node stopped")
+}
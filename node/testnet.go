@@ -0,0 +1,108 @@
+package node
+
+import (
+	"bft/config"
+	"bft/types"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const Procfile = "Procfile"
+const StartScript = "start.sh"
+
+type TestnetOptions struct {
+	ChainId string
+	Validators int
+	OutputDir string
+	IpAddress string
+	BasePort int // node i listens for peers on BasePort + i
+	RPCBasePort int // node i serves rpc on RPCBasePort + i
+	LogLevel string
+	Binary string // command which runs a node in the Procfile and the start script
+}
+
+func DefaultTestnetOptions() TestnetOptions {
+	return TestnetOptions{
+		ChainId: "bft-testnet",
+		Validators: 4,
+		OutputDir: "testnet",
+		IpAddress: "127.0.0.1",
+		BasePort: 2000,
+		RPCBasePort: 3000,
+		LogLevel: "info",
+		Binary: "bft",
+	}
+}
+
+// GenerateTestnet creates a home directory per validator in the output directory. All nodes share a genesis
+// which lists every validator, and every node has the others as peers. A Procfile and a start script which run
+// all nodes are written next to the home directories.
+func GenerateTestnet(options TestnetOptions) ([]*config.Config, error) {
+	if options.Validators < 1 {
+		return nil, fmt.Errorf("a testnet needs at least one validator")
+	}
+	outputDir, err := filepath.Abs(options.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+	configs := make([]*config.Config, options.Validators)
+	addresses := make([]string, options.Validators)
+	genesis := types.NewGenesis(options.ChainId, types.Validators{})
+	for i := range configs {
+		cfg := config.DefaultConfig(filepath.Join(outputDir, fmt.Sprintf("node%d", i)))
+		cfg.ListenAddress = options.IpAddress
+		cfg.ListenPort = options.BasePort + i
+		cfg.RPCAddress = fmt.Sprintf("%s:%d", options.IpAddress, options.RPCBasePort + i)
+		cfg.LogLevel = options.LogLevel
+		validator, peerId, err := InitHome(cfg)
+		if err != nil {
+			return nil, err
+		}
+		configs[i] = cfg
+		addresses[i] = fmt.Sprintf("/ip4/%s/tcp/%d/ipfs/%s", cfg.ListenAddress, cfg.ListenPort, peerId)
+		genesis.Validators = append(genesis.Validators, validator)
+	}
+	if err := genesis.Validate(); err != nil {
+		return nil, err
+	}
+	for i, cfg := range configs {
+		cfg.Peers = make([]string, 0, len(configs) - 1)
+		for j, address := range addresses {
+			if j != i {
+				cfg.Peers = append(cfg.Peers, address)
+			}
+		}
+		if err := cfg.Save(); err != nil {
+			return nil, err
+		}
+		if err := genesis.Save(cfg.GenesisPath()); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeStartFiles(outputDir, options.Binary, configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func writeStartFiles(outputDir string, binary string, configs []*config.Config) error {
+	procfile := bytes.Buffer{}
+	script := bytes.Buffer{}
+	script.WriteString("#!/bin/sh\n# starts every node of the testnet, ctrl-c stops them all\ntrap 'kill 0' INT TERM\n")
+	for i, cfg := range configs {
+		command := fmt.Sprintf("%s start --home %s", binary, cfg.Home)
+		fmt.Fprintf(&procfile, "node%d: %s\n", i, command)
+		fmt.Fprintf(&script, "%s > %s 2>&1 &\n", command, filepath.Join(cfg.Home, "node.log"))
+	}
+	script.WriteString("wait\n")
+	if err := ioutil.WriteFile(filepath.Join(outputDir, Procfile), procfile.Bytes(), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outputDir, StartScript), script.Bytes(), 0755)
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"bft/config"
+	"bft/network"
+	"bft/types"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTestnet(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "bft-testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+	options := DefaultTestnetOptions()
+	options.OutputDir = outputDir
+	configs, err := GenerateTestnet(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != options.Validators {
+		t.Fatalf("expected %d nodes, got %d", options.Validators, len(configs))
+	}
+	ports := make(map[int]bool)
+	rpcAddresses := make(map[string]bool)
+	peerIds := make([]string, len(configs))
+	var genesis *types.Genesis
+	for i, c := range configs {
+		cfg, err := config.Load(c.Home)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[cfg.ListenPort] = true
+		rpcAddresses[cfg.RPCAddress] = true
+		privateKey, err := LoadKey(cfg.KeyPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerIds[i], err = network.PeerId(cfg.IdentityPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := types.LoadGenesis(cfg.GenesisPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if genesis == nil {
+			genesis = doc
+		}
+		if len(doc.Validators) != options.Validators {
+			t.Fatalf("genesis of node %d should list %d validators, got %d", i, options.Validators, len(doc.Validators))
+		}
+		if doc.Validators[i].Address != privateKey.PublicKey().Address() || !reflect.DeepEqual(doc, genesis) {
+			t.Fatalf("genesis of node %d does not list its validator or differs from the others", i)
+		}
+	}
+	if len(ports) != options.Validators || len(rpcAddresses) != options.Validators {
+		t.Fatal("nodes should listen on distinct ports")
+	}
+	for i, cfg := range configs {
+		if len(cfg.Peers) != options.Validators - 1 {
+			t.Fatalf("node %d should have %d peers, got %v", i, options.Validators - 1, cfg.Peers)
+		}
+		for j, peerId := range peerIds {
+			expected := fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/ipfs/%s", options.BasePort + j, peerId)
+			found := false
+			for _, peer := range cfg.Peers {
+				found = found || peer == expected
+			}
+			if found != (i != j) {
+				t.Fatalf("peers of node %d are wrong: %v", i, cfg.Peers)
+			}
+		}
+	}
+	for _, name := range []string{Procfile, StartScript} {
+		b, err := ioutil.ReadFile(filepath.Join(outputDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cfg := range configs {
+			if !strings.Contains(string(b), "bft start --home " + cfg.Home) {
+				t.Fatalf("%s does not start %s", name, cfg.Home)
+			}
+		}
+	}
+}
+
+func TestGenerateTestnetRefusesExistingHome(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "bft-testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+	options := DefaultTestnetOptions()
+	options.OutputDir = outputDir
+	options.Validators = 1
+	if _, err := GenerateTestnet(options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateTestnet(options); err == nil {
+		t.Fatal("generating over an existing testnet should fail")
+	}
+}
@@ -0,0 +1,269 @@
+package rpc
+
+import (
+	"bft/database"
+	"bft/logging"
+	"bft/types"
+	"fmt"
+	"time"
+)
+
+type StatusResult struct {
+	ChainId string
+	GenesisHash types.Hash
+	Head types.BlockHeightId
+	HeadTime time.Time
+	SyncState string
+	Started bool
+	View types.View
+	StateType string
+	PendingTransactions int
+	PrunedBlocks database.HeightRange // heights whose bodies have been pruned
+	PrunedHeaders database.HeightRange // heights whose headers and commits have been pruned
+}
+
+type ValidatorsResult struct {
+	Height uint64
+	Validators types.Validators
+	TotalVotingPower uint64
+}
+
+type ConsensusParamsResult struct {
+	Height uint64
+	ConsensusParams types.ConsensusParams
+}
+
+type CommitResult struct {
+	HeightId types.BlockHeightId
+	Commits []types.Vote
+}
+
+type BlocksResult struct {
+	Blocks []*types.Block
+	Next string // cursor of the next page, empty on the last page
+}
+
+type TxResult struct {
+	Hash types.Hash
+	Height uint64
+	Index int // position in the transactions of the block
+	Tx types.Transaction
+}
+
+type BroadcastTxResult struct {
+	Hash types.Hash
+}
+
+type LogLevelResult struct {
+	Module string
+	Level string
+}
+
+// status reads the head and the pruned heights from one snapshot, a block added meanwhile can not mix them up
+func (s *Server) status(params Params) (interface{}, error) {
+	snapshot, err := s.blockStore.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+	head, err := snapshot.Head()
+	if err != nil {
+		return nil, err
+	}
+	prunedBlocks, prunedHeaders, err := snapshot.Pruned()
+	if err != nil {
+		return nil, err
+	}
+	result := StatusResult{
+		ChainId: s.blockStore.ChainId(),
+		GenesisHash: s.blockStore.GenesisHash(),
+		Head: head.Header().HeightId,
+		HeadTime: head.Header().Timestamp,
+		SyncState: "unknown",
+		Started: s.consensusManager.IsStarted(),
+		View: s.consensusManager.View(),
+		StateType: s.consensusManager.StateType().String(),
+		PendingTransactions: s.consensusManager.Mempool().Size(),
+		PrunedBlocks: prunedBlocks,
+		PrunedHeaders: prunedHeaders,
+	}
+	if s.syncState != nil {
+		result.SyncState = s.syncState()
+	}
+	return result, nil
+}
+
+func (s *Server) block(params Params) (interface{}, error) {
+	return s.getBlock(params)
+}
+
+func (s *Server) header(params Params) (interface{}, error) {
+	block, err := s.getBlock(params)
+	if err != nil {
+		return nil, err
+	}
+	return block.Header(), nil
+}
+
+// validators returns the validators of a height, by default the ones of the height in consensus
+func (s *Server) validators(params Params) (interface{}, error) {
+	height := params.Height
+	if height == 0 {
+		lastHeight, err := s.blockStore.LastHeight()
+		if err != nil {
+			return nil, err
+		}
+		height = lastHeight + 1
+	}
+	validators, err := s.blockStore.GetValidators(height)
+	if err != nil {
+		return nil, err
+	}
+	total := uint64(0)
+	for _, v := range validators {
+		total += v.VotingPower
+	}
+	return ValidatorsResult{
+		Height: height,
+		Validators: validators,
+		TotalVotingPower: total,
+	}, nil
+}
+
+// consensusParams returns the consensus params of a height, by default the ones of the height in consensus
+func (s *Server) consensusParams(params Params) (interface{}, error) {
+	height := params.Height
+	if height == 0 {
+		lastHeight, err := s.blockStore.LastHeight()
+		if err != nil {
+			return nil, err
+		}
+		height = lastHeight + 1
+	}
+	consensusParams, err := s.blockStore.GetConsensusParams(height)
+	if err != nil {
+		return nil, err
+	}
+	return ConsensusParamsResult{
+		Height: height,
+		ConsensusParams: consensusParams,
+	}, nil
+}
+
+func (s *Server) commit(params Params) (interface{}, error) {
+	block, err := s.getBlock(params)
+	if err != nil {
+		return nil, err
+	}
+	commits := block.Header().Commits
+	if commits == nil {
+		commits = make([]types.Vote, 0)
+	}
+	return CommitResult{
+		HeightId: block.Header().HeightId,
+		Commits: commits,
+	}, nil
+}
+
+// blocks pages through a height range, or the blocks of a proposer or of a time range, without scanning the chain.
+// A page is read from a snapshot, so it does not mix blocks with index keys written meanwhile.
+func (s *Server) blocks(params Params) (interface{}, error) {
+	limit := params.Limit
+	if limit < 0 || limit > types.MaxRPCPageSize {
+		return nil, newError(InvalidParams, "limit should be between 0 and %d", types.MaxRPCPageSize)
+	}
+	if limit == 0 {
+		limit = types.RPCPageSize
+	}
+	snapshot, err := s.blockStore.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+	page, err := snapshot.QueryBlocks(database.BlockQuery{
+		Start: params.Start,
+		End: params.End,
+		Proposer: params.Proposer,
+		From: params.From,
+		To: params.To,
+		Descending: params.Descending,
+		Limit: limit,
+		Cursor: params.Cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return BlocksResult{
+		Blocks: page.Blocks,
+		Next: page.Next,
+	}, nil
+}
+
+// tx finds a committed transaction by hash in the transaction index
+func (s *Server) tx(params Params) (interface{}, error) {
+	if params.Hash == "" {
+		return nil, newError(InvalidParams, "hash is missing")
+	}
+	hash, err := types.NewHash(params.Hash)
+	if err != nil {
+		return nil, newError(InvalidParams, "%v", err)
+	}
+	committed, err := s.blockStore.GetTransaction(hash)
+	if err != nil {
+		return nil, err
+	}
+	return TxResult{
+		Hash: hash,
+		Height: committed.Height,
+		Index: committed.Index,
+		Tx: committed.Tx,
+	}, nil
+}
+
+func (s *Server) broadcastTx(params Params) (interface{}, error) {
+	if len(params.Tx) == 0 {
+		return nil, newError(InvalidParams, "tx is missing")
+	}
+	hash, err := s.consensusManager.BroadcastTransaction(params.Tx)
+	if err != nil {
+		return nil, err
+	}
+	return BroadcastTxResult{
+		Hash: hash,
+	}, nil
+}
+
+// setLogLevel changes the level of a module, or the default level if no module is given
+func (s *Server) setLogLevel(params Params) (interface{}, error) {
+	if s.logLevels == nil {
+		return nil, fmt.Errorf("log levels can not be changed")
+	}
+	level, err := logging.ParseLevel(params.Level)
+	if err != nil {
+		return nil, newError(InvalidParams, "%v", err)
+	}
+	if params.Module == "" {
+		s.logLevels.SetDefault(level)
+	} else {
+		s.logLevels.Set(params.Module, level)
+	}
+	return LogLevelResult{
+		Module: params.Module,
+		Level: level.String(),
+	}, nil
+}
+
+// getBlock finds a block by id, or by height, or returns the head if neither is given
+func (s *Server) getBlock(params Params) (*types.Block, error) {
+	if params.Id != "" {
+		id, err := types.NewHash(params.Id)
+		if err != nil {
+			return nil, newError(InvalidParams, "%v", err)
+		}
+		return s.blockStore.GetBlockFromId(id)
+	}
+	if params.Height != 0 {
+		return s.blockStore.GetBlockFromHeight(params.Height)
+	}
+	return s.blockStore.Head()
+}
@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"bft/metrics"
+	_ "bft/network" // registers the network metrics of a full node
+)
+
+var (
+	commentLine = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\]|\\.)*",?)*\})? (\+Inf|-Inf|NaN|[-+0-9.eE]+)$`)
+)
+
+func TestServer_Metrics(t *testing.T) {
+	node := newTestNode(t)
+	defer node.server.Close()
+	resp, err := http.Get(node.server.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+	types := make(map[string]string, 0)
+	samples := make(map[string]bool, 0)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := commentLine.FindStringSubmatch(line); match != nil {
+			if match[1] == "TYPE" {
+				types[match[2]] = match[3]
+			}
+			continue
+		}
+		match := sampleLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Fatalf("line does not follow the exposition format: %q", line)
+		}
+		family := match[1]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if name := strings.TrimSuffix(family, suffix); types[name] == "histogram" {
+				family = name
+			}
+		}
+		if _, ok := types[family]; !ok {
+			t.Fatalf("sample %s comes before its TYPE line", match[1])
+		}
+		samples[line] = true
+	}
+	expected := map[string]string{
+		"bft_consensus_height": "gauge",
+		"bft_consensus_round": "gauge",
+		"bft_consensus_height_duration_seconds": "histogram",
+		"bft_consensus_round_changes_total": "counter",
+		"bft_consensus_state_seconds_total": "counter",
+		"bft_consensus_votes_received_total": "counter",
+		"bft_network_peers": "gauge",
+		"bft_network_messages_received_total": "counter",
+		"bft_network_received_bytes_total": "counter",
+		"bft_network_messages_sent_total": "counter",
+		"bft_network_sent_bytes_total": "counter",
+		"bft_sync_lag_blocks": "gauge",
+		"bft_db_read_duration_seconds": "histogram",
+		"bft_db_write_duration_seconds": "histogram",
+	}
+	for name, metricType := range expected {
+		if types[name] != metricType {
+			t.Errorf("expected %s to be a %s, got %q", name, metricType, types[name])
+		}
+	}
+	if height := fmt.Sprintf("bft_consensus_height %d", node.block.Height()); !samples[height] {
+		t.Errorf("expected sample %q", height)
+	}
+}
@@ -0,0 +1,311 @@
+package rpc
+
+import (
+	"bft/consensus"
+	"bft/database"
+	"bft/events"
+	"bft/logging"
+	"bft/metrics"
+	"bft/types"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const JSONRPCVersion = "2.0"
+const MetricsPath = "/metrics"
+
+// error codes of the JSON-RPC 2.0 specification, ServerError is used for failures of a method
+const (
+	ParseError = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams = -32602
+	InternalError = -32603
+	ServerError = -32000
+)
+
+type Request struct {
+	JSONRPC string `json:"jsonrpc"`
+	Id json.RawMessage `json:"id"`
+	Method string `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type Response struct {
+	JSONRPC string `json:"jsonrpc"`
+	Id json.RawMessage `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code int `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+func newError(code int, format string, args ...interface{}) *Error {
+	return &Error{
+		Code: code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Params are shared by all methods, each method reads the ones it needs
+type Params struct {
+	Height uint64 `json:"height"`
+	Id string `json:"id"` // hex block id
+	Hash string `json:"hash"` // hex transaction hash
+	Tx types.Transaction `json:"tx"` // hex encoded
+	Module string `json:"module"`
+	Level string `json:"level"`
+	Start uint64 `json:"start"` // first height of blocks
+	End uint64 `json:"end"` // last height of blocks
+	Proposer string `json:"proposer"`
+	From time.Time `json:"from"`
+	To time.Time `json:"to"`
+	Descending bool `json:"descending"`
+	Limit int `json:"limit"`
+	Cursor string `json:"cursor"` // next of the previous page
+}
+
+type SyncStateFunc func() string
+
+// postMethods change the node or the chain, they are not served to GET requests which a link or an image of
+// another site can send
+var postMethods = map[string]bool{
+	"broadcast_tx": true,
+	"set_log_level": true,
+}
+
+// adminMethods change the node, they are served to POST requests from the local host only
+var adminMethods = map[string]bool{
+	"set_log_level": true,
+}
+
+type method func(params Params) (interface{}, error)
+
+// Server answers JSON-RPC 2.0 requests posted to "/", and the methods which only read as GET /<method>?<params>.
+// Events are streamed on /websocket and metrics are exposed on /metrics.
+type Server struct {
+	blockStore *database.BlockStore
+	consensusManager *consensus.ConsensusManager
+	syncState SyncStateFunc
+	eventBus *events.EventBus
+	logLevels *logging.Levels
+	methods map[string]method
+	logger logging.Logger
+}
+
+func NewServer(blockStore *database.BlockStore, consensusManager *consensus.ConsensusManager) *Server {
+	s := &Server{
+		blockStore: blockStore,
+		consensusManager: consensusManager,
+		logger: logging.Default().With(logging.Module("rpc")),
+	}
+	s.methods = map[string]method{
+		"status": s.status,
+		"block": s.block,
+		"header": s.header,
+		"validators": s.validators,
+		"consensus_params": s.consensusParams,
+		"commit": s.commit,
+		"blocks": s.blocks,
+		"tx": s.tx,
+		"broadcast_tx": s.broadcastTx,
+		"set_log_level": s.setLogLevel,
+	}
+	return s
+}
+
+// SetSyncStateFunc reports the block synchronization state in status, it is unknown if unset
+func (s *Server) SetSyncStateFunc(syncState SyncStateFunc) {
+	s.syncState = syncState
+}
+
+// SetEventBus enables event subscriptions
+func (s *Server) SetEventBus(eventBus *events.EventBus) {
+	s.eventBus = eventBus
+}
+
+// SetLogLevels lets set_log_level change the levels of the node's loggers
+func (s *Server) SetLogLevels(levels *logging.Levels) {
+	s.logLevels = levels
+}
+
+func (s *Server) SetLogger(logger logging.Logger) {
+	s.logger = logger
+}
+
+func (s *Server) ListenAndServe(address string) error {
+	s.logger.Info("rpc server listening", logging.F("address", address))
+	return http.ListenAndServe(address, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case WebSocketPath:
+		s.serveWebSocket(w, r)
+		return
+	case MetricsPath:
+		metrics.DefaultRegistry.ServeHTTP(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.serveGet(w, r)
+	case http.MethodPost:
+		s.servePost(w, r)
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveGet(w http.ResponseWriter, r *http.Request) {
+	response := Response{
+		JSONRPC: JSONRPCVersion,
+		Id: json.RawMessage("-1"),
+	}
+	params, err := queryParams(r)
+	if err != nil {
+		response.Error = newError(InvalidParams, "%v", err)
+	} else {
+		response.Result, response.Error = s.call(strings.Trim(r.URL.Path, "/"), params, false, false)
+	}
+	s.writeResponse(w, response)
+}
+
+func (s *Server) servePost(w http.ResponseWriter, r *http.Request) {
+	response := Response{
+		JSONRPC: JSONRPCVersion,
+		Id: json.RawMessage("null"),
+	}
+	request := Request{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		response.Error = newError(ParseError, "%v", err)
+		s.writeResponse(w, response)
+		return
+	}
+	if len(request.Id) > 0 {
+		response.Id = request.Id
+	}
+	if request.JSONRPC != JSONRPCVersion {
+		response.Error = newError(InvalidRequest, "jsonrpc should be %s", JSONRPCVersion)
+		s.writeResponse(w, response)
+		return
+	}
+	params := Params{}
+	if len(request.Params) > 0 && string(request.Params) != "null" {
+		if err := json.Unmarshal(request.Params, &params); err != nil {
+			response.Error = newError(InvalidParams, "%v", err)
+			s.writeResponse(w, response)
+			return
+		}
+	}
+	response.Result, response.Error = s.call(request.Method, params, true, isLocal(r))
+	s.writeResponse(w, response)
+}
+
+// call runs a method, methods which change the node need a POST request and admin methods a local one
+func (s *Server) call(name string, params Params, post bool, local bool) (interface{}, *Error) {
+	m, ok := s.methods[name]
+	if !ok {
+		return nil, newError(MethodNotFound, "method %s does not exist", name)
+	}
+	if postMethods[name] && !post {
+		return nil, newError(InvalidRequest, "method %s is served to POST requests only", name)
+	}
+	if adminMethods[name] && !local {
+		return nil, newError(InvalidRequest, "method %s is served to POST requests from the local host only", name)
+	}
+	result, err := m(params)
+	if err != nil {
+		if rpcErr, ok := err.(*Error); ok {
+			return nil, rpcErr
+		}
+		return nil, newError(ServerError, "%v", err)
+	}
+	return result, nil
+}
+
+func queryParams(r *http.Request) (Params, error) {
+	params := Params{}
+	query := r.URL.Query()
+	if height := query.Get("height"); height != "" {
+		h, err := strconv.ParseUint(height, 10, 64)
+		if err != nil {
+			return params, fmt.Errorf("height should be an unsigned integer")
+		}
+		params.Height = h
+	}
+	params.Id = query.Get("id")
+	params.Hash = query.Get("hash")
+	params.Module = query.Get("module")
+	params.Level = query.Get("level")
+	params.Proposer = query.Get("proposer")
+	params.Cursor = query.Get("cursor")
+	for name, value := range map[string]*uint64{"start": &params.Start, "end": &params.End} {
+		if s := query.Get(name); s != "" {
+			h, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return params, fmt.Errorf("%s should be an unsigned integer", name)
+			}
+			*value = h
+		}
+	}
+	for name, value := range map[string]*time.Time{"from": &params.From, "to": &params.To} {
+		if s := query.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return params, fmt.Errorf("%s should be a RFC 3339 time", name)
+			}
+			*value = t
+		}
+	}
+	if descending := query.Get("descending"); descending != "" {
+		d, err := strconv.ParseBool(descending)
+		if err != nil {
+			return params, fmt.Errorf("descending should be true or false")
+		}
+		params.Descending = d
+	}
+	if limit := query.Get("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil {
+			return params, fmt.Errorf("limit should be an integer")
+		}
+		params.Limit = l
+	}
+	if tx := query.Get("tx"); tx != "" {
+		if err := params.Tx.UnmarshalJSON([]byte(strconv.Quote(tx))); err != nil {
+			return params, fmt.Errorf("tx should be hex encoded")
+		}
+	}
+	return params, nil
+}
+
+// isLocal tells whether the request comes from the local host. A proxy in front of the server makes every request
+// local, so it must not forward admin methods.
+func isLocal(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Debug("can not write response", logging.Err(err))
+	}
+}
@@ -0,0 +1,317 @@
+package rpc
+
+import (
+	"bft/consensus"
+	"bft/crypto"
+	"bft/database"
+	"bft/encoding"
+	"bft/events"
+	"bft/logging"
+	"bft/testutil"
+	"bft/types"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testGenesis() *types.Genesis {
+	publicKey, err := crypto.NewPublicKey("4zWHNAewJRxdzwgfpYzwhJvFzDooxBLHs28JT3AEXEbDMs9ha4")
+	if err != nil {
+		log.Fatal(err)
+	}
+	validator := types.Validator{
+		Address: publicKey.Address(),
+		PublicKey: *publicKey,
+		VotingPower: 1,
+	}
+	genesis := types.NewGenesis("bft-test", types.Validators{validator})
+	genesis.Time = time.Date(2017, 10, 2, 0, 0, 0, 0, time.UTC)
+	return genesis
+}
+
+type testNode struct {
+	server *httptest.Server
+	blockStore *database.BlockStore
+	eventBus *events.EventBus
+	logLevels *logging.Levels
+	block *types.Block // block committed by the test node
+	tx types.Transaction // transaction of block
+	broadcasted []types.Message
+}
+
+type testResponse struct {
+	Id json.RawMessage
+	Result json.RawMessage
+	Error *Error
+}
+
+// newTestNode runs a single validator node in process, with one more block on top of the genesis block
+func newTestNode(t *testing.T) *testNode {
+	key, validator := testutil.NewValidator(t)
+	validators := types.Validators{validator}
+	blockStore, err := database.NewBlockStore(database.NewMemoryStore(), testGenesis())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &testNode{
+		blockStore: blockStore,
+		eventBus: events.NewEventBus(),
+		logLevels: logging.NewLevels(logging.InfoLevel),
+		tx: types.Transaction("transfer 5"),
+	}
+	if err := node.blockStore.ResetValidators(validators); err != nil {
+		t.Fatal(err)
+	}
+	head, err := node.blockStore.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.block = testutil.NewCommittedBlock(t, head, key, validator, node.tx)
+	if err := node.blockStore.AddBlock(node.block); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := consensus.NewConsensusManager(node.blockStore, validator.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.SetSigner(key.Sign)
+	cm.SetBroadcaster(func(message types.Message) {
+		node.broadcasted = append(node.broadcasted, message)
+	})
+	cm.SetEventBus(node.eventBus)
+	cm.Start()
+	server := NewServer(node.blockStore, cm)
+	server.SetEventBus(node.eventBus)
+	server.SetLogLevels(node.logLevels)
+	server.SetSyncStateFunc(func() string {
+		return "in sync"
+	})
+	node.server = httptest.NewServer(server)
+	return node
+}
+
+func (n *testNode) post(t *testing.T, method string, params interface{}) testResponse {
+	request := map[string]interface{}{
+		"jsonrpc": JSONRPCVersion,
+		"id": 7,
+		"method": method,
+		"params": params,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(n.server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeResponse(t, resp)
+}
+
+func (n *testNode) get(t *testing.T, path string) testResponse {
+	resp, err := http.Get(n.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decodeResponse(t, resp)
+}
+
+func decodeResponse(t *testing.T, resp *http.Response) testResponse {
+	defer resp.Body.Close()
+	response := testResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func (r testResponse) decode(t *testing.T, result interface{}) {
+	if r.Error != nil {
+		t.Fatal(r.Error)
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	node := newTestNode(t)
+	defer node.server.Close()
+	heightId := node.block.Header().HeightId
+
+	t.Run("status", func(t *testing.T) {
+		status := StatusResult{}
+		node.post(t, "status", nil).decode(t, &status)
+		if !status.Head.Equals(heightId) || status.ChainId != "bft-test" || !status.GenesisHash.Equals(node.blockStore.GenesisHash()) {
+			t.Fatalf("unexpected head %s", status.Head.String())
+		}
+		if !status.Started || status.View.Height != heightId.Height + 1 || status.StateType != consensus.NewRound.String() {
+			t.Fatalf("unexpected consensus state %v %s", status.View, status.StateType)
+		}
+		if status.SyncState != "in sync" {
+			t.Fatalf("unexpected sync state %s", status.SyncState)
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		byHeight := types.Block{}
+		node.post(t, "block", map[string]interface{}{"height": heightId.Height}).decode(t, &byHeight)
+		byId := types.Block{}
+		node.get(t, "/block?id=" + heightId.Id.String()).decode(t, &byId)
+		head := types.Block{}
+		node.get(t, "/block").decode(t, &head)
+		for _, block := range []types.Block{byHeight, byId, head} {
+			if !block.Header().HeightId.Equals(heightId) || !block.Header().VerifyId(encoding.MarshalBinary) {
+				t.Fatalf("unexpected block %s", block.Header().HeightId.String())
+			}
+			signature := block.Signature()
+			if !signature.Verify(block.Header().Proposer.Address, heightId.Id[:]) {
+				t.Fatal("block signature should survive json")
+			}
+		}
+	})
+
+	t.Run("tx", func(t *testing.T) {
+		result := TxResult{}
+		node.get(t, "/tx?hash=" + node.tx.Hash().String()).decode(t, &result)
+		if result.Height != heightId.Height || result.Index != 0 || !result.Hash.Equals(node.tx.Hash()) || string(result.Tx) != string(node.tx) {
+			t.Fatalf("unexpected transaction %+v", result)
+		}
+		if response := node.post(t, "tx", nil); response.Error == nil || response.Error.Code != InvalidParams {
+			t.Fatal("missing hash should be rejected")
+		}
+		unknown := types.Transaction("unknown").Hash()
+		if response := node.post(t, "tx", map[string]interface{}{"hash": unknown.String()}); response.Error == nil || response.Error.Code != ServerError {
+			t.Fatal("unknown transaction should not be found")
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		header := types.BlockHeader{}
+		node.get(t, "/header?height=1").decode(t, &header)
+		if header.Height() != 1 || !header.VerifyId(encoding.MarshalBinary) {
+			t.Fatalf("unexpected header %s", header.HeightId.String())
+		}
+	})
+
+	t.Run("validators", func(t *testing.T) {
+		result := ValidatorsResult{}
+		node.get(t, "/validators").decode(t, &result)
+		if result.Height != heightId.Height + 1 || len(result.Validators) != 1 || result.TotalVotingPower != 1 {
+			t.Fatalf("unexpected validators %v", result)
+		}
+		if !result.Validators[0].Equals(node.block.Header().Proposer) {
+			t.Fatal("validator should be the test node")
+		}
+	})
+
+	t.Run("consensus_params", func(t *testing.T) {
+		result := ConsensusParamsResult{}
+		node.get(t, "/consensus_params").decode(t, &result)
+		if result.Height != heightId.Height + 1 || result.ConsensusParams != testGenesis().ConsensusParams {
+			t.Fatalf("unexpected consensus params %+v", result)
+		}
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		result := CommitResult{}
+		node.post(t, "commit", map[string]interface{}{"id": heightId.Id.String()}).decode(t, &result)
+		header := *node.block.Header()
+		header.Commits = result.Commits
+		validators, _ := node.blockStore.GetValidators(heightId.Height)
+		if err := header.VerifyCommits(validators, encoding.MarshalBinary); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("blocks", func(t *testing.T) {
+		result := BlocksResult{}
+		node.get(t, "/blocks?descending=true&limit=1").decode(t, &result)
+		if len(result.Blocks) != 1 || !result.Blocks[0].Header().HeightId.Equals(heightId) || result.Next != "1" {
+			t.Fatalf("unexpected first page %+v", result)
+		}
+		node.post(t, "blocks", map[string]interface{}{"descending": true, "limit": 1, "cursor": result.Next}).decode(t, &result)
+		if len(result.Blocks) != 1 || result.Blocks[0].Height() != 1 || result.Next != "" {
+			t.Fatalf("unexpected last page %+v", result)
+		}
+		proposer := node.block.Header().Proposer.Address
+		node.get(t, "/blocks?proposer=" + proposer).decode(t, &result)
+		if len(result.Blocks) != 1 || !result.Blocks[0].Header().HeightId.Equals(heightId) {
+			t.Fatalf("unexpected blocks of proposer %+v", result)
+		}
+		if response := node.get(t, "/blocks?limit=1000"); response.Error == nil || response.Error.Code != InvalidParams {
+			t.Fatal("too large limit should be rejected")
+		}
+	})
+
+	t.Run("broadcast_tx", func(t *testing.T) {
+		tx := types.Transaction("transfer 10")
+		result := BroadcastTxResult{}
+		node.post(t, "broadcast_tx", map[string]interface{}{"tx": tx}).decode(t, &result)
+		if !result.Hash.Equals(tx.Hash()) {
+			t.Fatal("unexpected transaction hash")
+		}
+		if len(node.broadcasted) != 1 || node.broadcasted[0].Type != types.TransactionMessage {
+			t.Fatal("transaction should be broadcasted to peers")
+		}
+		if response := node.post(t, "broadcast_tx", map[string]interface{}{"tx": tx}); response.Error == nil || response.Error.Code != ServerError {
+			t.Fatal("duplicate transaction should be rejected")
+		}
+		// "transfer 20" sent by a link of another site
+		if response := node.get(t, "/broadcast_tx?tx=7472616e73666572203230"); response.Error == nil || response.Error.Code != InvalidRequest {
+			t.Fatal("broadcast_tx should not be served to GET requests")
+		}
+		if len(node.broadcasted) != 1 {
+			t.Fatal("transaction of a GET request should not be broadcasted")
+		}
+	})
+
+	t.Run("set_log_level", func(t *testing.T) {
+		result := LogLevelResult{}
+		node.post(t, "set_log_level", map[string]interface{}{"module": "consensus", "level": "debug"}).decode(t, &result)
+		if node.logLevels.Get("consensus") != logging.DebugLevel || node.logLevels.Get("network") != logging.InfoLevel {
+			t.Fatal("only the consensus level should change")
+		}
+		node.post(t, "set_log_level", map[string]interface{}{"level": "error"}).decode(t, &result)
+		if node.logLevels.Get("network") != logging.ErrorLevel {
+			t.Fatal("default level should change")
+		}
+		if response := node.post(t, "set_log_level", map[string]interface{}{"level": "loud"}); response.Error == nil || response.Error.Code != InvalidParams {
+			t.Fatal("unknown level should be rejected")
+		}
+		if response := node.get(t, "/set_log_level?level=debug"); response.Error == nil || response.Error.Code != InvalidRequest {
+			t.Fatal("set_log_level should not be served to GET requests")
+		}
+		// httptest requests come from a remote address
+		body := `{"jsonrpc":"2.0","id":1,"method":"set_log_level","params":{"level":"debug"}}`
+		recorder := httptest.NewRecorder()
+		node.server.Config.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		if response := decodeResponse(t, recorder.Result()); response.Error == nil || response.Error.Code != InvalidRequest {
+			t.Fatal("set_log_level should not be served to remote hosts")
+		}
+		if node.logLevels.Get("network") != logging.ErrorLevel {
+			t.Fatal("rejected requests should not change the levels")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		response := node.post(t, "unknown", nil)
+		if response.Error == nil || response.Error.Code != MethodNotFound || string(response.Id) != "7" {
+			t.Fatalf("unexpected response %v", response)
+		}
+		if response := node.get(t, "/block?height=abc"); response.Error == nil || response.Error.Code != InvalidParams {
+			t.Fatal("invalid height should be rejected")
+		}
+		if response := node.get(t, "/block?height=100000"); response.Error == nil || response.Error.Code != ServerError {
+			t.Fatal("missing block should be reported")
+		}
+		if response := node.post(t, "broadcast_tx", nil); response.Error == nil || response.Error.Code != InvalidParams {
+			t.Fatal("missing tx should be rejected")
+		}
+	})
+}
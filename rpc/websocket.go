@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"bft/events"
+	"bft/types"
+	"bft/logging"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const WebSocketPath = "/websocket"
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize: 1024,
+	WriteBufferSize: 1024,
+}
+
+// serveWebSocket streams the events selected by ?types=new_block,state_change,... as JSON messages.
+// A client which can not keep up is disconnected with CloseTryAgainLater instead of slowing down consensus.
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.eventBus == nil {
+		http.Error(w, "events are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseFilter(r.URL.Query().Get("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Debug("can not upgrade to websocket", logging.Err(err))
+		return
+	}
+	subscription := s.eventBus.Subscribe(filter, types.EventBufferSize)
+	go s.readWebSocket(conn, subscription)
+	s.writeWebSocket(conn, subscription)
+}
+
+// readWebSocket handles control frames and ends the subscription when the client goes away
+func (s *Server) readWebSocket(conn *websocket.Conn, subscription *events.Subscription) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			s.eventBus.Unsubscribe(subscription)
+			return
+		}
+	}
+}
+
+func (s *Server) writeWebSocket(conn *websocket.Conn, subscription *events.Subscription) {
+	defer conn.Close()
+	timeout := types.WebSocketWriteTimeout * time.Second
+	for event := range subscription.Events() {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err := conn.WriteJSON(event); err != nil {
+			s.logger.Debug("can not write event", logging.Err(err))
+			s.eventBus.Unsubscribe(subscription)
+			return
+		}
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err := subscription.Err(); err != nil {
+		closeMessage = websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error())
+	}
+	conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(timeout))
+}
+
+func parseFilter(typeNames string) (events.Filter, error) {
+	filter := events.Filter{}
+	if typeNames == "" {
+		return filter, nil
+	}
+	for _, name := range strings.Split(typeNames, ",") {
+		eventType, err := events.ParseEventType(strings.TrimSpace(name))
+		if err != nil {
+			return filter, err
+		}
+		filter.Types = append(filter.Types, eventType)
+	}
+	return filter, nil
+}
@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"bft/events"
+	"bft/types"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEvent struct {
+	Type events.EventType
+	Data events.BlockEvent
+}
+
+func (n *testNode) dial(t *testing.T, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(n.server.URL, "http") + WebSocketPath + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitForSubscriptions(t *testing.T, bus *events.EventBus, n int) {
+	for i := 0; i < 100; i++ {
+		if bus.NumSubscriptions() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d subscriptions, got %d", n, bus.NumSubscriptions())
+}
+
+func TestWebSocket_Subscribe(t *testing.T) {
+	node := newTestNode(t)
+	defer node.server.Close()
+	conn := node.dial(t, "?types=new_block")
+	waitForSubscriptions(t, node.eventBus, 1)
+	header := node.block.Header()
+	node.eventBus.Publish(events.StateChange, events.StateEvent{})
+	node.eventBus.Publish(events.NewBlock, events.BlockEvent{Header: *header})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	event := testEvent{}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != events.NewBlock || !event.Data.Header.HeightId.Equals(header.HeightId) {
+		t.Fatalf("unexpected event %v", event)
+	}
+	// closing the socket ends the subscription
+	conn.Close()
+	waitForSubscriptions(t, node.eventBus, 0)
+}
+
+func TestWebSocket_SlowClient(t *testing.T) {
+	node := newTestNode(t)
+	defer node.server.Close()
+	conn := node.dial(t, "")
+	defer conn.Close()
+	waitForSubscriptions(t, node.eventBus, 1)
+	// the client does not read, so the socket buffers fill up and then the subscription overflows
+	block := events.BlockEvent{Header: *node.block.Header()}
+	block.Header.ValidatorUpdates = make(types.Validators, 100)
+	start := time.Now()
+	for i := 0; i < 100 * types.EventBufferSize && node.eventBus.NumSubscriptions() > 0; i++ {
+		node.eventBus.Publish(events.NewBlock, block)
+	}
+	if time.Since(start) > 5 * time.Second {
+		t.Fatal("publishing should not wait for the client")
+	}
+	if node.eventBus.NumSubscriptions() != 0 {
+		t.Fatal("slow client should be unsubscribed")
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+				t.Fatalf("expected close with try again later, got %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestWebSocket_UnknownEventType(t *testing.T) {
+	node := newTestNode(t)
+	defer node.server.Close()
+	resp, err := http.Get(node.server.URL + WebSocketPath + "?types=new_block,unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,74 @@
+// Package testutil builds the signed blocks shared by the tests of several packages. It depends on types, crypto
+// and encoding only, so every package can use it in its tests.
+package testutil
+
+import (
+	"bft/crypto"
+	"bft/encoding"
+	"bft/types"
+	"testing"
+	"time"
+)
+
+// NewValidator returns a random key and its validator with a voting power of 1
+func NewValidator(t *testing.T) (*crypto.PrivateKey, types.Validator) {
+	key, err := crypto.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := types.Validator{
+		Address: key.PublicKey().Address(),
+		PublicKey: *key.PublicKey(),
+		VotingPower: 1,
+	}
+	return key, validator
+}
+
+// NewCommit is the commit of key for header in round 0
+func NewCommit(t *testing.T, key *crypto.PrivateKey, header types.BlockHeader) types.Vote {
+	vote := types.Vote{
+		Address: key.PublicKey().Address(),
+		Type: types.Commit,
+		View: types.View{Round: 0, Height: header.Height()},
+		BlockId: header.Id(),
+	}
+	hash, err := vote.CalculateHash(encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote.Hash = hash
+	vote.Signature, err = key.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vote
+}
+
+// NewCommittedBlock is the block of txs on top of head which validator proposes and commits alone, one second after
+// head
+func NewCommittedBlock(t *testing.T, head *types.Block, key *crypto.PrivateKey, validator types.Validator, txs ...types.Transaction) *types.Block {
+	validatorsHash, err := types.Validators{validator}.Hash(encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := types.BlockHeader{
+		HeightId: types.BlockHeightId{Height: head.Height() + 1},
+		PreviousId: head.Id(),
+		Proposer: validator,
+		Timestamp: head.Header().Timestamp.Add(time.Second),
+		ValidatorsHash: validatorsHash,
+		NextValidatorsHash: validatorsHash,
+		TransactionsHash: types.Transactions(txs).Hash(),
+	}
+	header.HeightId.Id = header.CalculateId(encoding.MarshalBinary)
+	header.Commits = []types.Vote{NewCommit(t, key, header)}
+	blockId := header.Id()
+	signature, err := key.Sign(blockId[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &types.Block{
+		SignedHeader: types.SignedBlockHeader{Header: header, Signature: signature},
+		Transactions: txs,
+	}
+}
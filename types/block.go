@@ -42,6 +42,11 @@ type BlockHeader struct {
 	PreviousId Hash
 	Proposer Validator
 	Timestamp time.Time
+	ValidatorsHash Hash // validators which commit this block
+	NextValidatorsHash Hash // validators which commit the next block
+	TransactionsHash Hash // transactions of the block
+	ValidatorUpdates Validators // a zero voting power removes the validator
+	ParamsUpdates []ConsensusParamsUpdate
 	Commits []Vote
 }
 
@@ -58,6 +63,83 @@ func (h BlockHeader) CalculateId(encoder SerializeFunc) Hash {
 	return sha256.Sum256(b)
 }
 
+// VerifyId checks that the header's id is the hash of its content. The id is calculated before the block is
+// committed, so it covers neither the id itself nor the commits.
+func (h BlockHeader) VerifyId(encoder SerializeFunc) bool {
+	unsigned := h
+	unsigned.HeightId.Id = Hash{}
+	unsigned.Commits = nil
+	return unsigned.CalculateId(encoder).Equals(h.Id())
+}
+
+// VerifyCommits checks that the header was committed by more than 2/3 of the voting power of validators,
+// which must be the validator set in the header's ValidatorsHash
+func (h BlockHeader) VerifyCommits(validators Validators, encoder SerializeFunc) error {
+	validatorsHash, err := validators.Hash(encoder)
+	if err != nil {
+		return err
+	}
+	if !validatorsHash.Equals(h.ValidatorsHash) {
+		return fmt.Errorf("validators do not match the validators hash of block %s", h.HeightId.String())
+	}
+	power, total, err := h.committedPower(validators, false, encoder)
+	if err != nil {
+		return err
+	}
+	if power*3 <= total*2 {
+		return fmt.Errorf("block %s has commits of %d out of %d voting power", h.HeightId.String(), power, total)
+	}
+	return nil
+}
+
+// VerifyCommitsTrusting checks that more than 1/3 of the voting power of trusted validators committed the header.
+// The trusted validators may differ from the header's validators, commits from other voters are ignored.
+// At least one honest trusted validator vouches for the header then.
+func (h BlockHeader) VerifyCommitsTrusting(trusted Validators, encoder SerializeFunc) error {
+	power, total, err := h.committedPower(trusted, true, encoder)
+	if err != nil {
+		return err
+	}
+	if power*3 <= total {
+		return fmt.Errorf("block %s has trusted commits of %d out of %d voting power", h.HeightId.String(), power, total)
+	}
+	return nil
+}
+
+func (h BlockHeader) committedPower(validators Validators, ignoreUnknown bool, encoder SerializeFunc) (power uint64, total uint64, err error) {
+	voters := make(map[string]Validator, 0)
+	for _, v := range validators {
+		voters[v.Address] = v
+		total += v.VotingPower
+	}
+	voted := make(map[string]bool, 0)
+	for _, vote := range h.Commits {
+		voter, ok := voters[vote.Address]
+		if voted[vote.Address] {
+			return 0, 0, fmt.Errorf("duplicate commit from %s", vote.Address)
+		}
+		if !ok {
+			if ignoreUnknown {
+				continue
+			}
+			return 0, 0, fmt.Errorf("commit from unknown voter %s", vote.Address)
+		}
+		if vote.Type != Commit || vote.View.Height != h.Height() || !vote.BlockId.Equals(h.Id()) {
+			return 0, 0, fmt.Errorf("vote of %s does not commit block %s", vote.Address, h.HeightId.String())
+		}
+		hash, err := vote.CalculateHash(encoder)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !hash.Equals(vote.Hash) || !vote.Signature.Verify(voter.Address, hash[:]) {
+			return 0, 0, fmt.Errorf("invalid commit signature from %s", vote.Address)
+		}
+		voted[vote.Address] = true
+		power += voter.VotingPower
+	}
+	return power, total, nil
+}
+
 type SignedBlockHeader struct {
 	Header BlockHeader
 	Signature crypto.Signature
@@ -65,21 +147,35 @@ type SignedBlockHeader struct {
 
 type Block struct {
 	SignedHeader SignedBlockHeader
+	Transactions Transactions
 }
 
-func NewGenesisBlock(genesis Genesis, encoder SerializeFunc) *Block {
+// NewGenesisBlock is the block at height 1. Its previous id is the hash of the genesis, its validators are the
+// initial validators.
+func NewGenesisBlock(genesis *Genesis, encoder SerializeFunc) (*Block, error) {
+	validators, err := Validators{}.ApplyUpdates(genesis.Validators)
+	if err != nil {
+		return nil, err
+	}
+	validatorsHash, err := validators.Hash(encoder)
+	if err != nil {
+		return nil, err
+	}
 	genesisHeader := BlockHeader{}
 	genesisHeader.HeightId.Height = 1
-	genesisHeader.Proposer = genesis.Proposer
-	genesisHeader.Timestamp = genesis.Timestamp
+	genesisHeader.PreviousId = genesis.Hash(encoder)
+	genesisHeader.Proposer = validators[0]
+	genesisHeader.Timestamp = genesis.Time
+	genesisHeader.ValidatorsHash = validatorsHash
+	genesisHeader.NextValidatorsHash = validatorsHash
 	id := genesisHeader.CalculateId(encoder)
 	genesisHeader.HeightId.Id = id
 	signedHeader := SignedBlockHeader{
 		Header: genesisHeader,
 	}
 	return &Block{
-		signedHeader,
-	}
+		SignedHeader: signedHeader,
+	}, nil
 }
 
 func (b *Block) Header() *BlockHeader{
@@ -98,6 +194,14 @@ func (b *Block) Signature() crypto.Signature {
 	return b.SignedHeader.Signature
 }
 
+// VerifyTransactions checks that the transactions are the ones which the header commits to
+func (b *Block) VerifyTransactions() error {
+	if hash := b.Transactions.Hash(); !hash.Equals(b.Header().TransactionsHash) {
+		return fmt.Errorf("transactions hash %s of block %s does not match its transactions", hash.String(), b.Header().HeightId.String())
+	}
+	return nil
+}
+
 func (b *Block) IsValid() bool {
 	if b == nil {
 		log.Println("block should be not nil")
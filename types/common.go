@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"bft/crypto"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 )
 
 type Hash [32]byte // SHA256 hash
@@ -18,6 +20,34 @@ func (h Hash) IsEmpty() bool {
 	emptyHash := Hash{}
 	return h.Equals(emptyHash)
 }
+// convert hex string to hash
+func NewHash(hexString string) (Hash, error) {
+	h := Hash{}
+	b, err := hex.DecodeString(hexString)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != len(h) {
+		return h, fmt.Errorf("hash should have %d bytes, got %d", len(h), len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+func (h *Hash) UnmarshalJSON(b []byte) error {
+	hexString := ""
+	if err := json.Unmarshal(b, &hexString); err != nil {
+		return err
+	}
+	hash, err := NewHash(hexString)
+	if err != nil {
+		return err
+	}
+	*h = hash
+	return nil
+}
 type DeserializeFunc func (b []byte, v interface{}) error
 type SerializeFunc func (v interface{}) ([]byte, error)
 type KeyPair struct {
@@ -3,7 +3,30 @@ package types
 const P2P = "/p2p/"
 const NetworkVersion = "1.0.0"
 const HostIdentity = "host-identity"
-const RequestTimeout = 10000 //milliseconds
-const HandshakeTimeout = 1 // second
-const GenesisProposerKey  = "4zWHNAewJRxdzwgfpYzwhJvFzDooxBLHs28JT3AEXEbDMs9ha4"
-const GenesisTime = "2017-10-02T00:00:00.000Z"
\ No newline at end of file
+const ProposeTimeout = 3000 // milliseconds, default consensus params
+const PrepareTimeout = 1000 // milliseconds
+const CommitTimeout = 1000 // milliseconds
+const TimeoutDelta = 500 // milliseconds
+const MaxTimeout = 60000 // milliseconds
+const BlockInterval = 1000 // milliseconds a proposer waits after the previous block
+const HandshakePastSkew = 30 // seconds, how old a handshake may be
+const HandshakeFutureSkew = 30 // seconds, how far ahead of the local clock a handshake may be
+const ValidatorUpdateDelay = 2 // validator updates in block h take effect at height h + ValidatorUpdateDelay
+const RPCAddress = "127.0.0.1:3000" // default listen address of the rpc server
+const EventBufferSize = 100 // events buffered per subscriber before it is dropped
+const WebSocketWriteTimeout = 10 // seconds
+const MempoolSize = 5000 // maximum number of pending transactions
+const MempoolTTL = 600 // seconds a transaction stays pending before it is dropped
+const MaxTransactionSize = 65536 // bytes
+const MaxBlockSize = 1048576 // default bytes of an encoded block
+const MaxBlockTransactions = 10000 // default transactions of a block
+const MaxEvidenceAge = 100000 // default blocks
+const ParamsUpdateDelay = 2 // consensus params updates in block h take effect at h + ParamsUpdateDelay or later
+const RPCPageSize = 20 // default blocks of a page of the blocks rpc method
+const MaxRPCPageSize = 100
+const PruneBatchSize = 1000 // heights deleted in one batch by the pruning
+const PruneInterval = 60 // seconds between two prunings
+const MigrationBatchSize = 1000 // heights written in one batch by a migration
+const MaxTotalVotingPower = 1 << 60 // keeps the proposer priorities within int64
+const ValidatorSetCheckpoint = 1000 // heights between two stored proposer priorities of an unchanged validator set
+const MaxSyncBlocks = 100 // blocks sent in response to one sync request
\ No newline at end of file
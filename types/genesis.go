@@ -2,35 +2,79 @@ package types
 
 import (
 	"time"
-	"bft/crypto"
-	"log"
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 )
 
+// Genesis is the genesis.json shared by all nodes of a network
 type Genesis struct {
-	Timestamp time.Time
-	Proposer Validator
+	ChainId string `json:"chain_id"`
+	Time time.Time `json:"genesis_time"`
+	Validators Validators `json:"validators"`
+	ConsensusParams ConsensusParams `json:"consensus_params"`
+	AppState json.RawMessage `json:"app_state,omitempty"`
 }
 
-func NewGenesis() Genesis {
-	publicKey, err := crypto.NewPublicKey(GenesisProposerKey)
-	if err != nil {
-		log.Fatal(err)
+func NewGenesis(chainId string, validators Validators) *Genesis {
+	return &Genesis{
+		ChainId: chainId,
+		Time: time.Now().UTC().Truncate(time.Second),
+		Validators: validators,
+		ConsensusParams: DefaultConsensusParams(),
 	}
-	timestamp, err := time.Parse(time.RFC3339, GenesisTime)
+}
+
+func LoadGenesis(fileName string) (*Genesis, error) {
+	b, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	genesis := &Genesis{
+		ConsensusParams: DefaultConsensusParams(),
 	}
-	return Genesis{
-		timestamp,
-		Validator{
-			publicKey.Address(),
-			*publicKey,
-		},
+	if err := json.Unmarshal(b, genesis); err != nil {
+		return nil, fmt.Errorf("can not parse %s: %v", fileName, err)
 	}
+	return genesis, genesis.Validate()
 }
 
-func (g Genesis) ChainId(encoder SerializeFunc) Hash {
-	buf, _ := encoder(g)
+func (g *Genesis) Validate() error {
+	if g.ChainId == "" {
+		return fmt.Errorf("genesis has no chain id")
+	}
+	if g.Time.IsZero() {
+		return fmt.Errorf("genesis has no time")
+	}
+	if len(g.Validators) == 0 {
+		return fmt.Errorf("genesis has no validators")
+	}
+	if _, err := (Validators{}).ApplyUpdates(g.Validators); err != nil {
+		return err
+	}
+	return g.ConsensusParams.Validate()
+}
+
+func (g *Genesis) Save(fileName string) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(b, '\n'), 0644)
+}
+
+// Hash covers the whole genesis, so nodes whose genesis differs in any way are on different networks.
+// The app state is compacted first, the indentation of genesis.json does not matter.
+func (g *Genesis) Hash(encoder SerializeFunc) Hash {
+	genesis := *g
+	if len(g.AppState) > 0 {
+		appState := bytes.Buffer{}
+		if err := json.Compact(&appState, g.AppState); err == nil {
+			genesis.AppState = appState.Bytes()
+		}
+	}
+	buf, _ := encoder(genesis)
 	return sha256.Sum256(buf)
 }
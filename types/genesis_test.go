@@ -0,0 +1,120 @@
+package types_test
+
+import (
+	"bft/encoding"
+	"bft/types"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGenesis_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bft-genesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	genesis := types.NewGenesis("test-chain", newTestValidators(t, 1, 2))
+	genesis.ConsensusParams.MaxBlockSize = 4096
+	genesis.AppState = json.RawMessage(`{"accounts":[]}`)
+	fileName := filepath.Join(dir, "genesis.json")
+	if err := genesis.Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := types.LoadGenesis(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Time.Equal(genesis.Time) {
+		t.Fatalf("expected time %v, got %v", genesis.Time, loaded.Time)
+	}
+	if !loaded.Hash(encoding.MarshalBinary).Equals(genesis.Hash(encoding.MarshalBinary)) {
+		t.Fatal("loaded genesis has another hash")
+	}
+	loaded.Time = genesis.Time
+	loaded.AppState = genesis.AppState
+	if !reflect.DeepEqual(genesis, loaded) {
+		t.Fatalf("expected %+v, got %+v", genesis, loaded)
+	}
+}
+
+func TestGenesis_LoadDefaultParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bft-genesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	validators, err := json.Marshal(newTestValidators(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `{"chain_id": "test-chain", "genesis_time": "2017-10-02T00:00:00Z", "validators": ` + string(validators) + `}`
+	fileName := filepath.Join(dir, "genesis.json")
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := types.LoadGenesis(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if genesis.ConsensusParams != types.DefaultConsensusParams() {
+		t.Fatalf("missing consensus params should be the defaults, got %+v", genesis.ConsensusParams)
+	}
+}
+
+func TestGenesis_Validate(t *testing.T) {
+	invalid := map[string]func(g *types.Genesis){
+		"chain id": func(g *types.Genesis) { g.ChainId = "" },
+		"validators": func(g *types.Genesis) { g.Validators = nil },
+		"voting power": func(g *types.Genesis) { g.Validators[0].VotingPower = 0 },
+		"propose timeout": func(g *types.Genesis) { g.ConsensusParams.ProposeTimeout = 0 },
+		"max timeout": func(g *types.Genesis) { g.ConsensusParams.MaxTimeout = 1 },
+		"max block size": func(g *types.Genesis) { g.ConsensusParams.MaxBlockSize = 0 },
+		"max transactions": func(g *types.Genesis) { g.ConsensusParams.MaxTransactions = 0 },
+		"max evidence age": func(g *types.Genesis) { g.ConsensusParams.MaxEvidenceAge = 0 },
+	}
+	for name, change := range invalid {
+		genesis := types.NewGenesis("test-chain", newTestValidators(t, 1))
+		if err := genesis.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		change(genesis)
+		if err := genesis.Validate(); err == nil {
+			t.Fatalf("genesis with invalid %s should be rejected", name)
+		}
+	}
+}
+
+func TestNewGenesisBlock(t *testing.T) {
+	genesis := types.NewGenesis("test-chain", newTestValidators(t, 1, 2, 3))
+	block, err := types.NewGenesisBlock(genesis, encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := block.Header()
+	if header.Height() != 1 || !header.PreviousId.Equals(genesis.Hash(encoding.MarshalBinary)) {
+		t.Fatalf("genesis block should be at height 1 and link to the genesis hash")
+	}
+	validatorsHash, err := genesis.Validators.Hash(encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.ValidatorsHash.Equals(validatorsHash) || !header.NextValidatorsHash.Equals(validatorsHash) {
+		t.Fatal("genesis block should commit to the initial validators")
+	}
+	if !header.VerifyId(encoding.MarshalBinary) {
+		t.Fatal("genesis block id does not match its header")
+	}
+	// any change of the genesis leads to another chain
+	genesis.AppState = json.RawMessage(`{}`)
+	other, err := types.NewGenesisBlock(genesis, encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Id().Equals(block.Id()) {
+		t.Fatal("genesis blocks of different app states should differ")
+	}
+}
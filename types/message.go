@@ -3,8 +3,10 @@ package types
 import (
 	"time"
 	"bft/crypto"
-	"log"
+	"errors"
+	"fmt"
 	"crypto/sha256"
+	"crypto/rand"
 )
 
 type MessageType uint8
@@ -13,8 +15,32 @@ const (
 	ProposalMessage
 	VoteMessage
 	SyncRequestMessage
+	BlockMessage
+	TransactionMessage
+	SyncErrorMessage
 )
 
+func (mt MessageType) String() string {
+	switch mt {
+	case HandshakeMessage:
+		return "Handshake"
+	case ProposalMessage:
+		return "Proposal"
+	case VoteMessage:
+		return "Vote"
+	case SyncRequestMessage:
+		return "SyncRequest"
+	case BlockMessage:
+		return "Block"
+	case TransactionMessage:
+		return "Transaction"
+	case SyncErrorMessage:
+		return "SyncError"
+	default:
+		return ""
+	}
+}
+
 type Message struct {
 	Type 	MessageType
 	Payload []byte
@@ -71,70 +97,168 @@ func (m Message) ToSyncRequest(decoder DeserializeFunc) *SyncRequest {
 	return &syncRequest
 }
 
+func (m Message) ToSyncError(decoder DeserializeFunc) (*SyncError, error) {
+	syncError := SyncError{}
+	payload := make([]byte, len(m.Payload))
+	copy(payload, m.Payload)
+	err := decoder(payload, &syncError)
+	if err != nil {
+		return nil, err
+	}
+	return &syncError, nil
+}
+
+func (m Message) ToBlock(decoder DeserializeFunc) (*Block, error) {
+	block := Block{}
+	payload := make([]byte, len(m.Payload))
+	copy(payload, m.Payload)
+	err := decoder(payload, &block)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+func (m Message) ToTransaction(decoder DeserializeFunc) (Transaction, error) {
+	tx := Transaction{}
+	payload := make([]byte, len(m.Payload))
+	copy(payload, m.Payload)
+	err := decoder(payload, &tx)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
 type SyncRequest struct {
 	StartHeight uint64
 	EndHeight uint64
 }
 
+// SyncError answers a sync request which can not be served. BaseHeight is the first height after the genesis whose
+// block the peer still has, 0 if it is unknown.
+type SyncError struct {
+	StartHeight uint64
+	EndHeight uint64
+	BaseHeight uint64
+	Reason string
+}
+
 type Handshake struct {
 	NetworkVersion string
-	ChainId Hash
+	ChainId Hash // hash of the genesis
 	Address string
+	PeerId string // libp2p id of the peer which the handshake is addressed to
 	LastHeightId BlockHeightId
 	Timestamp time.Time
+	Nonce Hash // sender's challenge, the remote peer must echo it back
+	RemoteNonce Hash // echo of the remote peer's challenge, empty in an opening handshake
 	Digest Hash
 	Signature crypto.Signature
 }
 
-func NewHandshake(chainId Hash, address string, lastHeightId BlockHeightId, signer crypto.SignFunc, encoder SerializeFunc) *Handshake {
+// SkewWindow bounds how far a handshake's timestamp may lag behind (Past) or run ahead of (Future) the local clock
+type SkewWindow struct {
+	Past time.Duration
+	Future time.Duration
+}
+
+func DefaultSkewWindow() SkewWindow {
+	return SkewWindow{
+		Past: HandshakePastSkew * time.Second,
+		Future: HandshakeFutureSkew * time.Second,
+	}
+}
+
+func NewNonce() (Hash, error) {
+	nonce := Hash{}
+	_, err := rand.Read(nonce[:])
+	return nonce, err
+}
+
+func NewHandshake(chainId Hash, address string, peerId string, lastHeightId BlockHeightId, nonce Hash, remoteNonce Hash, signer crypto.SignFunc, encoder SerializeFunc) (*Handshake, error) {
 	handshake := Handshake{
 		NetworkVersion: NetworkVersion,
 		ChainId: chainId,
 		Address: address,
+		PeerId: peerId,
 		LastHeightId: lastHeightId,
 		Timestamp: time.Now().UTC(),
+		Nonce: nonce,
+		RemoteNonce: remoteNonce,
 	}
-	buf, err := encoder(handshake)
+	digest, err := handshake.CalculateDigest(encoder)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
-	handshake.Digest = sha256.Sum256(buf)
+	handshake.Digest = digest
 	signature, err := signer(handshake.Digest[:])
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
 	handshake.Signature = signature
-	return &handshake
+	return &handshake, nil
+}
+
+// digest covers every field except the digest and the signature themselves
+func (hs *Handshake) CalculateDigest(encoder SerializeFunc) (Hash, error) {
+	unsigned := *hs
+	unsigned.Digest = Hash{}
+	unsigned.Signature = crypto.Signature{}
+	buf, err := encoder(unsigned)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(buf), nil
 }
 
 func (hs *Handshake) Height() uint64 {
 	return hs.LastHeightId.Height
 }
 
-func (hs *Handshake) IsValid() bool {
+func (hs *Handshake) IsOpening() bool {
+	return hs.RemoteNonce.IsEmpty()
+}
+
+// Validate checks that the handshake carries a chain id, a last height, a challenge and a signature
+func (hs *Handshake) Validate() error {
 	if hs.ChainId.IsEmpty() {
-		log.Println("chain id is empty")
-		return false
+		return errors.New("chain id is empty")
 	}
 	if !hs.LastHeightId.IsValid() {
-		log.Println("height, id are invalid")
-		return false
+		return errors.New("height, id are invalid")
+	}
+	if hs.Nonce.IsEmpty() {
+		return errors.New("nonce is empty")
 	}
 	if !hs.Signature.IsValid() {
-		log.Println("signature is invalid")
-		return false
+		return errors.New("signature is invalid")
 	}
-	return true
+	return nil
 }
 
-func (hs *Handshake) Verify() bool {
-	ts := hs.Timestamp.UnixNano()
-	now := time.Now().UTC().UnixNano()
-	if now - ts > HandshakeTimeout * int64(time.Second) {
-		log.Println("handshake timeout")
-		return false
+// Verify checks that the handshake is addressed to the local peer, that its timestamp is inside the skew window
+// and that it is signed by its sender. Whether RemoteNonce answers our challenge is up to the caller.
+func (hs *Handshake) Verify(localPeerId string, window SkewWindow, encoder SerializeFunc) error {
+	if hs.PeerId != localPeerId {
+		return fmt.Errorf("handshake is addressed to %s, not %s", hs.PeerId, localPeerId)
+	}
+	skew := time.Now().UTC().Sub(hs.Timestamp)
+	if skew > window.Past {
+		return errors.New("handshake timeout")
+	}
+	if -skew > window.Future {
+		return errors.New("handshake is too far in the future")
+	}
+	digest, err := hs.CalculateDigest(encoder)
+	if err != nil {
+		return err
+	}
+	if !digest.Equals(hs.Digest) {
+		return errors.New("handshake digest does not match its content")
+	}
+	if !hs.Signature.Verify(hs.Address, hs.Digest[:]) {
+		return errors.New("handshake signature is invalid")
 	}
-	return hs.Signature.Verify(hs.Address, hs.Digest[:])
+	return nil
 }
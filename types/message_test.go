@@ -0,0 +1,105 @@
+package types_test
+
+import (
+	"testing"
+	"time"
+	"bft/crypto"
+	"bft/encoding"
+	"bft/types"
+)
+
+const localPeerId = "QmLocal"
+
+func newTestHandshake(t *testing.T, peerId string, remoteNonce types.Hash) (*types.Handshake, *crypto.PrivateKey) {
+	privateKey, err := crypto.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := types.NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastHeightId := types.BlockHeightId{Height: 1, Id: types.Hash{1}}
+	address := privateKey.PublicKey().Address()
+	handshake, err := types.NewHandshake(types.Hash{1}, address, peerId, lastHeightId, nonce, remoteNonce, privateKey.Sign, encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handshake, privateKey
+}
+
+func resign(t *testing.T, handshake *types.Handshake, privateKey *crypto.PrivateKey) {
+	digest, err := handshake.CalculateDigest(encoding.MarshalBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake.Digest = digest
+	handshake.Signature, err = privateKey.Sign(digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshake_Verify(t *testing.T) {
+	handshake, _ := newTestHandshake(t, localPeerId, types.Hash{})
+	if err := handshake.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if !handshake.IsOpening() {
+		t.Fatal("handshake without remote nonce should be an opening handshake")
+	}
+	if err := handshake.Verify(localPeerId, types.DefaultSkewWindow(), encoding.MarshalBinary); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshake_ValidateEmptyNonce(t *testing.T) {
+	handshake, _ := newTestHandshake(t, localPeerId, types.Hash{})
+	handshake.Nonce = types.Hash{}
+	if handshake.Validate() == nil {
+		t.Fatal("handshake without a challenge should be invalid")
+	}
+}
+
+func TestHandshake_VerifyPeerId(t *testing.T) {
+	handshake, _ := newTestHandshake(t, "QmOther", types.Hash{})
+	if handshake.Verify(localPeerId, types.DefaultSkewWindow(), encoding.MarshalBinary) == nil {
+		t.Fatal("handshake addressed to another peer should be rejected")
+	}
+}
+
+func TestHandshake_VerifyTamperedNonce(t *testing.T) {
+	handshake, _ := newTestHandshake(t, localPeerId, types.Hash{})
+	handshake.RemoteNonce = types.Hash{2}
+	if handshake.Verify(localPeerId, types.DefaultSkewWindow(), encoding.MarshalBinary) == nil {
+		t.Fatal("handshake whose nonce was changed after signing should be rejected")
+	}
+}
+
+func TestHandshake_VerifySkew(t *testing.T) {
+	window := types.SkewWindow{
+		Past: 2 * time.Second,
+		Future: 500 * time.Millisecond,
+	}
+	handshake, privateKey := newTestHandshake(t, localPeerId, types.Hash{})
+	handshake.Timestamp = time.Now().UTC().Add(-time.Second)
+	resign(t, handshake, privateKey)
+	if err := handshake.Verify(localPeerId, window, encoding.MarshalBinary); err != nil {
+		t.Fatalf("handshake inside the past window should be accepted: %v", err)
+	}
+	handshake.Timestamp = time.Now().UTC().Add(-3 * time.Second)
+	resign(t, handshake, privateKey)
+	if handshake.Verify(localPeerId, window, encoding.MarshalBinary) == nil {
+		t.Fatal("handshake older than the past window should be rejected")
+	}
+	handshake.Timestamp = time.Now().UTC().Add(200 * time.Millisecond)
+	resign(t, handshake, privateKey)
+	if err := handshake.Verify(localPeerId, window, encoding.MarshalBinary); err != nil {
+		t.Fatalf("handshake inside the future window should be accepted: %v", err)
+	}
+	handshake.Timestamp = time.Now().UTC().Add(time.Second)
+	resign(t, handshake, privateKey)
+	if handshake.Verify(localPeerId, window, encoding.MarshalBinary) == nil {
+		t.Fatal("handshake beyond the future window should be rejected")
+	}
+}
@@ -0,0 +1,109 @@
+package types
+
+import (
+	"fmt"
+	"time"
+)
+
+type TimeoutStep uint8
+
+const (
+	ProposeStep TimeoutStep = iota // waiting for the proposal
+	PrepareStep // waiting for +2/3 prepares
+	CommitStep // waiting for +2/3 commits
+)
+
+func (step TimeoutStep) String() string {
+	switch step {
+	case ProposeStep:
+		return "propose"
+	case PrepareStep:
+		return "prepare"
+	case CommitStep:
+		return "commit"
+	default:
+		return "unknown"
+	}
+}
+
+// ConsensusParams must be the same on every validator of a network. The genesis sets the initial params,
+// a block can change them from a future height on.
+type ConsensusParams struct {
+	ProposeTimeout uint64 `json:"propose_timeout"` // milliseconds in round 0
+	PrepareTimeout uint64 `json:"prepare_timeout"` // milliseconds in round 0
+	CommitTimeout uint64 `json:"commit_timeout"` // milliseconds in round 0
+	TimeoutDelta uint64 `json:"timeout_delta"` // milliseconds, the growth of the timeouts doubles every round
+	MaxTimeout uint64 `json:"max_timeout"` // milliseconds
+	MaxBlockSize uint64 `json:"max_block_size"` // bytes of an encoded block
+	MaxTransactions uint64 `json:"max_transactions"` // transactions of a block
+	MaxEvidenceAge uint64 `json:"max_evidence_age"` // blocks after which misbehaviour can not be reported
+}
+
+func DefaultConsensusParams() ConsensusParams {
+	return ConsensusParams{
+		ProposeTimeout: ProposeTimeout,
+		PrepareTimeout: PrepareTimeout,
+		CommitTimeout: CommitTimeout,
+		TimeoutDelta: TimeoutDelta,
+		MaxTimeout: MaxTimeout,
+		MaxBlockSize: MaxBlockSize,
+		MaxTransactions: MaxBlockTransactions,
+		MaxEvidenceAge: MaxEvidenceAge,
+	}
+}
+
+func (p ConsensusParams) Validate() error {
+	if p.ProposeTimeout == 0 || p.PrepareTimeout == 0 || p.CommitTimeout == 0 {
+		return fmt.Errorf("step timeouts should be positive")
+	}
+	if p.MaxTimeout < p.ProposeTimeout || p.MaxTimeout < p.PrepareTimeout || p.MaxTimeout < p.CommitTimeout {
+		return fmt.Errorf("max timeout should not be less than the step timeouts")
+	}
+	if p.MaxBlockSize == 0 {
+		return fmt.Errorf("max block size should be positive")
+	}
+	if p.MaxTransactions == 0 {
+		return fmt.Errorf("max transactions should be positive")
+	}
+	if p.MaxEvidenceAge == 0 {
+		return fmt.Errorf("max evidence age should be positive")
+	}
+	return nil
+}
+
+// Timeout of a step in a round is base + delta * (2^round - 1), at most MaxTimeout. Later rounds wait longer, so
+// honest validators eventually share a round long enough to agree even if the network is slow.
+func (p ConsensusParams) Timeout(step TimeoutStep, round uint64) time.Duration {
+	base := p.ProposeTimeout
+	switch step {
+	case PrepareStep:
+		base = p.PrepareTimeout
+	case CommitStep:
+		base = p.CommitTimeout
+	}
+	timeout := p.MaxTimeout
+	// beyond 63 rounds the growth overflows, the timeout is the max timeout long before
+	if p.TimeoutDelta == 0 {
+		timeout = base
+	} else if round < 63 {
+		growth := (uint64(1) << round) - 1
+		if growth <= (p.MaxTimeout - base) / p.TimeoutDelta {
+			timeout = base + p.TimeoutDelta * growth
+		}
+	}
+	return time.Duration(timeout) * time.Millisecond
+}
+
+// ConsensusParamsUpdate replaces the consensus params from Height on
+type ConsensusParamsUpdate struct {
+	Height uint64
+	Params ConsensusParams
+}
+
+// Validate checks an update of the block at blockHeight, it has to take effect at least ParamsUpdateDelay later
+func (u ConsensusParamsUpdate) Validate(blockHeight uint64) error {
+	if u.Height < blockHeight + ParamsUpdateDelay {
+		return fmt.Errorf("consensus params update of block %d takes effect at %d, before %d", blockHeight, u.Height, blockHeight + ParamsUpdateDelay)
+	}
+	return u.Params.Validate()
+}
@@ -0,0 +1,42 @@
+package types_test
+
+import (
+	"bft/types"
+	"testing"
+	"time"
+)
+
+func TestConsensusParams_Timeout(t *testing.T) {
+	params := types.ConsensusParams{
+		ProposeTimeout: 3000,
+		PrepareTimeout: 1000,
+		CommitTimeout: 2000,
+		TimeoutDelta: 500,
+		MaxTimeout: 20000,
+	}
+	expected := []struct {
+		step types.TimeoutStep
+		round uint64
+		timeout time.Duration
+	}{
+		{types.ProposeStep, 0, 3 * time.Second},
+		{types.PrepareStep, 0, time.Second},
+		{types.CommitStep, 0, 2 * time.Second},
+		{types.ProposeStep, 1, 3500 * time.Millisecond},
+		{types.ProposeStep, 2, 4500 * time.Millisecond},
+		{types.PrepareStep, 3, 4500 * time.Millisecond},
+		{types.CommitStep, 5, 17500 * time.Millisecond},
+		{types.CommitStep, 6, 20 * time.Second},
+		{types.ProposeStep, 63, 20 * time.Second},
+		{types.ProposeStep, 1000, 20 * time.Second},
+	}
+	for _, e := range expected {
+		if timeout := params.Timeout(e.step, e.round); timeout != e.timeout {
+			t.Fatalf("expected %s timeout %v in round %d, got %v", e.step.String(), e.timeout, e.round, timeout)
+		}
+	}
+	params.TimeoutDelta = 0
+	if timeout := params.Timeout(types.PrepareStep, 100); timeout != time.Second {
+		t.Fatalf("timeouts without delta should not grow, got %v", timeout)
+	}
+}
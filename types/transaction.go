@@ -0,0 +1,49 @@
+package types
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Transaction is an opaque payload submitted by clients
+type Transaction []byte
+
+func (tx Transaction) Hash() Hash {
+	return sha256.Sum256(tx)
+}
+
+// Transactions of a block, in the order they are applied
+type Transactions []Transaction
+
+// Hash covers the hashes of the transactions in their order, a block without transactions has an empty hash
+func (txs Transactions) Hash() Hash {
+	if len(txs) == 0 {
+		return Hash{}
+	}
+	hasher := sha256.New()
+	for _, tx := range txs {
+		hash := tx.Hash()
+		hasher.Write(hash[:])
+	}
+	hash := Hash{}
+	copy(hash[:], hasher.Sum(nil))
+	return hash
+}
+
+func (tx Transaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(tx))
+}
+
+func (tx *Transaction) UnmarshalJSON(b []byte) error {
+	hexString := ""
+	if err := json.Unmarshal(b, &hexString); err != nil {
+		return err
+	}
+	data, err := hex.DecodeString(hexString)
+	if err != nil {
+		return err
+	}
+	*tx = data
+	return nil
+}
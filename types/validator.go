@@ -2,11 +2,15 @@ package types
 
 import (
 	"bft/crypto"
+	"fmt"
+	"sort"
+	"crypto/sha256"
 )
 
 type Validator struct {
 	Address string
 	PublicKey crypto.PublicKey
+	VotingPower uint64
 }
 
 func (v Validator) Equals(target Validator) bool {
@@ -15,6 +19,74 @@ func (v Validator) Equals(target Validator) bool {
 
 type Validators []Validator
 
+// ApplyUpdates returns a sorted copy of the validators with the updates applied.
+// An update adds an unknown validator, changes the power of a known one or removes it if its power is zero.
+func (vs Validators) ApplyUpdates(updates Validators) (Validators, error) {
+	result := make(Validators, len(vs))
+	copy(result, vs)
+	for _, update := range updates {
+		index := -1
+		for i, v := range result {
+			if v.Address == update.Address {
+				index = i
+				break
+			}
+		}
+		if update.Address != update.PublicKey.Address() {
+			return nil, fmt.Errorf("address %s does not match public key", update.Address)
+		}
+		switch {
+		case index == -1 && update.VotingPower == 0:
+			return nil, fmt.Errorf("can not remove unknown validator %s", update.Address)
+		case index == -1:
+			result = append(result, update)
+		case !result[index].PublicKey.Equals(update.PublicKey):
+			return nil, fmt.Errorf("public key of validator %s can not be changed", update.Address)
+		case update.VotingPower == 0:
+			result = append(result[:index], result[index+1:]...)
+		default:
+			result[index].VotingPower = update.VotingPower
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("validator set can not be empty")
+	}
+	total := uint64(0)
+	for _, v := range result {
+		if v.VotingPower > MaxTotalVotingPower - total {
+			return nil, fmt.Errorf("total voting power is larger than %d", uint64(MaxTotalVotingPower))
+		}
+		total += v.VotingPower
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// Equals compares two sorted validator sets, including the voting powers
+func (vs Validators) Equals(target Validators) bool {
+	if len(vs) != len(target) {
+		return false
+	}
+	for i := range vs {
+		if !vs[i].Equals(target[i]) || vs[i].VotingPower != target[i].VotingPower {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash identifies the validator set, it does not depend on the order of validators
+func (vs Validators) Hash(encoder SerializeFunc) (Hash, error) {
+	sorted := make(Validators, len(vs))
+	copy(sorted, vs)
+	sort.Sort(sorted)
+	buf, err := encoder(sorted)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
+
 // sort interface
 func (vs Validators) Len() int {
 	return len(vs)
@@ -0,0 +1,70 @@
+package types_test
+
+import (
+	"testing"
+	"bft/crypto"
+	"bft/types"
+)
+
+func newTestValidators(t *testing.T, powers ...uint64) types.Validators {
+	validators := make(types.Validators, 0)
+	for _, power := range powers {
+		privateKey, err := crypto.NewRandomPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		validators = append(validators, types.Validator{
+			Address: privateKey.PublicKey().Address(),
+			PublicKey: *privateKey.PublicKey(),
+			VotingPower: power,
+		})
+	}
+	return validators
+}
+
+func TestValidators_ApplyUpdates(t *testing.T) {
+	validators := newTestValidators(t, 1, 2, 3)
+	added := newTestValidators(t, 4)[0]
+	changed := validators[0]
+	changed.VotingPower = 10
+	removed := validators[1]
+	removed.VotingPower = 0
+	result, err := validators.ApplyUpdates(types.Validators{added, changed, removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("expected 3 validators, got %d", len(result))
+	}
+	powers := make(map[string]uint64, 0)
+	for _, v := range result {
+		powers[v.Address] = v.VotingPower
+	}
+	if powers[added.Address] != 4 || powers[changed.Address] != 10 || powers[validators[2].Address] != 3 {
+		t.Fatalf("unexpected voting powers %v", powers)
+	}
+	if _, ok := powers[removed.Address]; ok {
+		t.Fatal("removed validator is still in the set")
+	}
+	if validators[0].VotingPower != 1 || len(validators) != 3 {
+		t.Fatal("original validators should not be modified")
+	}
+}
+
+func TestValidators_ApplyInvalidUpdates(t *testing.T) {
+	validators := newTestValidators(t, 1, 2)
+	unknown := newTestValidators(t, 0)[0]
+	if _, err := validators.ApplyUpdates(types.Validators{unknown}); err == nil {
+		t.Fatal("removing an unknown validator should fail")
+	}
+	forged := validators[0]
+	forged.PublicKey = newTestValidators(t, 1)[0].PublicKey
+	if _, err := validators.ApplyUpdates(types.Validators{forged}); err == nil {
+		t.Fatal("changing the public key of a validator should fail")
+	}
+	first, second := validators[0], validators[1]
+	first.VotingPower, second.VotingPower = 0, 0
+	if _, err := validators.ApplyUpdates(types.Validators{first, second}); err == nil {
+		t.Fatal("removing every validator should fail")
+	}
+}
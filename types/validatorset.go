@@ -3,26 +3,45 @@ package types
 import (
 	"sync"
 	"sort"
-	"log"
+	"fmt"
 )
 
 type ValidatorSet struct {
 	rwMutex sync.RWMutex
 	validators Validators
 	self Validator
-	proposer *Validator
+	height uint64 // height of the blocks which the set signs
+	priorities []int64 // proposer priorities before the turn of round 0, in the order of validators
 }
 
+// NewValidatorSet is the set of the first height, every validator starts with a zero priority
 func NewValidatorSet(validators Validators, address string) *ValidatorSet {
+	sorted := make(Validators, len(validators))
+	copy(sorted, validators)
+	sort.Sort(sorted)
+	return newValidatorSet(1, sorted, make([]int64, len(sorted)), address)
+}
+
+// RestoreValidatorSet continues the rotation of a set from the priorities it had at height, validators are sorted
+func RestoreValidatorSet(height uint64, validators Validators, priorities []int64, address string) (*ValidatorSet, error) {
+	if len(priorities) != len(validators) {
+		return nil, fmt.Errorf("%d priorities for %d validators", len(priorities), len(validators))
+	}
+	if !sort.IsSorted(validators) {
+		return nil, fmt.Errorf("validators are not sorted")
+	}
+	return newValidatorSet(height, validators, priorities, address), nil
+}
+
+func newValidatorSet(height uint64, validators Validators, priorities []int64, address string) *ValidatorSet {
 	vs := &ValidatorSet{}
 	vs.validators = validators
-	sort.Sort(vs.validators)
-	if vs.Size() > 0 {
-		vs.proposer = vs.GetByIndex(0)
-	}
+	vs.height = height
+	vs.priorities = priorities
 	i, self := vs.GetByAddress(address)
 	if i == -1 {
-		log.Fatal("self address is invalid")
+		// the local node follows the chain but it does not vote
+		self = Validator{Address: address}
 	}
 	vs.self = self
 	return vs
@@ -32,11 +51,12 @@ func (vs *ValidatorSet) Size() int {
 	return len(vs.GetValidators())
 }
 
+// GetByIndex returns nil if the index is out of bounds
 func (vs *ValidatorSet) GetByIndex(i uint64) *Validator {
 	vs.rwMutex.RLock()
 	defer vs.rwMutex.RUnlock()
-	if i >= uint64(vs.Size()) {
-		log.Fatal("index is out of bounds")
+	if i >= uint64(len(vs.validators)) {
+		return nil
 	}
 	return &vs.validators[i]
 }
@@ -50,31 +70,126 @@ func (vs *ValidatorSet) GetByAddress(address string) (int, Validator) {
 	return -1, Validator{}
 }
 
+func (vs *ValidatorSet) TotalVotingPower() uint64 {
+	total := uint64(0)
+	for _, v := range vs.GetValidators() {
+		total += v.VotingPower
+	}
+	return total
+}
+
+// HasTwoThirdsMajority reports whether power is more than 2/3 of the total voting power
+func (vs *ValidatorSet) HasTwoThirdsMajority(power uint64) bool {
+	return power*3 > vs.TotalVotingPower()*2
+}
+
+// HasOneThird reports whether power is more than 1/3 of the total voting power,
+// so that at least one honest validator is included
+func (vs *ValidatorSet) HasOneThird(power uint64) bool {
+	return power*3 > vs.TotalVotingPower()
+}
+
+// VotingPowerOf sums the power of the validators that cast votes, counting each voter once
+func (vs *ValidatorSet) VotingPowerOf(votes []Vote) uint64 {
+	power := uint64(0)
+	voters := make(map[string]bool, 0)
+	for _, vote := range votes {
+		if voters[vote.Address] {
+			continue
+		}
+		i, voter := vs.GetByAddress(vote.Address)
+		if i == -1 {
+			continue
+		}
+		voters[vote.Address] = true
+		power += voter.VotingPower
+	}
+	return power
+}
+
 func (vs *ValidatorSet) GetValidators() Validators {
 	vs.rwMutex.RLock()
 	defer vs.rwMutex.RUnlock()
 	return vs.validators
 }
 
-func (vs *ValidatorSet) IsProposer(validator Validator) bool {
-	i, v := vs.GetByAddress(validator.Address)
-	if i == -1 {
-		log.Printf("wrong proposer. expected %s, got %s\n", vs.proposer.Address, validator.Address)
+// IsValidator reports whether the local node belongs to the set
+func (vs *ValidatorSet) IsValidator() bool {
+	i, _ := vs.GetByAddress(vs.Self().Address)
+	return i != -1
+}
+
+func (vs *ValidatorSet) IsProposer(validator Validator, view View) bool {
+	proposer := vs.GetProposer(view)
+	if proposer == nil {
 		return false
 	}
-	return v.Equals(*vs.Proposer())
+	return proposer.Equals(validator)
 }
 
-func (vs *ValidatorSet) Proposer() *Validator {
+// GetProposer returns the proposer of a round of the set's height, or nil for a view of another height.
+// Validators take turns in smooth weighted round-robin order, the priority scheme of Tendermint. The set carries
+// the priorities from height to height and every round is one more turn, so over many heights every validator
+// proposes as often as its share of the voting power. A round costs one pass over the validators.
+func (vs *ValidatorSet) GetProposer(view View) *Validator {
+	if view.Height != vs.Height() {
+		return nil
+	}
+	validators := vs.GetValidators()
+	priorities := vs.Priorities()
+	total := int64(vs.TotalVotingPower())
+	proposer := -1
+	for round := uint64(0); round <= view.Round; round++ {
+		proposer = takeTurn(validators, priorities, total)
+	}
+	if proposer == -1 {
+		return nil
+	}
+	return vs.GetByIndex(uint64(proposer))
+}
+
+// NextHeight returns the set of the next height, which is signed by validators. The turn of round 0 of this height
+// is taken. Validators which stay keep their priority, new ones start behind the others, so a change of the
+// validators does not restart the rotation.
+func (vs *ValidatorSet) NextHeight(validators Validators) *ValidatorSet {
+	current := vs.GetValidators()
+	priorities := vs.Priorities()
+	takeTurn(current, priorities, int64(vs.TotalVotingPower()))
+	if current.Equals(validators) {
+		return newValidatorSet(vs.Height() + 1, validators, priorities, vs.Self().Address)
+	}
+	total := int64(0)
+	for _, v := range validators {
+		total += int64(v.VotingPower)
+	}
+	next := make([]int64, len(validators))
+	for i, v := range validators {
+		j, _ := vs.GetByAddress(v.Address)
+		if j == -1 {
+			// a new validator waits about one period before it proposes
+			next[i] = -(total + total / 8)
+			continue
+		}
+		next[i] = priorities[j]
+	}
+	rescalePriorities(next, total)
+	return newValidatorSet(vs.Height() + 1, validators, next, vs.Self().Address)
+}
+
+// Height is the height of the blocks which the set signs
+func (vs *ValidatorSet) Height() uint64 {
 	vs.rwMutex.RLock()
 	defer vs.rwMutex.RUnlock()
-	return vs.proposer
+	return vs.height
 }
 
-func (vs *ValidatorSet) setProposer(proposer *Validator) {
-	vs.rwMutex.Lock()
-	defer vs.rwMutex.Unlock()
-	vs.proposer = proposer
+// Priorities returns a copy of the proposer priorities before the turn of round 0
+func (vs *ValidatorSet) Priorities() []int64 {
+	vs.rwMutex.RLock()
+	defer vs.rwMutex.RUnlock()
+	priorities := make([]int64, len(vs.priorities))
+	copy(priorities, vs.priorities)
+	return priorities
 }
 
 func (vs *ValidatorSet) Self() Validator {
@@ -83,15 +198,53 @@ func (vs *ValidatorSet) Self() Validator {
 	return vs.self
 }
 
-func (vs *ValidatorSet) CalculateProposer(round uint64) {
-	offset := round
-	if vs.Proposer() != nil {
-		i, _ := vs.GetByAddress(vs.Proposer().Address)
-		if i == -1 {
-			log.Fatal("current proposer is invalid")
+// takeTurn grows the priority of every validator by its voting power, the validator with the highest priority
+// proposes (the lowest address wins a tie) and its priority drops by the total power. It returns the index of the
+// proposer, or -1 if no validator has voting power. The priorities keep their sum.
+func takeTurn(validators Validators, priorities []int64, total int64) int {
+	proposer := -1
+	for i, v := range validators {
+		if v.VotingPower == 0 {
+			continue
 		}
-		offset = uint64(i) + round + 1
+		priorities[i] += int64(v.VotingPower)
+		if proposer == -1 || priorities[i] > priorities[proposer] {
+			proposer = i
+		}
+	}
+	if proposer != -1 {
+		priorities[proposer] -= total
+	}
+	return proposer
+}
+
+// rescalePriorities keeps the priorities of a changed set within twice the total power of each other and centers
+// them on zero, like after any number of turns of an unchanged set
+func rescalePriorities(priorities []int64, total int64) {
+	if len(priorities) == 0 || total == 0 {
+		return
+	}
+	min, max := priorities[0], priorities[0]
+	for _, p := range priorities {
+		if p < min {
+			min = p
+		}
+		if p > max {
+			max = p
+		}
+	}
+	if window := 2 * total; max - min > window {
+		ratio := (max - min + window - 1) / window
+		for i := range priorities {
+			priorities[i] /= ratio
+		}
+	}
+	sum := int64(0)
+	for _, p := range priorities {
+		sum += p
+	}
+	average := sum / int64(len(priorities))
+	for i := range priorities {
+		priorities[i] -= average
 	}
-	i := offset % uint64(vs.Size())
-	vs.setProposer(vs.GetByIndex(i))
 }
\ No newline at end of file
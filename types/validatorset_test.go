@@ -0,0 +1,175 @@
+package types_test
+
+import (
+	"testing"
+	"math"
+	"bft/types"
+)
+
+// proposerSchedule follows an unchanged set for n heights and returns the proposers of round 0, the set is left at
+// the height after them
+func proposerSchedule(vs **types.ValidatorSet, n uint64) []string {
+	schedule := make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		current := *vs
+		proposer := current.GetProposer(types.View{Round: 0, Height: current.Height()})
+		schedule = append(schedule, proposer.Address)
+		*vs = current.NextHeight(current.GetValidators())
+	}
+	return schedule
+}
+
+func countProposers(schedule []string) map[string]uint64 {
+	counts := make(map[string]uint64, 0)
+	for _, address := range schedule {
+		counts[address]++
+	}
+	return counts
+}
+
+func TestValidatorSet_ProposerFairness(t *testing.T) {
+	validators := newTestValidators(t, 1, 2, 3, 10)
+	vs := types.NewValidatorSet(validators, validators[0].Address)
+	total := vs.TotalVotingPower()
+	periods := uint64(1000)
+	schedule := proposerSchedule(&vs, total * periods)
+	counts := countProposers(schedule)
+	for _, v := range vs.GetValidators() {
+		if counts[v.Address] != v.VotingPower * periods {
+			t.Fatalf("validator with power %d proposed %d times, expected %d", v.VotingPower, counts[v.Address], v.VotingPower * periods)
+		}
+	}
+	// every window of one period is fair, wherever it starts
+	for from := uint64(0); from < total; from++ {
+		counts := countProposers(schedule[from:from + total])
+		for _, v := range vs.GetValidators() {
+			if counts[v.Address] != v.VotingPower {
+				t.Fatalf("window from %d: validator with power %d proposed %d times", from, v.VotingPower, counts[v.Address])
+			}
+		}
+	}
+}
+
+func TestValidatorSet_ProposerFairnessWithLargePowers(t *testing.T) {
+	// coprime powers would make a period of 3 * 10^9 heights
+	validators := newTestValidators(t, 1000000007, 1000000009, 999999937)
+	vs := types.NewValidatorSet(validators, validators[0].Address)
+	heights := uint64(30000)
+	counts := countProposers(proposerSchedule(&vs, heights))
+	total := float64(vs.TotalVotingPower())
+	for _, v := range vs.GetValidators() {
+		share := float64(heights) * float64(v.VotingPower) / total
+		if math.Abs(float64(counts[v.Address]) - share) > 1 {
+			t.Fatalf("validator with power %d proposed %d times, its share is %f", v.VotingPower, counts[v.Address], share)
+		}
+	}
+}
+
+func TestValidatorSet_ProposerIsSmooth(t *testing.T) {
+	validators := newTestValidators(t, 1, 1, 1, 5)
+	vs := types.NewValidatorSet(validators, validators[0].Address)
+	schedule := proposerSchedule(&vs, 8 * 100)
+	// a validator with 1/8 of the power never waits longer than a period
+	last := make(map[string]int, 0)
+	for height, address := range schedule {
+		_, proposer := vs.GetByAddress(address)
+		if previous, ok := last[address]; ok && proposer.VotingPower == 1 && height - previous > 8 {
+			t.Fatalf("validator waited %d heights", height - previous)
+		}
+		last[address] = height
+	}
+	// in every window the number of proposals stays close to the share of voting power,
+	// a schedule that lets the heaviest validator propose five times in a row would be off by 1.875
+	for _, v := range vs.GetValidators() {
+		for from := 0; from < 8; from++ {
+			count := 0
+			for length := 1; length <= 8; length++ {
+				if schedule[from + length - 1] == v.Address {
+					count++
+				}
+				share := float64(length) * float64(v.VotingPower) / 8
+				if math.Abs(float64(count) - share) >= 1.5 {
+					t.Fatalf("validator with power %d proposed %d times in %d heights", v.VotingPower, count, length)
+				}
+			}
+		}
+	}
+}
+
+func TestValidatorSet_ProposerIsDeterministic(t *testing.T) {
+	validators := newTestValidators(t, 3, 1, 4, 1, 5)
+	reversed := make(types.Validators, 0)
+	for i := len(validators) - 1; i >= 0; i-- {
+		reversed = append(reversed, validators[i])
+	}
+	first := types.NewValidatorSet(validators, validators[0].Address)
+	second := types.NewValidatorSet(reversed, reversed[0].Address)
+	for i := range reversed {
+		// the set sorts its own copy, the caller keeps its order, one of both slices is not sorted
+		if reversed[i].Address != validators[len(validators) - 1 - i].Address {
+			t.Fatal("validators of the caller should not be reordered")
+		}
+	}
+	proposerSchedule(&first, 7)
+	proposerSchedule(&second, 7)
+	// a set restored from the priorities continues the rotation
+	restored, err := types.RestoreValidatorSet(first.Height(), first.GetValidators(), first.Priorities(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := uint64(0); round < 20; round++ {
+		view := types.View{Round: round, Height: first.Height()}
+		expected := first.GetProposer(view)
+		// the answer does not depend on the order of the validators or on previous calls
+		if address := second.GetProposer(view).Address; address != expected.Address {
+			t.Fatalf("view %v: expected %s, got %s", view, expected.Address, address)
+		}
+		if !restored.IsProposer(*expected, view) {
+			t.Fatalf("view %v: proposer is not recognized", view)
+		}
+	}
+	if first.GetProposer(types.View{Round: 0, Height: first.Height() + 1}) != nil {
+		t.Fatal("a set should not elect the proposer of another height")
+	}
+	// a later round moves to the next turn
+	view := types.View{Round: 1, Height: first.Height()}
+	next := first.NextHeight(first.GetValidators())
+	if first.GetProposer(view).Address != next.GetProposer(types.View{Round: 0, Height: next.Height()}).Address {
+		t.Fatal("round 1 of a height and round 0 of the next height should share a turn")
+	}
+	if _, err := types.RestoreValidatorSet(1, first.GetValidators(), []int64{1}, ""); err == nil {
+		t.Fatal("priorities of another set should be rejected")
+	}
+}
+
+func TestValidatorSet_ProposerAfterChanges(t *testing.T) {
+	validators := newTestValidators(t, 1, 1, 1, 1)
+	vs := types.NewValidatorSet(validators, validators[0].Address)
+	proposerSchedule(&vs, 3)
+	added := newTestValidators(t, 4)[0]
+	removed := vs.GetValidators()[0]
+	removed.VotingPower = 0
+	changed, err := vs.GetValidators().ApplyUpdates(types.Validators{added, removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs = vs.NextHeight(changed)
+	total := int64(vs.TotalVotingPower())
+	schedule := proposerSchedule(&vs, 7 * 100)
+	// the new validator does not jump the queue
+	if schedule[0] == added.Address {
+		t.Fatal("a new validator should not propose right away")
+	}
+	counts := countProposers(schedule)
+	if counts[removed.Address] != 0 {
+		t.Fatal("a removed validator should not propose")
+	}
+	if counts[added.Address] < 4 * 100 - 1 || counts[added.Address] > 4 * 100 + 1 {
+		t.Fatalf("the new validator proposed %d times", counts[added.Address])
+	}
+	for _, priority := range vs.Priorities() {
+		if priority > 2 * total || priority < -2 * total {
+			t.Fatalf("priority %d is out of bounds", priority)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"bft/crypto"
+	"crypto/sha256"
 )
 
 type VoteType uint8
@@ -33,3 +34,15 @@ type Vote struct {
 	BlockId 	Hash
 	Signature 	crypto.Signature
 }
+
+// CalculateHash returns the digest which the voter signs, it covers every field except the hash and the signature
+func (v Vote) CalculateHash(encoder SerializeFunc) (Hash, error) {
+	unsigned := v
+	unsigned.Hash = Hash{}
+	unsigned.Signature = crypto.Signature{}
+	buf, err := encoder(unsigned)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
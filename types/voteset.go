@@ -11,6 +11,7 @@ type VoteSet struct {
 	voteType VoteType
 	validatorSet *ValidatorSet
 	votes map[string]Vote
+	power uint64 // accumulated voting power of votes
 }
 
 func NewVoteSet(view View, voteType VoteType, validatorSet *ValidatorSet) *VoteSet {
@@ -35,7 +36,12 @@ func (vs *VoteSet) AddVote(vote Vote, verify bool) error {
 	if _, ok := vs.votes[vote.Address]; ok {
 		return fmt.Errorf("voter %s sent duplicate vote", vote.Address)
 	}
+	index, voter := vs.validatorSet.GetByAddress(vote.Address)
+	if index == -1 {
+		return fmt.Errorf("invalid voter address: %s", vote.Address)
+	}
 	vs.votes[vote.Address] = vote
+	vs.power += voter.VotingPower
 	return nil
 }
 
@@ -70,6 +76,12 @@ func (vs *VoteSet) Votes() map[string]Vote {
 	return vs.votes
 }
 
+func (vs *VoteSet) VotingPower() uint64 {
+	vs.mutex.RLock()
+	defer vs.mutex.RUnlock()
+	return vs.power
+}
+
 func (vs *VoteSet) Size() int {
 	vs.mutex.RLock()
 	defer vs.mutex.RUnlock()